@@ -53,6 +53,10 @@ type IterValue struct {
 	Unit       xtime.Unit
 	Metadata   ts.Metadata
 	Annotation []byte
+
+	// ID if set overrides the series ID that is otherwise generated from
+	// the tags, it is only used for unaggregated writes.
+	ID []byte
 }
 
 // DownsampleAndWriteIter is an interface that can be implemented to use
@@ -93,6 +97,71 @@ type BatchError interface {
 	LastError() error
 }
 
+// seriesError is an error encountered writing a single series of a batch,
+// it retains the index of the series within the batch.
+type seriesError struct {
+	inner error
+	index int
+}
+
+// NewSeriesError returns an error for the series at the given index within
+// a batch.
+func NewSeriesError(err error, index int) error {
+	return seriesError{inner: err, index: index}
+}
+
+func (e seriesError) Error() string {
+	return e.inner.Error()
+}
+
+func (e seriesError) InnerError() error {
+	return e.inner
+}
+
+// SeriesErrorIndex returns the index within the batch of the series that
+// the error was returned for, the result is false if the error was not
+// specific to a single series.
+func SeriesErrorIndex(err error) (int, bool) {
+	for err != nil {
+		if e, ok := err.(seriesError); ok {
+			return e.index, true
+		}
+		err = xerrors.InnerError(err)
+	}
+	return 0, false
+}
+
+// aggregatedError is an error encountered writing a series of a batch to
+// the downsampler rather than writing it unaggregated to storage.
+type aggregatedError struct {
+	inner error
+}
+
+// NewAggregatedError returns an error encountered writing to the downsampler.
+func NewAggregatedError(err error) error {
+	return aggregatedError{inner: err}
+}
+
+func (e aggregatedError) Error() string {
+	return e.inner.Error()
+}
+
+func (e aggregatedError) InnerError() error {
+	return e.inner
+}
+
+// IsAggregatedError returns true if the error was encountered writing to the
+// downsampler rather than writing unaggregated to storage.
+func IsAggregatedError(err error) bool {
+	for err != nil {
+		if _, ok := err.(aggregatedError); ok {
+			return true
+		}
+		err = xerrors.InnerError(err)
+	}
+	return false
+}
+
 // WriteOptions contains overrides for the downsampling mapping
 // rules and storage policies for a given write.
 type WriteOptions struct {
@@ -101,6 +170,16 @@ type WriteOptions struct {
 
 	DownsampleOverride bool
 	WriteOverride      bool
+
+	// FailFast stops a batch write at the first error and returns only that
+	// error, cancelling the writes that are in progress, rather than writing
+	// every series and returning all of the errors.
+	FailFast bool
+
+	// Annotations is provenance metadata for the write, such as the source
+	// cluster or pipeline version, that is not written as labels. Writers
+	// that do not persist annotations ignore them.
+	Annotations map[string]string
 }
 
 type downsamplerAndWriterMetrics struct {
@@ -152,7 +231,7 @@ func (d *downsamplerAndWriter) Write(
 		var err error
 		dropUnaggregated, err = d.writeToDownsampler(tags, datapoints, unit, overrides)
 		if err != nil {
-			multiErr = multiErr.Add(err)
+			multiErr = multiErr.Add(NewAggregatedError(err))
 		}
 	}
 
@@ -358,12 +437,22 @@ func (d *downsamplerAndWriter) WriteBatch(
 		wg       sync.WaitGroup
 		multiErr xerrors.MultiError
 		errLock  sync.Mutex
+		cancel   = func() {}
 		addError = func(err error) {
 			errLock.Lock()
-			multiErr = multiErr.Add(err)
+			if !overrides.FailFast || multiErr.Empty() {
+				multiErr = multiErr.Add(err)
+			}
 			errLock.Unlock()
+			if overrides.FailFast {
+				cancel()
+			}
 		}
 	)
+	if overrides.FailFast {
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+	}
 
 	if d.shouldDownsample(overrides) {
 		if errs := d.writeAggregatedBatch(iter, overrides); !errs.Empty() {
@@ -371,7 +460,10 @@ func (d *downsamplerAndWriter) WriteBatch(
 			// ok not to use the addError method here as we are running single
 			// threaded at this point.
 			for _, err := range errs.Errors() {
-				multiErr = multiErr.Add(err)
+				multiErr = multiErr.Add(NewAggregatedError(err))
+			}
+			if overrides.FailFast {
+				return multiErr
 			}
 		}
 	}
@@ -391,14 +483,21 @@ func (d *downsamplerAndWriter) WriteBatch(
 			storagePolicies = unaggregatedStoragePolicies
 		}
 
+		index := -1
 		for iter.Next() {
+			if overrides.FailFast && ctx.Err() != nil {
+				// A write has failed so the remaining series are not written.
+				break
+			}
+			index++
 			value := iter.Current()
 			if value.Metadata.DropUnaggregated {
 				d.metrics.dropped.Inc(1)
 				continue
 			}
 			for _, p := range storagePolicies {
-				p := p // Capture for lambda.
+				p := p         // Capture for lambda.
+				index := index // Capture for lambda.
 				wg.Add(1)
 				d.workerPool.Go(func() {
 					// NB(r): Allocate the write query at the top
@@ -411,12 +510,13 @@ func (d *downsamplerAndWriter) WriteBatch(
 						Unit:       value.Unit,
 						Annotation: value.Annotation,
 						Attributes: storageAttributesFromPolicy(p),
+						ID:         value.ID,
 					})
 					if err == nil {
 						err = d.store.Write(ctx, writeQuery)
 					}
 					if err != nil {
-						addError(err)
+						addError(NewSeriesError(err, index))
 					}
 					wg.Done()
 				})
@@ -444,12 +544,17 @@ func (d *downsamplerAndWriter) writeAggregatedBatch(
 
 	defer appender.Finalize()
 
+	index := -1
 	for iter.Next() {
+		if overrides.FailFast && !multiErr.Empty() {
+			return multiErr
+		}
+		index++
 		appender.NextMetric()
 
 		value := iter.Current()
 		if err := value.Tags.Validate(); err != nil {
-			multiErr = multiErr.Add(err)
+			multiErr = multiErr.Add(NewSeriesError(err, index))
 			continue
 		}
 
@@ -486,7 +591,7 @@ func (d *downsamplerAndWriter) writeAggregatedBatch(
 
 		result, err := appender.SamplesAppender(opts)
 		if err != nil {
-			multiErr = multiErr.Add(err)
+			multiErr = multiErr.Add(NewSeriesError(err, index))
 			continue
 		}
 
@@ -506,7 +611,10 @@ func (d *downsamplerAndWriter) writeAggregatedBatch(
 			if err != nil {
 				// If we see an error break out so we can try processing the
 				// next datapoint.
-				multiErr = multiErr.Add(err)
+				multiErr = multiErr.Add(NewSeriesError(err, index))
+				if overrides.FailFast {
+					break
+				}
 			}
 		}
 	}
@@ -245,10 +245,16 @@ func TestDownsampleAndWriteWithBadTags(t *testing.T) {
 	multiErr, ok := xerrors.GetInnerMultiError(err)
 	require.True(t, ok)
 	require.Equal(t, 2, multiErr.NumErrors())
-	// Make sure all are invalid params errors.
+	// Make sure all are invalid params errors and only the downsample error
+	// is an aggregated error.
+	var numAggregated int
 	for _, err := range multiErr.Errors() {
 		require.True(t, xerrors.IsInvalidParams(err))
+		if IsAggregatedError(err) {
+			numAggregated++
+		}
 	}
+	require.Equal(t, 1, numAggregated)
 }
 
 func TestDownsampleAndWriteWithDownsampleOverridesAndNoMappingRules(t *testing.T) {
@@ -544,10 +550,48 @@ func TestDownsampleAndWriteBatchBadTags(t *testing.T) {
 	multiErr, ok := err.(xerrors.MultiError)
 	require.True(t, ok)
 	require.Equal(t, 2, multiErr.NumErrors())
-	// Make sure all are invalid params errors.
+	// Make sure all are invalid params errors for the first series.
 	for _, err := range multiErr.Errors() {
 		require.True(t, xerrors.IsInvalidParams(err))
+		index, ok := SeriesErrorIndex(err)
+		require.True(t, ok)
+		require.Equal(t, 0, index)
+	}
+}
+
+func TestDownsampleAndWriteBatchFailFast(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl,
+		testDownsamplerAndWriterOptions{})
+
+	mockMetricsAppender := downsample.NewMockMetricsAppender(ctrl)
+
+	entries := []testIterEntry{
+		{tags: testBadTags, datapoints: testDatapoints1, attributes: testAttributesGauge, annotation: testAnnotation1},
+		{tags: testTags2, datapoints: testDatapoints2, attributes: testAttributesGauge, annotation: testAnnotation2},
 	}
+
+	// Expect to stop at the bad tags of the first series without
+	// downsampling or writing any of the other series.
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+	mockMetricsAppender.EXPECT().NextMetric().Times(1)
+	mockMetricsAppender.EXPECT().Finalize()
+
+	iter := newTestIter(entries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, WriteOptions{
+		FailFast: true,
+	})
+	require.Error(t, err)
+
+	multiErr, ok := err.(xerrors.MultiError)
+	require.True(t, ok)
+	require.Equal(t, 1, multiErr.NumErrors())
+	require.True(t, xerrors.IsInvalidParams(multiErr.Errors()[0]))
+	index, ok := SeriesErrorIndex(multiErr.Errors()[0])
+	require.True(t, ok)
+	require.Equal(t, 0, index)
 }
 
 func TestDownsampleAndWriteBatchDifferentTypes(t *testing.T) {
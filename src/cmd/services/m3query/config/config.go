@@ -154,6 +154,9 @@ type Configuration struct {
 	// WriteForwarding is the write forwarding options.
 	WriteForwarding WriteForwardingConfiguration `yaml:"writeForwarding"`
 
+	// PromRemoteWrite is the Prometheus remote write handler configuration.
+	PromRemoteWrite PromRemoteWriteConfiguration `yaml:"promRemoteWrite"`
+
 	// Downsample configures how the metrics should be downsampled.
 	Downsample downsample.Configuration `yaml:"downsample"`
 
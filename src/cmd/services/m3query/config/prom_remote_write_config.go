@@ -0,0 +1,777 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/models"
+)
+
+// PromRemoteWriteConfiguration is the Prometheus remote write handler
+// configuration.
+type PromRemoteWriteConfiguration struct {
+	// MaxDecompressedBodySize is the max size in bytes of a decompressed
+	// write request body, if zero then no limit is enforced.
+	MaxDecompressedBodySize int `yaml:"maxDecompressedBodySize" validate:"min=0"`
+
+	// MaxDecompressionRatio is the max ratio of the size of a decompressed
+	// write request body to its compressed size, bodies that decompress to
+	// more are rejected with a 400 status. This guards against small bodies
+	// that decompress to far more than expected. If zero then no limit is
+	// enforced.
+	MaxDecompressionRatio int `yaml:"maxDecompressionRatio" validate:"min=0"`
+
+	// LowerCaseLabelNames folds all label names to lower case before the
+	// labels are sorted and converted to tags, so that sources that differ
+	// only in label name casing (e.g. "Host" and "host") write to the same
+	// series. This changes the identity of any series written with upper
+	// case label names and so must only be enabled deliberately, and if a
+	// series has two label names that only differ by case the write for
+	// that series will fail as a duplicate tag.
+	LowerCaseLabelNames bool `yaml:"lowerCaseLabelNames"`
+
+	// EncodedSamples enables write requests with the encoded samples content
+	// type, where the samples of each series are sent as a single M3TSZ
+	// stream, with delta of delta encoded timestamps and XOR encoded values,
+	// in field 103 of the TimeSeries message rather than as individual
+	// samples. Requests with the content type are rejected with a 400 status
+	// if not enabled.
+	EncodedSamples bool `yaml:"encodedSamples"`
+
+	// TrustSortedLabels enables the labels sorted header, which clients that
+	// already sort the labels of each series by name set to skip sorting the
+	// labels again. Requests with the header set are rejected with a 400
+	// status if the labels of any series are not sorted.
+	TrustSortedLabels bool `yaml:"trustSortedLabels"`
+
+	// ResultTrailers allows HTTP/2 clients to opt in to receiving a 200 status
+	// before the series of a request are written, with the result of the
+	// write reported in trailers, by setting the result trailers header. The
+	// header is ignored for other clients and when not allowed.
+	ResultTrailers bool `yaml:"resultTrailers"`
+
+	// RequiredLabels is a set of label names that every series must have,
+	// requests with a series that is missing any of the labels are rejected
+	// with a 400 status. If empty then no labels are required.
+	RequiredLabels []string `yaml:"requiredLabels"`
+
+	// AllowTimestampOffset enables the timestamp offset header which shifts
+	// the timestamps of all samples in a request, this is intended for
+	// replaying traffic into test clusters and should not be enabled for
+	// production clusters.
+	AllowTimestampOffset bool `yaml:"allowTimestampOffset"`
+
+	// DisableIngestLatencyMetric skips recording the age of every written
+	// sample in the ingest latency histogram, which is a measurable cost
+	// for nodes that ingest at high throughput.
+	DisableIngestLatencyMetric bool `yaml:"disableIngestLatencyMetric"`
+
+	// IngestLatencyRecording configures recording the ingest latency of
+	// written samples asynchronously rather than before responding.
+	IngestLatencyRecording PromRemoteWriteIngestLatencyRecordingConfiguration `yaml:"ingestLatencyRecording"`
+
+	// RateLimit configures limiting the rate of samples written per client.
+	RateLimit PromRemoteWriteRateLimitConfiguration `yaml:"rateLimit"`
+
+	// HistogramBuckets is the set of histogram bucket boundaries to retain
+	// for classic Prometheus histograms, the "_bucket" series of a histogram
+	// are collapsed to these boundaries before being written. Boundaries
+	// should be a subset of the source boundaries for counts to be exact,
+	// otherwise a retained boundary reports the count of the nearest source
+	// boundary below it. If empty then histograms are written unchanged.
+	HistogramBuckets []float64 `yaml:"histogramBuckets"`
+
+	// SummaryGrouping enables grouping the quantile, "_sum" and "_count"
+	// series of classic Prometheus summaries, the series of each summary are
+	// given summary type metadata so that they are written together. Series
+	// with a quantile label that is not a number between zero and one are
+	// rejected.
+	SummaryGrouping bool `yaml:"summaryGrouping"`
+
+	// IDOverrideLabel is the name of a label that when present on a series
+	// supplies the series ID directly rather than the ID being generated
+	// from all of the series labels, the label itself is not stored as a
+	// tag. This is intended for migrating series with IDs computed upstream
+	// and only applies to unaggregated writes. If empty then IDs are always
+	// generated from the labels.
+	IDOverrideLabel string `yaml:"idOverrideLabel"`
+
+	// IDSchemes are the ID schemes that clients may select for the series
+	// IDs of a write request with the ID scheme header instead of the ID
+	// scheme of the tag options, such as to write with both an old and new
+	// scheme while migrating between them. Requests with a scheme that is
+	// not allowed are rejected with a 400 status. If empty then the header
+	// is ignored.
+	IDSchemes []models.IDSchemeType `yaml:"idSchemes"`
+
+	// DeterministicSeriesIDs forces series IDs to be generated from the
+	// sorted series labels using a fixed scheme regardless of the configured
+	// tag options, so that equivalent label sets always produce the same ID
+	// across runs. This is intended for reproducible tests of ingestion,
+	// enabling it for an existing cluster changes the IDs of written series.
+	DeterministicSeriesIDs bool `yaml:"deterministicSeriesIDs"`
+
+	// NameValidation is the validation applied to metric and label names,
+	// if empty then names are not validated.
+	NameValidation NameValidationMode `yaml:"nameValidation"`
+
+	// EmptyLabelValues is how series with a label that has an empty value
+	// are handled, if empty then they are written as is.
+	EmptyLabelValues EmptyLabelValueMode `yaml:"emptyLabelValues"`
+
+	// ReservedLabels configures rejecting or stripping client supplied labels
+	// with names that are reserved for internal use.
+	ReservedLabels PromRemoteWriteReservedLabelsConfiguration `yaml:"reservedLabels"`
+
+	// InvalidTimestamps is how samples with a zero or negative timestamp are
+	// handled, if empty then they are written as is.
+	InvalidTimestamps InvalidTimestampMode `yaml:"invalidTimestamps"`
+
+	// DuplicateTimestamps is how samples of a series that share a timestamp
+	// are handled, if empty then they are written as is and the value that
+	// is stored depends on the order they are written in.
+	DuplicateTimestamps DuplicateTimestampMode `yaml:"duplicateTimestamps"`
+
+	// CounterMonotonicity enables checking that the samples of counters in
+	// each series of a request do not decrease other than by resetting to
+	// zero, counters that do are counted with the counter.non-monotonic
+	// metric tagged by metric name and logged but still written. Series are
+	// counters if their type metadata is a counter or their metric name has
+	// a _total suffix.
+	CounterMonotonicity bool `yaml:"counterMonotonicity"`
+
+	// ValueRanges configures the range of valid sample values for series
+	// with a given metric name.
+	ValueRanges PromRemoteWriteValueRangesConfiguration `yaml:"valueRanges"`
+
+	// SeriesSampleLimit configures the max number of samples of a single
+	// series in a write request.
+	SeriesSampleLimit PromRemoteWriteSeriesSampleLimitConfiguration `yaml:"seriesSampleLimit"`
+
+	// StrictDecode rejects write requests that contain fields unknown to
+	// the write request schema or that contain series with labels but no
+	// samples or samples with a zero timestamp, which usually indicates a
+	// client using a mismatched schema.
+	StrictDecode bool `yaml:"strictDecode"`
+
+	// FailFast stops writing a request at the first write error and responds
+	// with the status of that error, rather than writing every series and
+	// collecting all of the errors. This suits clients that retry the whole
+	// request on any error, partial success responses do not report the
+	// series that were not written after the error.
+	FailFast bool `yaml:"failFast"`
+
+	// Coalesce configures coalescing of small write requests.
+	Coalesce PromRemoteWriteCoalesceConfiguration `yaml:"coalesce"`
+
+	// RetryQueue configures retrying writes that fail with retryable errors
+	// in the background rather than returning the errors to clients.
+	RetryQueue PromRemoteWriteRetryQueueConfiguration `yaml:"retryQueue"`
+
+	// CardinalityLimit configures limiting the rate of new series written.
+	CardinalityLimit PromRemoteWriteCardinalityLimitConfiguration `yaml:"cardinalityLimit"`
+
+	// SeriesTracking configures counting the written series that are new
+	// versus those that were already seen.
+	SeriesTracking PromRemoteWriteSeriesTrackingConfiguration `yaml:"seriesTracking"`
+
+	// OutOfOrder configures rejecting or dropping samples that are not newer
+	// than the last accepted sample of their series across write requests.
+	OutOfOrder PromRemoteWriteOutOfOrderConfiguration `yaml:"outOfOrder"`
+
+	// CounterRates configures deriving rate series from counters at ingest.
+	CounterRates PromRemoteWriteCounterRatesConfiguration `yaml:"counterRates"`
+
+	// Freeze configures rejecting writes to namespaces or of metrics that are
+	// frozen, such as while they are reindexed.
+	Freeze PromRemoteWriteFreezeConfiguration `yaml:"freeze"`
+
+	// LabelSampler configures periodically logging the label names with the
+	// fastest growing number of distinct values.
+	LabelSampler PromRemoteWriteLabelSamplerConfiguration `yaml:"labelSampler"`
+
+	// WAL configures persisting accepted writes to local disk before they
+	// are written so that they can be replayed after a crash.
+	WAL PromRemoteWriteWALConfiguration `yaml:"wal"`
+
+	// TypeStoragePolicies configures writing series to storage policies by
+	// their metric type.
+	TypeStoragePolicies PromRemoteWriteTypeStoragePoliciesConfiguration `yaml:"typeStoragePolicies"`
+
+	// WriteConcurrency configures writing the series of large requests
+	// concurrently.
+	WriteConcurrency PromRemoteWriteConcurrencyConfiguration `yaml:"writeConcurrency"`
+
+	// AdmissionWebhook configures an external service that decides whether
+	// each write request is written.
+	AdmissionWebhook PromRemoteWriteAdmissionWebhookConfiguration `yaml:"admissionWebhook"`
+
+	// SeriesMetricsTypeLabels enables setting the metrics type and storage
+	// policy of each series with the reserved __m3_metrics_type__ and
+	// __m3_storage_policy__ labels, so that unaggregated and aggregated
+	// series can be written in a single request. The labels are removed
+	// before the series are written.
+	SeriesMetricsTypeLabels bool `yaml:"seriesMetricsTypeLabels"`
+
+	// SamplePolicyHints enables a storage policy hint for each sample, set
+	// with field 100 of the Sample message, so that samples of a series can
+	// be written to different storage policies such as a short retention
+	// for preview samples and a long retention for committed samples.
+	// Samples with a hint are written directly to the hinted aggregated
+	// storage policy and samples without a hint are written as usual. Hints
+	// are applied with the reserved labels of SeriesMetricsTypeLabels, so
+	// enabling hints also enables those labels.
+	SamplePolicyHints bool `yaml:"samplePolicyHints"`
+
+	// SampleAgeDeadlines configures writing series with fresh samples with
+	// a shorter deadline than series with older backfilled samples.
+	SampleAgeDeadlines PromRemoteWriteSampleAgeDeadlinesConfiguration `yaml:"sampleAgeDeadlines"`
+}
+
+// PromRemoteWriteSampleAgeDeadlinesConfiguration configures splitting the
+// series of a write request into fresh and stale series by the age of their
+// newest sample, each of which is written with its own deadline so that
+// fresh series are not held up behind slow writes of backfilled series.
+type PromRemoteWriteSampleAgeDeadlinesConfiguration struct {
+	// Enabled enables writing fresh and stale series with separate deadlines.
+	Enabled bool `yaml:"enabled"`
+
+	// FreshThreshold is the max age of the newest sample of a series for it
+	// to be written as a fresh series, if zero then a default of one minute
+	// is used.
+	FreshThreshold time.Duration `yaml:"freshThreshold" validate:"min=0"`
+
+	// FreshTimeout is the deadline for writing fresh series, if zero then a
+	// default of five seconds is used.
+	FreshTimeout time.Duration `yaml:"freshTimeout" validate:"min=0"`
+
+	// StaleTimeout is the deadline for writing stale series, if zero then a
+	// default of one minute is used.
+	StaleTimeout time.Duration `yaml:"staleTimeout" validate:"min=0"`
+}
+
+// NameValidationMode is the validation applied to metric and label names.
+type NameValidationMode string
+
+const (
+	// NameValidationLegacy only accepts metric names matching
+	// [a-zA-Z_:][a-zA-Z0-9_:]* and label names matching
+	// [a-zA-Z_][a-zA-Z0-9_]*, as required by storage that predates
+	// Prometheus UTF-8 name support.
+	NameValidationLegacy NameValidationMode = "legacy"
+	// NameValidationUTF8 accepts any metric and label names that are
+	// valid UTF-8.
+	NameValidationUTF8 NameValidationMode = "utf8"
+)
+
+// EmptyLabelValueMode is how series with a label that has an empty value,
+// which usually indicates a templating bug in the client, are handled.
+type EmptyLabelValueMode string
+
+const (
+	// EmptyLabelValueReject rejects write requests that contain series with
+	// empty label values.
+	EmptyLabelValueReject EmptyLabelValueMode = "reject"
+	// EmptyLabelValueDropSeries drops series with empty label values and
+	// writes the remaining series of the request.
+	EmptyLabelValueDropSeries EmptyLabelValueMode = "drop-series"
+	// EmptyLabelValueDropLabels removes labels with empty values from the
+	// series, following the Prometheus convention that a label with an
+	// empty value is the same as the label being absent.
+	EmptyLabelValueDropLabels EmptyLabelValueMode = "drop-labels"
+)
+
+// PromRemoteWriteReservedLabelsConfiguration configures how labels with
+// names reserved for internal use are handled, such labels can otherwise
+// collide with the labels that M3 uses internally.
+type PromRemoteWriteReservedLabelsConfiguration struct {
+	// Mode is how series with a reserved label are handled, if empty then
+	// reserved labels are written as is.
+	Mode ReservedLabelMode `yaml:"mode"`
+
+	// Prefixes are the label name prefixes that are reserved, if empty then
+	// the "__" prefix is used. The __name__ label is always allowed, as are
+	// the __m3_metrics_type__ and __m3_storage_policy__ labels when
+	// SeriesMetricsTypeLabels is enabled and the IDOverrideLabel if set.
+	Prefixes []string `yaml:"prefixes"`
+}
+
+// ReservedLabelMode is how series with a label whose name is reserved for
+// internal use are handled.
+type ReservedLabelMode string
+
+const (
+	// ReservedLabelReject rejects write requests that contain series with
+	// reserved labels.
+	ReservedLabelReject ReservedLabelMode = "reject"
+	// ReservedLabelStrip removes reserved labels from the series and writes
+	// the series with the remaining labels.
+	ReservedLabelStrip ReservedLabelMode = "strip"
+)
+
+// InvalidTimestampMode is how samples with a zero or negative timestamp,
+// typically from clients that did not set the timestamp, are handled.
+type InvalidTimestampMode string
+
+const (
+	// InvalidTimestampReject rejects write requests that contain samples
+	// with invalid timestamps.
+	InvalidTimestampReject InvalidTimestampMode = "reject"
+	// InvalidTimestampDrop drops samples with invalid timestamps and writes
+	// the remaining samples of the request.
+	InvalidTimestampDrop InvalidTimestampMode = "drop"
+)
+
+// DuplicateTimestampMode is how samples of a series that share a timestamp
+// are handled, samples of each series are sorted by timestamp before samples
+// that share a timestamp are reduced to a single sample.
+type DuplicateTimestampMode string
+
+const (
+	// DuplicateTimestampFirstWins keeps the first sample in the request for
+	// each timestamp.
+	DuplicateTimestampFirstWins DuplicateTimestampMode = "first-wins"
+	// DuplicateTimestampLastWins keeps the last sample in the request for
+	// each timestamp.
+	DuplicateTimestampLastWins DuplicateTimestampMode = "last-wins"
+	// DuplicateTimestampReject rejects write requests that contain samples
+	// sharing a timestamp with different values.
+	DuplicateTimestampReject DuplicateTimestampMode = "reject"
+	// DuplicateTimestampMax keeps the sample with the max value for each
+	// timestamp.
+	DuplicateTimestampMax DuplicateTimestampMode = "max"
+	// DuplicateTimestampMin keeps the sample with the min value for each
+	// timestamp.
+	DuplicateTimestampMin DuplicateTimestampMode = "min"
+)
+
+// PromRemoteWriteValueRangesConfiguration configures the range of valid
+// sample values for series with a given metric name, which catches clients
+// that send values in the wrong unit such as a ratio sent as a percentage.
+type PromRemoteWriteValueRangesConfiguration struct {
+	// Mode is how samples with a value outside of the range of their metric
+	// are handled, if empty then they are dropped.
+	Mode ValueRangeMode `yaml:"mode"`
+
+	// Metrics is the range of valid sample values keyed by the exact metric
+	// name of the series, series of other metrics are not checked.
+	Metrics map[string]PromRemoteWriteValueRange `yaml:"metrics"`
+}
+
+// PromRemoteWriteValueRange is an inclusive range of sample values.
+type PromRemoteWriteValueRange struct {
+	// Min is the min valid sample value.
+	Min float64 `yaml:"min"`
+
+	// Max is the max valid sample value.
+	Max float64 `yaml:"max"`
+}
+
+// PromRemoteWriteSeriesSampleLimitConfiguration configures a limit on the
+// number of samples of each series in a write request, so that a single
+// series with many samples such as from a backfill does not skew the latency
+// of the batch it is written in.
+type PromRemoteWriteSeriesSampleLimitConfiguration struct {
+	// MaxSamplesPerSeries is the max number of samples of a series, if zero
+	// then the number of samples is not limited.
+	MaxSamplesPerSeries int `yaml:"maxSamplesPerSeries" validate:"min=0"`
+
+	// Mode is how series with more samples than the limit are handled, if
+	// empty then the write request is rejected.
+	Mode SeriesSampleLimitMode `yaml:"mode"`
+}
+
+// SeriesSampleLimitMode is how series with more samples than the limit are
+// handled.
+type SeriesSampleLimitMode string
+
+const (
+	// SeriesSampleLimitReject rejects write requests that contain a series
+	// with more samples than the limit.
+	SeriesSampleLimitReject SeriesSampleLimitMode = "reject"
+	// SeriesSampleLimitTruncate keeps the newest samples of a series with
+	// more samples than the limit and drops the rest.
+	SeriesSampleLimitTruncate SeriesSampleLimitMode = "truncate"
+)
+
+// ValueRangeMode is how samples with a value outside of the range of their
+// metric are handled, NaN values such as staleness markers are always valid.
+type ValueRangeMode string
+
+const (
+	// ValueRangeDrop drops samples with a value outside of the range and
+	// writes the remaining samples of the request.
+	ValueRangeDrop ValueRangeMode = "drop"
+	// ValueRangeReject rejects write requests that contain samples with a
+	// value outside of the range.
+	ValueRangeReject ValueRangeMode = "reject"
+)
+
+// PromRemoteWriteCoalesceConfiguration configures coalescing many small
+// write requests into larger batches, requests that are coalesced are
+// acknowledged with a 202 Accepted status once buffered and then written
+// asynchronously so write errors are not returned to the client.
+type PromRemoteWriteCoalesceConfiguration struct {
+	// Enabled enables coalescing of write requests.
+	Enabled bool `yaml:"enabled"`
+
+	// MaxDelay is the max time series are buffered before being written,
+	// if zero then a default is used.
+	MaxDelay time.Duration `yaml:"maxDelay" validate:"min=0"`
+
+	// MaxSeries is the max number of series buffered before being written,
+	// if zero then a default is used.
+	MaxSeries int `yaml:"maxSeries" validate:"min=0"`
+}
+
+// PromRemoteWriteRetryQueueConfiguration configures a bounded queue of
+// writes that failed with retryable errors, which are retried in the
+// background with an exponential backoff until they are written or expire.
+// Clients are told that queued writes succeeded, so writes are delivered at
+// least once rather than the client being told of the failure. If the write
+// ahead log is enabled then queued writes are only marked done once written
+// or dropped, so writes still queued when the process exits are replayed.
+// Only the failed writes to storage are retried, writes that failed to be
+// downsampled are not retried so that samples are not aggregated twice.
+type PromRemoteWriteRetryQueueConfiguration struct {
+	// Enabled enables the retry queue.
+	Enabled bool `yaml:"enabled"`
+
+	// MaxSeries is the max number of series held by the queue, the oldest
+	// writes are dropped to make room for new writes once full. If zero
+	// then a default is used.
+	MaxSeries int `yaml:"maxSeries" validate:"min=0"`
+
+	// TTL is the max time a write is retried for before it is dropped, if
+	// zero then a default is used.
+	TTL time.Duration `yaml:"ttl" validate:"min=0"`
+
+	// InitialBackoff is the time before a write is first retried, which is
+	// doubled after each failed retry. If zero then a default is used.
+	InitialBackoff time.Duration `yaml:"initialBackoff" validate:"min=0"`
+
+	// MaxBackoff is the max time between retries of a write, if zero then a
+	// default is used.
+	MaxBackoff time.Duration `yaml:"maxBackoff" validate:"min=0"`
+}
+
+// PromRemoteWriteCardinalityLimitConfiguration configures a budget for the
+// number of new series that may be written within a rolling window. Series
+// seen within the current or previous window are tracked with bloom filters
+// so memory use is bounded regardless of how many series are written, at the
+// cost of a small rate of new series being mistaken for existing ones.
+type PromRemoteWriteCardinalityLimitConfiguration struct {
+	// NewSeriesLimit is the max number of new series that may be written
+	// within a window, if zero then new series are not limited.
+	NewSeriesLimit int `yaml:"newSeriesLimit" validate:"min=0"`
+
+	// Window is the length of the window the new series limit applies to,
+	// if zero then a default of one minute is used.
+	Window time.Duration `yaml:"window" validate:"min=0"`
+
+	// ExpectedSeries is the number of distinct series expected to be written
+	// within a window and is used to size the bloom filters, if zero then a
+	// default is used.
+	ExpectedSeries int `yaml:"expectedSeries" validate:"min=0"`
+
+	// FalsePositiveRate is the target rate of new series being mistaken for
+	// existing ones when ExpectedSeries series have been seen, if zero then
+	// a default is used.
+	FalsePositiveRate float64 `yaml:"falsePositiveRate" validate:"min=0,max=1"`
+}
+
+// PromRemoteWriteSeriesTrackingConfiguration configures approximately
+// counting the written series that are new, with the series.new counter,
+// versus those seen within a rolling window, with the series.existing
+// counter. Seen series are tracked with bloom filters of a fixed size, so
+// new series are occasionally counted as existing ones.
+type PromRemoteWriteSeriesTrackingConfiguration struct {
+	// Enabled enables counting new and existing series.
+	Enabled bool `yaml:"enabled"`
+
+	// Window is the length of the window that series are remembered for,
+	// if zero then a default of one minute is used.
+	Window time.Duration `yaml:"window" validate:"min=0"`
+
+	// ExpectedSeries is the number of distinct series expected to be written
+	// within a window and is used to size the bloom filters, if zero then a
+	// default is used.
+	ExpectedSeries int `yaml:"expectedSeries" validate:"min=0"`
+
+	// FalsePositiveRate is the target rate of new series being counted as
+	// existing ones when ExpectedSeries series have been seen, if zero then
+	// a default is used.
+	FalsePositiveRate float64 `yaml:"falsePositiveRate" validate:"min=0,max=1"`
+}
+
+// PromRemoteWriteOutOfOrderConfiguration configures enforcing that the
+// samples of each series are written with increasing timestamps, for storage
+// that requires them, by remembering the timestamp of the last sample written
+// for recently written series. This is best effort since series that are
+// evicted from the cache, or written concurrently by separate requests, are
+// not checked, but catches the common case of replayed or duplicated batches.
+type PromRemoteWriteOutOfOrderConfiguration struct {
+	// Mode is how samples with a timestamp at or before the last written
+	// sample of their series are handled, if empty then they are not checked.
+	Mode OutOfOrderMode `yaml:"mode"`
+
+	// MaxSeries is the max number of series to remember the last written
+	// timestamp of, the least recently written series are evicted first. If
+	// zero then a default is used.
+	MaxSeries int `yaml:"maxSeries" validate:"min=0"`
+
+	// Retention is how long the last written timestamp of a series is
+	// remembered for after it was last written, if zero then a default of
+	// ten minutes is used.
+	Retention time.Duration `yaml:"retention" validate:"min=0"`
+}
+
+// OutOfOrderMode is how samples that are not newer than the last written
+// sample of their series are handled.
+type OutOfOrderMode string
+
+const (
+	// OutOfOrderReject rejects write requests that contain out of order
+	// samples.
+	OutOfOrderReject OutOfOrderMode = "reject"
+	// OutOfOrderDrop drops out of order samples and writes the remaining
+	// samples of the request.
+	OutOfOrderDrop OutOfOrderMode = "drop"
+)
+
+// PromRemoteWriteCounterRatesConfiguration configures an experimental
+// transform that writes the per second rate of counters, computed against
+// the previous sample of each series, for counters that are only ever queried
+// by rate. A decrease in value is treated as a counter reset. The previous
+// sample of recently written series is remembered across write requests, so
+// the first sample of a series after it is evicted has no rate.
+type PromRemoteWriteCounterRatesConfiguration struct {
+	// Enabled enables writing rate series for counters.
+	Enabled bool `yaml:"enabled"`
+
+	// MetricNamePattern is a regular expression that the metric name of a
+	// counter must fully match to have a rate series written, if empty then
+	// all counters have rate series written. Series are counters if their
+	// type metadata is a counter or their metric name has a _total suffix.
+	MetricNamePattern string `yaml:"metricNamePattern"`
+
+	// Mode is whether the rate series replaces the counter or is written
+	// alongside it, if empty then it is written alongside the counter.
+	Mode CounterRateMode `yaml:"mode"`
+
+	// Suffix is appended to the metric name of a counter for the name of its
+	// rate series, if empty then ":rate" is used.
+	Suffix string `yaml:"suffix"`
+
+	// MaxSeries is the max number of counters to remember the previous
+	// sample of, the least recently written counters are evicted first. If
+	// zero then a default is used.
+	MaxSeries int `yaml:"maxSeries" validate:"min=0"`
+
+	// Retention is how long the previous sample of a counter is remembered
+	// for after it was last written, if zero then a default of ten minutes
+	// is used.
+	Retention time.Duration `yaml:"retention" validate:"min=0"`
+}
+
+// CounterRateMode is whether rate series are written instead of or as well as
+// the counters they are derived from.
+type CounterRateMode string
+
+const (
+	// CounterRateAlongside writes rate series as well as the counters.
+	CounterRateAlongside CounterRateMode = "alongside"
+	// CounterRateReplace writes rate series instead of the counters.
+	CounterRateReplace CounterRateMode = "replace"
+)
+
+// PromRemoteWriteFreezeConfiguration configures rejecting write requests
+// with a 503 status and a Retry-After header while any of their series match
+// a freeze rule, so that clients buffer and retry the writes once unfrozen.
+// The rules can be replaced at runtime through the freeze endpoint.
+type PromRemoteWriteFreezeConfiguration struct {
+	// Rules are the freeze rules applied at startup.
+	Rules []PromRemoteWriteFreezeRule `yaml:"rules"`
+
+	// RetryAfter is the time clients are told to wait before retrying a
+	// frozen write, if zero then a default of thirty seconds is used.
+	RetryAfter time.Duration `yaml:"retryAfter" validate:"min=0"`
+}
+
+// PromRemoteWriteFreezeRule matches the series of write requests that are
+// frozen, a series matches if it matches every field that is set.
+type PromRemoteWriteFreezeRule struct {
+	// Namespace is the storage policy of the namespace that is frozen, such
+	// as 1m:48h, or unaggregated for the unaggregated namespace. Series are
+	// written to the unaggregated namespace unless the request sets the
+	// storage policies it is written to.
+	Namespace string `yaml:"namespace"`
+
+	// MetricNamePattern is a regular expression that the metric name of a
+	// frozen series must fully match.
+	MetricNamePattern string `yaml:"metricNamePattern"`
+}
+
+// PromRemoteWriteIngestLatencyRecordingConfiguration configures a bounded
+// pool of workers that record the ingest latency of the samples of written
+// requests, so that large requests are not held up recording the latency of
+// every sample. Requests are dropped from recording, and counted with the
+// ingest-latency.dropped counter, when the queue of the workers is full.
+type PromRemoteWriteIngestLatencyRecordingConfiguration struct {
+	// Workers is the number of workers that record ingest latency, if zero
+	// then the latency is recorded before responding to each request.
+	Workers int `yaml:"workers" validate:"min=0"`
+
+	// QueueSize is the max number of requests waiting to have their latency
+	// recorded, if zero then a default of 1024 is used.
+	QueueSize int `yaml:"queueSize" validate:"min=0"`
+}
+
+// PromRemoteWriteAdmissionWebhookConfiguration configures posting a JSON
+// summary of each write request, being the client, the number of series and
+// samples, the label names and the decompressed body size, to a webhook. The
+// webhook responds with whether the request is allowed, a reason if denied,
+// and optionally tag mappings to apply with the same format as the map tags
+// header. Denied requests are rejected with a 403 status. Mapped labels are
+// validated as those of the map tags header are, requests with an invalid
+// mapping or invalid mapped labels are rejected with a 400 status.
+type PromRemoteWriteAdmissionWebhookConfiguration struct {
+	// URL is the webhook URL, if empty then the webhook is not used.
+	URL string `yaml:"url"`
+
+	// Timeout is the max time to wait for a decision, if zero then a default
+	// of one second is used.
+	Timeout time.Duration `yaml:"timeout" validate:"min=0"`
+
+	// FailOpen admits requests if the webhook cannot be reached or returns
+	// an invalid response, otherwise they are rejected with a 503 status so
+	// that clients retry them.
+	FailOpen bool `yaml:"failOpen"`
+
+	// ClientHeader is the request header that identifies the client, if
+	// empty or not set on a request then the remote address host is used.
+	ClientHeader string `yaml:"clientHeader"`
+}
+
+// PromRemoteWriteConcurrencyConfiguration configures splitting the series
+// of a large write request into shards that are written concurrently.
+type PromRemoteWriteConcurrencyConfiguration struct {
+	// Shards is the number of shards the series of a request are split
+	// into, if zero or one then requests are written by a single goroutine.
+	Shards int `yaml:"shards" validate:"min=0"`
+
+	// MinSeries is the min number of series a request must have for it to
+	// be split into shards, if zero then a default of 1000 is used.
+	MinSeries int `yaml:"minSeries" validate:"min=0"`
+}
+
+// PromRemoteWriteTypeStoragePoliciesConfiguration configures the storage
+// policies that series of each metric type are written to, overriding the
+// downsampling rules as the storage policy header does. The metric type of a
+// series is taken from its type metadata if present, or otherwise inferred
+// from a _total suffix for counters or a _bucket, _sum or _count suffix for
+// histograms. Series whose type has no storage policies, and writes that
+// override the storage policies with request headers, are written as usual.
+type PromRemoteWriteTypeStoragePoliciesConfiguration struct {
+	// Counter are the storage policies for counters.
+	Counter []policy.StoragePolicy `yaml:"counter"`
+
+	// Gauge are the storage policies for gauges.
+	Gauge []policy.StoragePolicy `yaml:"gauge"`
+
+	// Histogram are the storage policies for histograms.
+	Histogram []policy.StoragePolicy `yaml:"histogram"`
+
+	// Summary are the storage policies for summaries.
+	Summary []policy.StoragePolicy `yaml:"summary"`
+}
+
+// PromRemoteWriteWALConfiguration configures a write ahead log of accepted
+// writes with default write options. Each write is synced to a segment file
+// before it is written and marked done once written, segments with writes
+// that are not done are replayed on start up so writes are written at least
+// once even if the process exits after a write was acknowledged, such as a
+// coalesced write, but before it was written.
+type PromRemoteWriteWALConfiguration struct {
+	// Enabled enables the write ahead log.
+	Enabled bool `yaml:"enabled"`
+
+	// Path is the directory that segment files are written to, it is
+	// required if enabled.
+	Path string `yaml:"path"`
+
+	// MaxSegmentSize is the size in bytes at which a segment is rotated, if
+	// zero then a default of 64MiB is used.
+	MaxSegmentSize int64 `yaml:"maxSegmentSize" validate:"min=0"`
+}
+
+// PromRemoteWriteLabelSamplerConfiguration configures a diagnostic sampler
+// that approximates the number of distinct values written for each label
+// name and logs the top label names by growth every interval.
+type PromRemoteWriteLabelSamplerConfiguration struct {
+	// Enabled enables the label sampler.
+	Enabled bool `yaml:"enabled"`
+
+	// Interval is how often the top label names are logged, if zero then a
+	// default of one minute is used.
+	Interval time.Duration `yaml:"interval" validate:"min=0"`
+
+	// TopK is the number of label names logged each interval, if zero then
+	// a default is used.
+	TopK int `yaml:"topK" validate:"min=0"`
+
+	// MaxLabels is the max number of label names tracked each interval,
+	// each tracked label name uses 8KiB. If zero then a default is used.
+	MaxLabels int `yaml:"maxLabels" validate:"min=0"`
+}
+
+// PromRemoteWriteRateLimitConfiguration configures a token bucket rate limit
+// of samples written per client. Clients are identified by the value of a
+// request header or otherwise by their remote address.
+type PromRemoteWriteRateLimitConfiguration struct {
+	// Default is the limit for clients without a specific limit, if the rate
+	// is zero then these clients are not limited.
+	Default PromRemoteWriteClientRateLimitConfiguration `yaml:"default"`
+
+	// Clients are the specific limits by client identifier.
+	Clients map[string]PromRemoteWriteClientRateLimitConfiguration `yaml:"clients"`
+
+	// ClientHeader is the request header that identifies the client, such
+	// as "X-Scope-OrgID", if empty or not set on a request then the remote
+	// address host of the request is used.
+	ClientHeader string `yaml:"clientHeader"`
+
+	// MaxClients is the max number of clients tracked, the least recently
+	// seen clients are evicted beyond this, if zero then a default is used.
+	MaxClients int `yaml:"maxClients" validate:"min=0"`
+}
+
+// PromRemoteWriteClientRateLimitConfiguration is the rate limit for a client.
+type PromRemoteWriteClientRateLimitConfiguration struct {
+	// SamplesPerSecond is the sustained rate of samples the client may write.
+	SamplesPerSecond float64 `yaml:"samplesPerSecond" validate:"min=0"`
+
+	// Burst is the max number of samples the client may accrue to write in a
+	// burst, if zero then it is equal to the samples per second.
+	Burst float64 `yaml:"burst" validate:"min=0"`
+}
@@ -26,6 +26,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/m3db/m3/src/query/errors"
@@ -37,8 +40,11 @@ import (
 	"github.com/m3db/m3/src/query/util"
 	"github.com/m3db/m3/src/query/util/json"
 	xerrors "github.com/m3db/m3/src/x/errors"
+	"github.com/m3db/m3/src/x/headers"
+	xhttp "github.com/m3db/m3/src/x/net/http"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -49,8 +55,33 @@ const (
 	tolerance           = 0.0000001
 )
 
+const (
+	// SnappyContentEncoding is the snappy content encoding, which is the
+	// default if no content encoding is specified.
+	SnappyContentEncoding = "snappy"
+	// ZstdContentEncoding is the zstd content encoding.
+	ZstdContentEncoding = "zstd"
+	// IdentityContentEncoding is the content encoding of uncompressed
+	// requests.
+	IdentityContentEncoding = "identity"
+)
+
 var (
 	roleName = []byte("role")
+
+	// AcceptedContentEncodings is the list of content encodings accepted
+	// for compressed Prometheus requests, suitable for use as the value of
+	// an Accept-Encoding response header.
+	AcceptedContentEncodings = strings.Join([]string{
+		SnappyContentEncoding,
+		ZstdContentEncoding,
+		IdentityContentEncoding,
+	}, ", ")
+
+	// zstdDecoders is a bounded pool of zstd stream decoders, a channel is
+	// used rather than a sync.Pool since decoders own background goroutines
+	// that are only released when they are explicitly closed.
+	zstdDecoders = make(chan *zstd.Decoder, runtime.GOMAXPROCS(0))
 )
 
 // ParsePromCompressedRequestResult is the result of a
@@ -60,9 +91,59 @@ type ParsePromCompressedRequestResult struct {
 	UncompressedBody []byte
 }
 
+// ParsePromCompressedRequestOptions are the options for parsing a compressed
+// request from Prometheus.
+type ParsePromCompressedRequestOptions struct {
+	// MaxDecompressedBodySize is the max size in bytes of the decompressed
+	// body, if zero then no limit is enforced.
+	MaxDecompressedBodySize int
+	// MaxDecompressionRatio is the max ratio of the size of the decompressed
+	// body to the size of the compressed body, if zero then no limit is
+	// enforced.
+	MaxDecompressionRatio int
+}
+
+// DecompressionRatioError is returned when a compressed request body
+// decompresses to more than the max decompression ratio allows.
+type DecompressionRatioError struct {
+	// CompressedSize is the size in bytes of the compressed body.
+	CompressedSize int
+	// MaxRatio is the max decompression ratio.
+	MaxRatio int
+}
+
+func (e DecompressionRatioError) Error() string {
+	return fmt.Sprintf("decompressed body exceeds max ratio %d of compressed size %d",
+		e.MaxRatio, e.CompressedSize)
+}
+
+// IsDecompressionRatioError returns whether the error is or contains a
+// decompression ratio error.
+func IsDecompressionRatioError(err error) bool {
+	for err != nil {
+		if _, ok := err.(DecompressionRatioError); ok {
+			return true
+		}
+		err = xerrors.InnerError(err)
+	}
+	return false
+}
+
 // ParsePromCompressedRequest parses a snappy compressed request from Prometheus.
 func ParsePromCompressedRequest(
 	r *http.Request,
+) (ParsePromCompressedRequestResult, error) {
+	return ParsePromCompressedRequestWithOptions(r,
+		ParsePromCompressedRequestOptions{})
+}
+
+// ParsePromCompressedRequestWithOptions parses a compressed request from
+// Prometheus using the content encoding specified by the request, defaulting
+// to snappy if none is specified. Requests without a content encoding that
+// set the uncompressed header to true are parsed as uncompressed.
+func ParsePromCompressedRequestWithOptions(
+	r *http.Request,
+	opts ParsePromCompressedRequestOptions,
 ) (ParsePromCompressedRequestResult, error) {
 	body := r.Body
 	if r.Body == nil {
@@ -73,12 +154,42 @@ func ParsePromCompressedRequest(
 
 	defer body.Close()
 
+	// Read to EOF rather than relying on the Content-Length so that chunked
+	// bodies, such as from proxies that strip the Content-Length, are read
+	// in full.
 	compressed, err := ioutil.ReadAll(body)
 	if err != nil {
 		return ParsePromCompressedRequestResult{}, err
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	var reqBuf []byte
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get(xhttp.HeaderContentEncoding)))
+	if encoding == "" {
+		if v := strings.TrimSpace(r.Header.Get(headers.UncompressedHeader)); v != "" {
+			uncompressed, err := strconv.ParseBool(v)
+			if err != nil {
+				err = fmt.Errorf("could not parse uncompressed: %v", err)
+				return ParsePromCompressedRequestResult{},
+					xerrors.NewInvalidParamsError(err)
+			}
+			if uncompressed {
+				encoding = IdentityContentEncoding
+			}
+		}
+	}
+
+	switch encoding {
+	case "", SnappyContentEncoding:
+		reqBuf, err = decodeSnappy(compressed, opts.MaxDecompressedBodySize,
+			opts.MaxDecompressionRatio)
+	case ZstdContentEncoding:
+		reqBuf, err = decodeZstd(compressed, opts.MaxDecompressedBodySize,
+			opts.MaxDecompressionRatio)
+	case IdentityContentEncoding:
+		reqBuf, err = decodeIdentity(compressed, opts.MaxDecompressedBodySize)
+	default:
+		err = fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
 	if err != nil {
 		return ParsePromCompressedRequestResult{},
 			xerrors.NewInvalidParamsError(err)
@@ -90,6 +201,89 @@ func ParsePromCompressedRequest(
 	}, nil
 }
 
+func decodeSnappy(compressed []byte, maxSize, maxRatio int) ([]byte, error) {
+	if maxSize > 0 || maxRatio > 0 {
+		n, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			return nil, err
+		}
+		if maxSize > 0 && n > maxSize {
+			return nil, fmt.Errorf("decompressed body size %d exceeds limit %d",
+				n, maxSize)
+		}
+		if maxRatio > 0 && n > maxRatio*len(compressed) {
+			return nil, DecompressionRatioError{
+				CompressedSize: len(compressed),
+				MaxRatio:       maxRatio,
+			}
+		}
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+func decodeIdentity(body []byte, maxSize int) ([]byte, error) {
+	if maxSize > 0 && len(body) > maxSize {
+		return nil, fmt.Errorf("body size %d exceeds limit %d", len(body), maxSize)
+	}
+	return body, nil
+}
+
+func decodeZstd(compressed []byte, maxSize, maxRatio int) ([]byte, error) {
+	decoder, err := getZstdDecoder(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer putZstdDecoder(decoder)
+
+	limit := maxSize
+	if maxRatio > 0 && (limit <= 0 || maxRatio*len(compressed) < limit) {
+		limit = maxRatio * len(compressed)
+	}
+
+	var r io.Reader = decoder
+	if limit > 0 {
+		// Read at most one byte past the limit to detect exceeding it
+		// without decompressing the whole body.
+		r = io.LimitReader(decoder, int64(limit)+1)
+	}
+
+	result, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && len(result) > maxSize {
+		return nil, fmt.Errorf("decompressed body size exceeds limit %d", maxSize)
+	}
+	if maxRatio > 0 && len(result) > maxRatio*len(compressed) {
+		return nil, DecompressionRatioError{
+			CompressedSize: len(compressed),
+			MaxRatio:       maxRatio,
+		}
+	}
+	return result, nil
+}
+
+func getZstdDecoder(r io.Reader) (*zstd.Decoder, error) {
+	select {
+	case decoder := <-zstdDecoders:
+		if err := decoder.Reset(r); err != nil {
+			decoder.Close()
+			return nil, err
+		}
+		return decoder, nil
+	default:
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	}
+}
+
+func putZstdDecoder(decoder *zstd.Decoder) {
+	select {
+	case zstdDecoders <- decoder:
+	default:
+		decoder.Close()
+	}
+}
+
 // TagCompletionQueries are tag completion queries.
 type TagCompletionQueries struct {
 	// Queries are the tag completion queries.
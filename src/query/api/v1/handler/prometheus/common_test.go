@@ -24,6 +24,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -34,8 +35,11 @@ import (
 	"github.com/m3db/m3/src/query/parser/promql"
 	"github.com/m3db/m3/src/query/test"
 	xerrors "github.com/m3db/m3/src/x/errors"
+	"github.com/m3db/m3/src/x/headers"
 	xhttp "github.com/m3db/m3/src/x/net/http"
 
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -67,6 +71,173 @@ func TestPromCompressedReadInvalidEncoding(t *testing.T) {
 	assert.True(t, xerrors.IsInvalidParams(err))
 }
 
+func TestPromCompressedRequestZstd(t *testing.T) {
+	body := []byte("zstd encoded body")
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	compressed := encoder.EncodeAll(body, nil)
+	require.NoError(t, encoder.Close())
+
+	req := httptest.NewRequest("POST", "/dummy", bytes.NewReader(compressed))
+	req.Header.Set(xhttp.HeaderContentEncoding, ZstdContentEncoding)
+	result, err := ParsePromCompressedRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, body, result.UncompressedBody)
+	assert.Equal(t, compressed, result.CompressedBody)
+}
+
+func TestPromCompressedRequestUnsupportedEncoding(t *testing.T) {
+	req := httptest.NewRequest("POST", "/dummy", test.GeneratePromReadBody(t))
+	req.Header.Set(xhttp.HeaderContentEncoding, "br")
+	_, err := ParsePromCompressedRequest(req)
+	require.Error(t, err)
+	assert.True(t, xerrors.IsInvalidParams(err))
+}
+
+func TestPromCompressedRequestMaxDecompressedBodySize(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1024)
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstdCompressed := encoder.EncodeAll(body, nil)
+	require.NoError(t, encoder.Close())
+
+	tests := []struct {
+		encoding   string
+		compressed []byte
+	}{
+		{encoding: SnappyContentEncoding, compressed: snappy.Encode(nil, body)},
+		{encoding: ZstdContentEncoding, compressed: zstdCompressed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/dummy", bytes.NewReader(tt.compressed))
+			req.Header.Set(xhttp.HeaderContentEncoding, tt.encoding)
+			_, err := ParsePromCompressedRequestWithOptions(req,
+				ParsePromCompressedRequestOptions{MaxDecompressedBodySize: 512})
+			require.Error(t, err)
+			assert.True(t, xerrors.IsInvalidParams(err))
+
+			req = httptest.NewRequest("POST", "/dummy", bytes.NewReader(tt.compressed))
+			req.Header.Set(xhttp.HeaderContentEncoding, tt.encoding)
+			result, err := ParsePromCompressedRequestWithOptions(req,
+				ParsePromCompressedRequestOptions{MaxDecompressedBodySize: 1024})
+			require.NoError(t, err)
+			assert.Equal(t, body, result.UncompressedBody)
+		})
+	}
+}
+
+func TestPromCompressedRequestMaxDecompressionRatio(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 64*1024)
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstdCompressed := encoder.EncodeAll(body, nil)
+	require.NoError(t, encoder.Close())
+
+	tests := []struct {
+		encoding   string
+		compressed []byte
+	}{
+		{encoding: SnappyContentEncoding, compressed: snappy.Encode(nil, body)},
+		{encoding: ZstdContentEncoding, compressed: zstdCompressed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			ratio := len(body) / len(tt.compressed)
+
+			req := httptest.NewRequest("POST", "/dummy", bytes.NewReader(tt.compressed))
+			req.Header.Set(xhttp.HeaderContentEncoding, tt.encoding)
+			_, err := ParsePromCompressedRequestWithOptions(req,
+				ParsePromCompressedRequestOptions{MaxDecompressionRatio: ratio - 1})
+			require.Error(t, err)
+			assert.True(t, xerrors.IsInvalidParams(err))
+			assert.True(t, IsDecompressionRatioError(err))
+
+			req = httptest.NewRequest("POST", "/dummy", bytes.NewReader(tt.compressed))
+			req.Header.Set(xhttp.HeaderContentEncoding, tt.encoding)
+			result, err := ParsePromCompressedRequestWithOptions(req,
+				ParsePromCompressedRequestOptions{MaxDecompressionRatio: ratio + 1})
+			require.NoError(t, err)
+			assert.Equal(t, body, result.UncompressedBody)
+		})
+	}
+}
+
+func TestPromCompressedRequestUncompressed(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1024)
+
+	newRequest := func(header, value string) *http.Request {
+		req := httptest.NewRequest("POST", "/dummy", bytes.NewReader(body))
+		req.Header.Set(header, value)
+		return req
+	}
+
+	for _, req := range []*http.Request{
+		newRequest(xhttp.HeaderContentEncoding, IdentityContentEncoding),
+		newRequest(headers.UncompressedHeader, "true"),
+	} {
+		result, err := ParsePromCompressedRequestWithOptions(req,
+			ParsePromCompressedRequestOptions{MaxDecompressedBodySize: 1024})
+		require.NoError(t, err)
+		assert.Equal(t, body, result.UncompressedBody)
+	}
+
+	_, err := ParsePromCompressedRequestWithOptions(
+		newRequest(headers.UncompressedHeader, "true"),
+		ParsePromCompressedRequestOptions{MaxDecompressedBodySize: 512})
+	require.Error(t, err)
+	assert.True(t, xerrors.IsInvalidParams(err))
+
+	// The body is not valid snappy so it is not guessed to be uncompressed.
+	_, err = ParsePromCompressedRequestWithOptions(
+		newRequest(headers.UncompressedHeader, "false"),
+		ParsePromCompressedRequestOptions{})
+	require.Error(t, err)
+	assert.True(t, xerrors.IsInvalidParams(err))
+}
+
+func TestPromCompressedRequestChunked(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1024)
+	compressed := snappy.Encode(nil, body)
+
+	var (
+		result           ParsePromCompressedRequestResult
+		parseErr         error
+		contentLength    int64
+		transferEncoding []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentLength, transferEncoding = r.ContentLength, r.TransferEncoding
+		result, parseErr = ParsePromCompressedRequestWithOptions(r,
+			ParsePromCompressedRequestOptions{MaxDecompressedBodySize: 1024})
+	}))
+	defer server.Close()
+
+	post := func(compressed []byte) {
+		// Wrap the body so that its length is unknown and it is sent chunked.
+		req, err := http.NewRequest("POST", server.URL,
+			io.MultiReader(bytes.NewReader(compressed)))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	post(compressed)
+	require.Equal(t, int64(-1), contentLength)
+	require.Equal(t, []string{"chunked"}, transferEncoding)
+	require.NoError(t, parseErr)
+	assert.Equal(t, compressed, result.CompressedBody)
+	assert.Equal(t, body, result.UncompressedBody)
+
+	// The decompressed body size limit is still enforced.
+	post(snappy.Encode(nil, append(body, 'a')))
+	require.Error(t, parseErr)
+	assert.True(t, xerrors.IsInvalidParams(parseErr))
+}
+
 type writer struct {
 	value string
 }
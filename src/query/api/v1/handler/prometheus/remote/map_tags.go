@@ -29,12 +29,14 @@ import (
 )
 
 // mapTags modifies a given write request based on the tag mappers passed.
+// The tag mappers are all validated before any are applied so that the
+// request is never left partially mapped.
 func mapTags(req *prompb.WriteRequest, opts handleroptions.MapTagsOptions) error {
-	for _, mapper := range opts.TagMappers {
-		if err := mapper.Validate(); err != nil {
-			return err
-		}
+	if err := validateMapTags(opts); err != nil {
+		return err
+	}
 
+	for _, mapper := range opts.TagMappers {
 		if op := mapper.Write; !op.IsEmpty() {
 			tag := []byte(op.Tag)
 			value := []byte(op.Value)
@@ -57,6 +59,18 @@ func mapTags(req *prompb.WriteRequest, opts handleroptions.MapTagsOptions) error
 				}
 			}
 		}
+	}
+
+	return nil
+}
+
+// validateMapTags returns an error if any of the tag mappers are invalid or
+// use an operation that is not supported.
+func validateMapTags(opts handleroptions.MapTagsOptions) error {
+	for _, mapper := range opts.TagMappers {
+		if err := mapper.Validate(); err != nil {
+			return err
+		}
 
 		if op := mapper.Drop; !op.IsEmpty() {
 			return errors.New("Drop operation is not yet supported")
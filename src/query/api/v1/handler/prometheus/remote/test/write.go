@@ -63,6 +63,71 @@ func GeneratePromWriteRequest() *prompb.WriteRequest {
 	return req
 }
 
+// NewWriteRequest returns a Prometheus remote write request of the series.
+func NewWriteRequest(series ...prompb.TimeSeries) *prompb.WriteRequest {
+	return &prompb.WriteRequest{Timeseries: series}
+}
+
+// NewSeries returns a series with the metric name, unless empty, followed by
+// the label name and value pairs, and a single sample with a value of 1 at a
+// timestamp of 1000.
+func NewSeries(name string, labels ...string) prompb.TimeSeries {
+	var series prompb.TimeSeries
+	if name != "" {
+		series.Labels = append(series.Labels, prompb.Label{
+			Name:  []byte(model.MetricNameLabel),
+			Value: []byte(name),
+		})
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		series.Labels = append(series.Labels, prompb.Label{
+			Name:  []byte(labels[i]),
+			Value: []byte(labels[i+1]),
+		})
+	}
+	series.Samples = []prompb.Sample{{Value: 1, Timestamp: 1000}}
+	return series
+}
+
+// NamedSeries returns a series with each of the metric names, the series
+// are otherwise the same as those returned by NewSeries.
+func NamedSeries(names ...string) []prompb.TimeSeries {
+	series := make([]prompb.TimeSeries, 0, len(names))
+	for _, name := range names {
+		series = append(series, NewSeries(name))
+	}
+	return series
+}
+
+// WithSamples returns the series with its samples replaced.
+func WithSamples(series prompb.TimeSeries, samples ...prompb.Sample) prompb.TimeSeries {
+	series.Samples = samples
+	return series
+}
+
+// WithValue returns the series with a single sample of the value at a
+// timestamp of 1000.
+func WithValue(series prompb.TimeSeries, value float64) prompb.TimeSeries {
+	series.Samples = []prompb.Sample{{Value: value, Timestamp: 1000}}
+	return series
+}
+
+// WithTimestamps returns the series with its samples replaced by samples
+// with a value of 1 at each of the timestamps.
+func WithTimestamps(series prompb.TimeSeries, timestamps ...int64) prompb.TimeSeries {
+	series.Samples = make([]prompb.Sample, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		series.Samples = append(series.Samples, prompb.Sample{Value: 1, Timestamp: timestamp})
+	}
+	return series
+}
+
+// WithType returns the series with its metric type replaced.
+func WithType(series prompb.TimeSeries, typ prompb.MetricType) prompb.TimeSeries {
+	series.Type = typ
+	return series
+}
+
 // GeneratePromWriteRequestBody generates a Prometheus remote
 // write request body.
 func GeneratePromWriteRequestBody(
@@ -23,16 +23,22 @@ package remote
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
-	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
 	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/query/api/v1/handler"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus"
@@ -42,6 +48,7 @@ import (
 	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/query/storage"
 	"github.com/m3db/m3/src/query/storage/m3/storagemetadata"
+	"github.com/m3db/m3/src/query/tracepoint"
 	"github.com/m3db/m3/src/query/ts"
 	"github.com/m3db/m3/src/query/util/logging"
 	"github.com/m3db/m3/src/x/clock"
@@ -49,6 +56,7 @@ import (
 	"github.com/m3db/m3/src/x/headers"
 	"github.com/m3db/m3/src/x/instrument"
 	xhttp "github.com/m3db/m3/src/x/net/http"
+	xopentracing "github.com/m3db/m3/src/x/opentracing"
 	"github.com/m3db/m3/src/x/retry"
 	xsync "github.com/m3db/m3/src/x/sync"
 	xtime "github.com/m3db/m3/src/x/time"
@@ -70,13 +78,22 @@ const (
 
 	// defaultForwardingTimeout is the default forwarding timeout.
 	defaultForwardingTimeout = 15 * time.Second
+
+	// defaultWriteConcurrencyMinSeries is the default min number of series
+	// for a request to be written concurrently.
+	defaultWriteConcurrencyMinSeries = 1000
 )
 
 var (
 	errNoDownsamplerAndWriter       = errors.New("no downsampler and writer set")
 	errNoTagOptions                 = errors.New("no tag options set")
 	errNoNowFn                      = errors.New("no now fn set")
+	errNoWALPath                    = errors.New("no write ahead log path set")
 	errUnaggregatedStoragePolicySet = errors.New("storage policy should not be set for unaggregated metrics")
+	errTimestampOffsetNotAllowed    = errors.New("timestamp offset header is not enabled")
+	errEncodedSamplesNotAllowed     = errors.New("encoded samples content type is not enabled")
+	errDraining                     = xhttp.NewError(errors.New("write handler is draining"),
+		http.StatusServiceUnavailable)
 
 	defaultForwardingRetryForever = false
 	defaultForwardingRetryJitter  = true
@@ -88,6 +105,8 @@ var (
 		Jitter:         &defaultForwardingRetryJitter,
 	}
 
+	deterministicIDTagOptions = models.NewTagOptions().SetIDSchemeType(models.TypeQuoted)
+
 	defaultValue = ingest.IterValue{
 		Tags:       models.EmptyTags(),
 		Attributes: ts.DefaultSeriesAttributes(),
@@ -99,13 +118,41 @@ var (
 type PromWriteHandler struct {
 	downsamplerAndWriter   ingest.DownsamplerAndWriter
 	tagOptions             models.TagOptions
+	metricNameLabels       [][]byte
+	idSchemeTagOptions     map[string]models.TagOptions
 	storeMetricsType       bool
+	writeConfig            config.PromRemoteWriteConfiguration
 	forwarding             handleroptions.PromWriteHandlerForwardingOptions
 	forwardTimeout         time.Duration
 	forwardHTTPClient      *http.Client
 	forwardingBoundWorkers xsync.WorkerPool
 	forwardContext         context.Context
 	forwardRetrier         retry.Retrier
+	seriesObserver         options.PromWriteSeriesObserver
+	decodedObserver        options.PromWriteDecodedObserver
+	parseOptions           prometheus.ParsePromCompressedRequestOptions
+	coalescer              *writeCoalescer
+	retryQueue             *writeRetryQueue
+	cardinalityLimiter     *cardinalityLimiter
+	seriesTracker          *seriesTracker
+	seriesWatermarks       *seriesWatermarks
+	counterRates           *counterRates
+	counterMonotonicity    *counterMonotonicity
+	freezes                *writeFreezes
+	latencyRecorder        *ingestLatencyRecorder
+	requiredLabels         *requiredLabels
+	reservedLabels         *reservedLabels
+	histogramCollapser     *histogramBucketCollapser
+	rateLimiter            *clientRateLimiter
+	labelSampler           *labelSampler
+	wal                    *writeAheadLog
+	typeRouter             *metricTypeRouter
+	sampleAgeDeadlines     *sampleAgeDeadlines
+	idOverrideLabel        []byte
+	tee                    options.PromWriteTeeOptions
+	authorizer             options.PromWriteAuthorizerOptions
+	admissionWebhook       *admissionWebhook
+	drainState             drainState
 	nowFn                  clock.NowFn
 	instrumentOpts         instrument.Options
 	metrics                promWriteMetrics
@@ -118,6 +165,7 @@ func NewPromWriteHandler(options options.HandlerOptions) (http.Handler, error) {
 		tagOptions           = options.TagOptions()
 		nowFn                = options.NowFn()
 		forwarding           = options.Config().WriteForwarding.PromRemoteWrite
+		writeConfig          = options.Config().PromRemoteWrite
 		instrumentOpts       = options.InstrumentOpts()
 	)
 
@@ -133,6 +181,63 @@ func NewPromWriteHandler(options options.HandlerOptions) (http.Handler, error) {
 		return nil, errNoNowFn
 	}
 
+	switch v := writeConfig.NameValidation; v {
+	case "", config.NameValidationLegacy, config.NameValidationUTF8:
+	default:
+		return nil, fmt.Errorf("unknown name validation mode: %s", v)
+	}
+
+	switch v := writeConfig.EmptyLabelValues; v {
+	case "", config.EmptyLabelValueReject, config.EmptyLabelValueDropSeries,
+		config.EmptyLabelValueDropLabels:
+	default:
+		return nil, fmt.Errorf("unknown empty label value mode: %s", v)
+	}
+
+	switch v := writeConfig.ReservedLabels.Mode; v {
+	case "", config.ReservedLabelReject, config.ReservedLabelStrip:
+	default:
+		return nil, fmt.Errorf("unknown reserved label mode: %s", v)
+	}
+
+	switch v := writeConfig.InvalidTimestamps; v {
+	case "", config.InvalidTimestampReject, config.InvalidTimestampDrop:
+	default:
+		return nil, fmt.Errorf("unknown invalid timestamp mode: %s", v)
+	}
+
+	switch v := writeConfig.ValueRanges.Mode; v {
+	case "", config.ValueRangeDrop, config.ValueRangeReject:
+	default:
+		return nil, fmt.Errorf("unknown value range mode: %s", v)
+	}
+
+	switch v := writeConfig.DuplicateTimestamps; v {
+	case "", config.DuplicateTimestampFirstWins, config.DuplicateTimestampLastWins,
+		config.DuplicateTimestampReject, config.DuplicateTimestampMax,
+		config.DuplicateTimestampMin:
+	default:
+		return nil, fmt.Errorf("unknown duplicate timestamp mode: %s", v)
+	}
+
+	switch v := writeConfig.SeriesSampleLimit.Mode; v {
+	case "", config.SeriesSampleLimitReject, config.SeriesSampleLimitTruncate:
+	default:
+		return nil, fmt.Errorf("unknown series sample limit mode: %s", v)
+	}
+
+	switch v := writeConfig.OutOfOrder.Mode; v {
+	case "", config.OutOfOrderReject, config.OutOfOrderDrop:
+	default:
+		return nil, fmt.Errorf("unknown out of order mode: %s", v)
+	}
+
+	switch v := writeConfig.CounterRates.Mode; v {
+	case "", config.CounterRateAlongside, config.CounterRateReplace:
+	default:
+		return nil, fmt.Errorf("unknown counter rate mode: %s", v)
+	}
+
 	scope := options.InstrumentOpts().
 		MetricsScope().
 		Tagged(map[string]string{"handler": "remote-write"})
@@ -166,26 +271,180 @@ func NewPromWriteHandler(options options.HandlerOptions) (http.Handler, error) {
 		scope.SubScope("forwarding-retry"),
 	)
 
-	return &PromWriteHandler{
+	parseOptions := prometheus.ParsePromCompressedRequestOptions{
+		MaxDecompressedBodySize: writeConfig.MaxDecompressedBodySize,
+		MaxDecompressionRatio:   writeConfig.MaxDecompressionRatio,
+	}
+
+	h := &PromWriteHandler{
 		downsamplerAndWriter:   downsamplerAndWriter,
 		tagOptions:             tagOptions,
+		metricNameLabels:       newMetricNameLabels(tagOptions),
 		storeMetricsType:       options.StoreMetricsType(),
+		writeConfig:            writeConfig,
 		forwarding:             forwarding,
 		forwardTimeout:         forwardTimeout,
 		forwardHTTPClient:      xhttp.NewHTTPClient(forwardHTTPOpts),
 		forwardingBoundWorkers: forwardingBoundWorkers,
 		forwardContext:         context.Background(),
 		forwardRetrier:         retry.NewRetrier(forwardRetryOpts),
+		seriesObserver:         options.PromWriteSeriesObserver(),
+		decodedObserver:        options.PromWriteDecodedObserver(),
+		tee:                    options.PromWriteTee(),
+		authorizer:             options.PromWriteAuthorizer(),
+		parseOptions:           parseOptions,
 		nowFn:                  nowFn,
 		metrics:                metrics,
 		instrumentOpts:         instrumentOpts,
-	}, nil
+		typeRouter:             newMetricTypeRouter(writeConfig.TypeStoragePolicies),
+		sampleAgeDeadlines:     newSampleAgeDeadlines(writeConfig.SampleAgeDeadlines, nowFn),
+	}
+
+	if writeConfig.Coalesce.Enabled {
+		h.coalescer = newWriteCoalescer(writeConfig.Coalesce, h.writeCoalesced)
+	}
+
+	if v := writeConfig.RetryQueue; v.Enabled {
+		h.retryQueue = newWriteRetryQueue(v, nowFn, h.writeRetried, scope)
+		h.retryQueue.Start()
+	}
+
+	if writeConfig.CardinalityLimit.NewSeriesLimit > 0 {
+		h.cardinalityLimiter = newCardinalityLimiter(writeConfig.CardinalityLimit, nowFn)
+	}
+
+	if v := writeConfig.SeriesTracking; v.Enabled {
+		h.seriesTracker = newSeriesTracker(v, nowFn, scope)
+	}
+
+	if v := writeConfig.OutOfOrder; v.Mode != "" {
+		h.seriesWatermarks = newSeriesWatermarks(v, nowFn, scope)
+	}
+
+	if v := writeConfig.IDSchemes; len(v) > 0 {
+		h.idSchemeTagOptions = make(map[string]models.TagOptions, len(v))
+		for _, scheme := range v {
+			if err := scheme.Validate(); err != nil {
+				return nil, err
+			}
+			h.idSchemeTagOptions[scheme.String()] = tagOptions.SetIDSchemeType(scheme)
+		}
+	}
+
+	freezes, err := newWriteFreezes(writeConfig.Freeze, h.metricNameLabels)
+	if err != nil {
+		return nil, err
+	}
+	h.freezes = freezes
+
+	if v := writeConfig.IngestLatencyRecording; v.Workers > 0 &&
+		!writeConfig.DisableIngestLatencyMetric {
+		h.latencyRecorder = newIngestLatencyRecorder(v, h.metrics.ingestLatency, scope)
+	}
+
+	if writeConfig.CounterMonotonicity {
+		h.counterMonotonicity = newCounterMonotonicity(h.metricNameLabels, scope,
+			instrumentOpts.Logger())
+	}
+
+	if v := writeConfig.CounterRates; v.Enabled {
+		counterRates, err := newCounterRates(v, h.metricNameLabels, nowFn, scope)
+		if err != nil {
+			return nil, err
+		}
+		h.counterRates = counterRates
+	}
+
+	if v := writeConfig.RequiredLabels; len(v) > 0 {
+		h.requiredLabels = newRequiredLabels(v, scope)
+	}
+
+	if v := writeConfig.IDOverrideLabel; v != "" {
+		h.idOverrideLabel = []byte(v)
+	}
+
+	if v := writeConfig.ReservedLabels; v.Mode != "" {
+		allowed := append([][]byte{}, h.metricNameLabels...)
+		if h.seriesMetricsTypeLabels() {
+			allowed = append(allowed, seriesMetricsTypeLabel, seriesStoragePolicyLabel)
+		}
+		if h.idOverrideLabel != nil {
+			allowed = append(allowed, h.idOverrideLabel)
+		}
+		h.reservedLabels = newReservedLabels(v, allowed, scope)
+	}
+
+	if v := writeConfig.RateLimit; v.Default.SamplesPerSecond > 0 || len(v.Clients) > 0 {
+		h.rateLimiter = newClientRateLimiter(v, nowFn, scope)
+	}
+
+	if len(writeConfig.HistogramBuckets) > 0 {
+		h.histogramCollapser = newHistogramBucketCollapser(writeConfig.HistogramBuckets)
+	}
+
+	if v := writeConfig.AdmissionWebhook; v.URL != "" {
+		h.admissionWebhook = newAdmissionWebhook(v, scope)
+	}
+
+	if v := writeConfig.LabelSampler; v.Enabled {
+		sampler := newLabelSampler(v, instrumentOpts.Logger())
+		sampler.Start(v.Interval)
+		h.labelSampler = sampler
+
+		// Feed the sampler from the series observer, chaining any
+		// observer that has already been set.
+		observer := h.seriesObserver
+		h.seriesObserver = func(labels []prompb.Label) {
+			if observer != nil {
+				observer(labels)
+			}
+			sampler.Observe(labels)
+		}
+	}
+
+	if v := writeConfig.WAL; v.Enabled {
+		if v.Path == "" {
+			return nil, errNoWALPath
+		}
+		wal, existing, err := openWriteAheadLog(v.Path, v.MaxSegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("could not open write ahead log: %v", err)
+		}
+		// Replay writes that were accepted by a previous process but not
+		// written before accepting any new writes.
+		for _, path := range existing {
+			if err := replayWALSegment(path, h.writeReplayed); err != nil {
+				wal.Close()
+				return nil, fmt.Errorf("could not replay write ahead log: %v", err)
+			}
+		}
+		h.wal = wal
+	}
+
+	return h, nil
+}
+
+// drainState tracks in flight writes so that the handler can be drained.
+type drainState struct {
+	sync.Mutex
+
+	draining bool
+	inFlight int
+	drained  chan struct{}
 }
 
 type promWriteMetrics struct {
 	writeSuccess             tally.Counter
+	writePartialSuccess      tally.Counter
+	writeEmpty               tally.Counter
+	invalidTimestamps        tally.Counter
+	emptyLabelValues         tally.Counter
+	duplicateTimestamps      tally.Counter
+	outOfRangeValues         tally.Counter
+	seriesSamplesOverLimit   tally.Counter
 	writeErrorsServer        tally.Counter
 	writeErrorsClient        tally.Counter
+	compressionRatioRejected tally.Counter
 	writeBatchLatency        tally.Histogram
 	writeBatchLatencyBuckets tally.DurationBuckets
 	ingestLatency            tally.Histogram
@@ -194,6 +453,22 @@ type promWriteMetrics struct {
 	forwardErrors            tally.Counter
 	forwardDropped           tally.Counter
 	forwardLatency           tally.Histogram
+	coalesced                tally.Counter
+	coalesceFlushSuccess     tally.Counter
+	coalesceFlushErrors      tally.Counter
+	cardinalityRejected      tally.Counter
+	frozen                   tally.Counter
+	authorizationDenied      tally.Counter
+	teeSuccess               tally.Counter
+	teeErrors                tally.Counter
+	walAppendErrors          tally.Counter
+	walDoneErrors            tally.Counter
+	walReplayed              tally.Counter
+	walReplayErrors          tally.Counter
+	parseDuration            tally.Histogram
+	unmarshalDuration        tally.Histogram
+	writeDuration            tally.Histogram
+	inFlight                 tally.Gauge
 }
 
 func (m *promWriteMetrics) incError(err error) {
@@ -209,10 +484,21 @@ func newPromWriteMetrics(scope tally.Scope) (promWriteMetrics, error) {
 	if err != nil {
 		return promWriteMetrics{}, err
 	}
+	// Sub-second buckets from 100us to ~1.6s for timing the individual
+	// phases of handling a request.
+	phaseBuckets := tally.MustMakeExponentialDurationBuckets(100*time.Microsecond, 2, 15)
 	return promWriteMetrics{
 		writeSuccess:             scope.SubScope("write").Counter("success"),
+		writePartialSuccess:      scope.SubScope("write").Counter("partial-success"),
+		writeEmpty:               scope.SubScope("write").Counter("empty"),
+		invalidTimestamps:        scope.SubScope("write").Counter("invalid-timestamp-samples"),
+		emptyLabelValues:         scope.SubScope("write").Counter("empty-label-values"),
+		duplicateTimestamps:      scope.SubScope("write").Counter("duplicate-timestamp-samples"),
+		outOfRangeValues:         scope.SubScope("write").Counter("out-of-range-samples"),
+		seriesSamplesOverLimit:   scope.SubScope("write").Counter("series-samples-over-limit"),
 		writeErrorsServer:        scope.SubScope("write").Tagged(map[string]string{"code": "5XX"}).Counter("errors"),
 		writeErrorsClient:        scope.SubScope("write").Tagged(map[string]string{"code": "4XX"}).Counter("errors"),
+		compressionRatioRejected: scope.SubScope("parse").Tagged(map[string]string{"reason": "compression_ratio"}).Counter("rejected"),
 		writeBatchLatency:        scope.SubScope("write").Histogram("batch-latency", buckets.WriteLatencyBuckets),
 		writeBatchLatencyBuckets: buckets.WriteLatencyBuckets,
 		ingestLatency:            scope.SubScope("ingest").Histogram("latency", buckets.IngestLatencyBuckets),
@@ -221,14 +507,56 @@ func newPromWriteMetrics(scope tally.Scope) (promWriteMetrics, error) {
 		forwardErrors:            scope.SubScope("forward").Counter("errors"),
 		forwardDropped:           scope.SubScope("forward").Counter("dropped"),
 		forwardLatency:           scope.SubScope("forward").Histogram("latency", buckets.WriteLatencyBuckets),
+		coalesced:                scope.SubScope("coalesce").Counter("requests"),
+		coalesceFlushSuccess:     scope.SubScope("coalesce").Counter("flush-success"),
+		coalesceFlushErrors:      scope.SubScope("coalesce").Counter("flush-errors"),
+		cardinalityRejected:      scope.SubScope("cardinality-limit").Counter("rejected"),
+		frozen:                   scope.SubScope("write").Counter("frozen"),
+		authorizationDenied:      scope.SubScope("authorization").Counter("denied-series"),
+		teeSuccess:               scope.SubScope("tee").Counter("success"),
+		teeErrors:                scope.SubScope("tee").Counter("errors"),
+		walAppendErrors:          scope.SubScope("wal").Counter("append-errors"),
+		walDoneErrors:            scope.SubScope("wal").Counter("done-errors"),
+		walReplayed:              scope.SubScope("wal").Counter("replayed"),
+		walReplayErrors:          scope.SubScope("wal").Counter("replay-errors"),
+		parseDuration:            scope.SubScope("parse").Histogram("duration", phaseBuckets),
+		unmarshalDuration:        scope.SubScope("unmarshal").Histogram("duration", phaseBuckets),
+		writeDuration:            scope.SubScope("write").Histogram("duration", phaseBuckets),
+		inFlight:                 scope.SubScope("write").Gauge("in-flight"),
 	}, nil
 }
 
-func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *PromWriteHandler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.beginWrite() {
+		h.metrics.incError(errDraining)
+		xhttp.WriteError(w, errDraining)
+		return
+	}
+	defer h.endWrite()
+
 	batchRequestStopwatch := h.metrics.writeBatchLatency.Start()
 	defer batchRequestStopwatch.Stop()
 
+	// Reject clients that have exhausted their rate limit before the
+	// request body is decoded.
+	var clientID string
+	if h.rateLimiter != nil {
+		clientID = h.rateLimiter.Client(r)
+		if wait, err := h.rateLimiter.Admit(clientID); err != nil {
+			writeRetryAfter(w, wait)
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+	}
+
+	// Advertise the accepted content encodings so that clients
+	// can negotiate the request body compression.
+	w.Header().Set(xhttp.HeaderAcceptEncoding, prometheus.AcceptedContentEncodings)
+
+	parseSpan, _ := xopentracing.StartSpanFromContext(r.Context(), tracepoint.PromWriteParseRequest)
 	checkedReq, err := h.checkedParseRequest(r)
+	finishSpan(parseSpan, err)
 	if err != nil {
 		h.metrics.incError(err)
 		xhttp.WriteError(w, err)
@@ -240,6 +568,89 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		opts   = checkedReq.Options
 		result = checkedReq.CompressResult
 	)
+	if mode := writeMode(opts); mode != "" {
+		w.Header().Set(headers.WriteModeHeader, mode)
+	}
+	tagRequestSpan(r.Context(), req)
+	if h.authorizer.Authorizer != nil {
+		if err := h.authorize(r.Context(), req); err != nil {
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+	}
+
+	if h.rateLimiter != nil {
+		var numSamples int
+		for _, series := range req.Timeseries {
+			numSamples += len(series.Samples)
+		}
+		h.rateLimiter.Charge(clientID, numSamples)
+	}
+
+	if len(req.Timeseries) == 0 {
+		// Empty requests are counted separately from successful writes so
+		// that they can be distinguished from real ingestion.
+		w.WriteHeader(http.StatusOK)
+		h.metrics.writeEmpty.Inc(1)
+		return
+	}
+
+	if h.freezes.Frozen(req, opts) {
+		writeRetryAfter(w, h.freezes.retryAfter)
+		h.metrics.frozen.Inc(1)
+		h.metrics.incError(errWriteFrozen)
+		xhttp.WriteError(w, errWriteFrozen)
+		return
+	}
+
+	if h.admissionWebhook != nil {
+		mapped, err := h.admissionWebhook.Admit(r.Context(), r, req, len(result.UncompressedBody))
+		if err == nil && mapped {
+			// Check the labels mapped by the webhook exactly as those mapped
+			// by the map tags header are, the mapped labels may no longer be
+			// sorted.
+			if err = h.checkLabels(req); err != nil {
+				err = xerrors.NewInvalidParamsError(err)
+			}
+			checkedReq.LabelsSorted = false
+		}
+		if err != nil {
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+	}
+
+	if h.cardinalityLimiter != nil {
+		if err := h.cardinalityLimiter.Admit(req.Timeseries); err != nil {
+			h.metrics.cardinalityRejected.Inc(1)
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+	}
+
+	if h.seriesTracker != nil {
+		h.seriesTracker.Track(req.Timeseries)
+	}
+
+	var watermarkKeys [][8]byte
+	if h.seriesWatermarks != nil {
+		var err error
+		watermarkKeys, err = h.seriesWatermarks.Filter(req, checkedReq.Unit)
+		if err != nil {
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+		if len(req.Timeseries) == 0 {
+			// Every sample was out of order and dropped.
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
 	// Begin async forwarding.
 	// NB(r): Be careful about not returning buffers to pool
 	// if the request bodies ever get pooled until after
@@ -261,7 +672,7 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				// NB: this includes any time for retries.
 				for _, series := range req.Timeseries {
 					for _, sample := range series.Samples {
-						age := now.Sub(storage.PromTimestampToTime(sample.Timestamp))
+						age := now.Sub(sampleTime(sample.Timestamp, checkedReq.Unit))
 						h.metrics.forwardLatency.RecordDuration(age)
 					}
 				}
@@ -289,14 +700,90 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	batchErr := h.write(r.Context(), req, opts)
+	var walEntryDone func()
+	if h.wal != nil && isDefaultWriteOptions(opts) && len(opts.Annotations) == 0 &&
+		checkedReq.TagOptions == nil {
+		entry, err := h.wal.Append(req.Timeseries, checkedReq.Unit)
+		if err != nil {
+			h.metrics.walAppendErrors.Inc(1)
+			h.metrics.incError(err)
+			xhttp.WriteError(w, err)
+			return
+		}
+		walEntryDone = func() { h.walDone(entry) }
+	}
+
+	if h.coalescer != nil && isDefaultWriteOptions(opts) && len(opts.Annotations) == 0 &&
+		!checkedReq.PartialSuccess && checkedReq.Unit == xtime.Millisecond &&
+		checkedReq.TagOptions == nil {
+		// Buffer the series to be written asynchronously as part of a larger
+		// batch, the client is only told that the write has been accepted.
+		h.coalescer.Add(req.Timeseries, walEntryDone)
+		if h.seriesWatermarks != nil {
+			h.seriesWatermarks.Written(req, watermarkKeys, checkedReq.Unit, nil)
+		}
+		if h.counterRates != nil {
+			h.counterRates.Written(req, checkedReq.CounterRateUpdates, nil)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		h.metrics.coalesced.Inc(1)
+		return
+	}
+
+	// Send the status before writing for clients that opted in to the
+	// result of the write being reported in trailers.
+	var (
+		numFailed int
+		trailers  *resultTrailersWriter
+	)
+	if checkedReq.ResultTrailers {
+		if started, ok := startResultTrailers(w); ok {
+			trailers = started
+			w = started
+			defer func() { started.Finish(numFailed) }()
+		}
+	}
+
+	writeSpan, writeCtx := xopentracing.StartSpanFromContext(r.Context(), tracepoint.PromWriteWrite)
+	batchErr := h.write(writeCtx, req, opts, checkedReq.Unit, checkedReq.LabelsSorted,
+		checkedReq.TagOptions)
+	finishSpan(writeSpan, batchErr)
+	numFailed = numFailedSeries(batchErr, len(req.Timeseries))
+
+	if h.seriesWatermarks != nil {
+		h.seriesWatermarks.Written(req, watermarkKeys, checkedReq.Unit, batchErr)
+	}
+
+	// Queue series that failed with retryable errors to be retried in the
+	// background, the client is told the write succeeded.
+	queued := batchErr != nil && h.retryQueue != nil && !checkedReq.PartialSuccess &&
+		checkedReq.TagOptions == nil && h.retryQueue.AddFailed(req, batchErr, opts, checkedReq.Unit, walEntryDone)
+	if h.counterRates != nil {
+		// Queued series are written once retried so are recorded as written.
+		rateErr := batchErr
+		if queued {
+			rateErr = nil
+		}
+		h.counterRates.Written(req, checkedReq.CounterRateUpdates, rateErr)
+	}
+	if walEntryDone != nil && !queued {
+		// The result of the write is returned to the client so the write
+		// is done regardless of whether it succeeded.
+		walEntryDone()
+	}
 
 	// Record ingestion delay latency
-	now := h.nowFn()
-	for _, series := range req.Timeseries {
-		for _, sample := range series.Samples {
-			age := now.Sub(storage.PromTimestampToTime(sample.Timestamp))
-			h.metrics.ingestLatency.RecordDuration(age)
+	h.recordIngestLatency(req, checkedReq.Unit)
+
+	if queued {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if batchErr != nil && checkedReq.PartialSuccess {
+		if failed, ok := failedSeries(batchErr); ok && len(failed) < len(req.Timeseries) {
+			h.writePartialSuccess(w, req, failed)
+			return
 		}
 	}
 
@@ -309,17 +796,13 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			numBadRequest     int
 		)
 		for _, err := range errs {
-			switch {
-			case client.IsBadRequestError(err):
+			if isBadRequestWriteError(err) {
 				numBadRequest++
 				lastBadRequestErr = err.Error()
-			case xerrors.IsInvalidParams(err):
-				numBadRequest++
-				lastBadRequestErr = err.Error()
-			default:
-				numRegular++
-				lastRegularErr = err.Error()
+				continue
 			}
+			numRegular++
+			lastRegularErr = err.Error()
 		}
 
 		var status int
@@ -331,13 +814,16 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		logger := logging.WithContext(r.Context(), h.instrumentOpts)
-		logger.Error("write error",
+		fields := []zap.Field{
 			zap.String("remoteAddr", r.RemoteAddr),
 			zap.Int("httpResponseStatusCode", status),
 			zap.Int("numRegularErrors", numRegular),
 			zap.Int("numBadRequestErrors", numBadRequest),
 			zap.String("lastRegularError", lastRegularErr),
-			zap.String("lastBadRequestErr", lastBadRequestErr))
+			zap.String("lastBadRequestErr", lastBadRequestErr),
+		}
+		logger.Error("write error", append(fields,
+			firstFailedSeriesFields(req, errs, h.metricNameLabels)...)...)
 
 		var resultErrMessage string
 		if lastRegularErr != "" {
@@ -355,6 +841,12 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		resultError := xhttp.NewError(errors.New(resultErrMessage), status)
 		h.metrics.incError(resultError)
+		if trailers != nil {
+			// The status has already been sent so the error is only
+			// reported in the trailers.
+			trailers.WriteError(resultError)
+			return
+		}
 		xhttp.WriteError(w, resultError)
 		return
 	}
@@ -366,10 +858,300 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.metrics.writeSuccess.Inc(1)
 }
 
+// TagOptions returns the tag options the handler converts the labels of
+// written series to tags with, which determine the metric name and bucket
+// tags and the ID scheme of the series.
+func (h *PromWriteHandler) TagOptions() models.TagOptions {
+	return h.tagOptions
+}
+
+// Drain stops the handler accepting new writes, subsequent requests are
+// rejected with a 503 status, and waits for in flight writes to complete
+// including any coalesced writes, stops retrying queued writes, waits for
+// queued ingest latency to be recorded, and then closes the write ahead log
+// if enabled. It returns an error if the context is done before the handler
+// is drained, if the context is done while coalesced writes are being flushed
+// the rest of the handler is still closed on a best effort basis.
+func (h *PromWriteHandler) Drain(ctx context.Context) error {
+	h.drainState.Lock()
+	if !h.drainState.draining {
+		h.drainState.draining = true
+		h.drainState.drained = make(chan struct{})
+		if h.drainState.inFlight == 0 {
+			close(h.drainState.drained)
+		}
+	}
+	drained := h.drainState.drained
+	h.drainState.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if h.labelSampler != nil {
+		h.labelSampler.Close()
+	}
+
+	if h.coalescer != nil {
+		coalescerClosed := make(chan struct{})
+		go func() {
+			h.coalescer.Close()
+			close(coalescerClosed)
+		}()
+		select {
+		case <-coalescerClosed:
+		case <-ctx.Done():
+			// The coalesced writes still being flushed are abandoned but the
+			// rest of the handler is closed regardless, the entries of the
+			// abandoned writes are retained in the write ahead log to be
+			// replayed on start up.
+			h.closeBackground() //nolint:errcheck
+			return ctx.Err()
+		}
+	}
+
+	return h.closeBackground()
+}
+
+// closeBackground stops retrying queued writes, waits for queued ingest
+// latency to be recorded and closes the write ahead log if enabled.
+func (h *PromWriteHandler) closeBackground() error {
+	if h.retryQueue != nil {
+		h.retryQueue.Close()
+	}
+
+	if h.latencyRecorder != nil {
+		h.latencyRecorder.Close()
+	}
+
+	if h.wal != nil {
+		return h.wal.Close()
+	}
+	return nil
+}
+
+func (h *PromWriteHandler) beginWrite() bool {
+	h.drainState.Lock()
+	defer h.drainState.Unlock()
+	if h.drainState.draining {
+		return false
+	}
+	h.drainState.inFlight++
+	h.metrics.inFlight.Update(float64(h.drainState.inFlight))
+	return true
+}
+
+func (h *PromWriteHandler) endWrite() {
+	h.drainState.Lock()
+	defer h.drainState.Unlock()
+	h.drainState.inFlight--
+	h.metrics.inFlight.Update(float64(h.drainState.inFlight))
+	if h.drainState.draining && h.drainState.inFlight == 0 {
+		close(h.drainState.drained)
+	}
+}
+
+func (h *PromWriteHandler) recordIngestLatency(req *prompb.WriteRequest, unit xtime.Unit) {
+	if h.writeConfig.DisableIngestLatencyMetric {
+		return
+	}
+
+	now := h.nowFn()
+	if h.latencyRecorder != nil {
+		h.latencyRecorder.Record(req, unit, now)
+		return
+	}
+	for _, series := range req.Timeseries {
+		for _, sample := range series.Samples {
+			age := now.Sub(sampleTime(sample.Timestamp, unit))
+			h.metrics.ingestLatency.RecordDuration(age)
+		}
+	}
+}
+
+// writeCoalesced writes a batch of series coalesced from multiple requests,
+// errors can no longer be returned to clients so they are only logged.
+func (h *PromWriteHandler) writeCoalesced(series []prompb.TimeSeries) bool {
+	req := &prompb.WriteRequest{Timeseries: series}
+	batchErr := h.write(context.Background(), req, ingest.WriteOptions{}, xtime.Millisecond,
+		false, nil)
+	h.recordIngestLatency(req, xtime.Millisecond)
+	if batchErr != nil {
+		h.metrics.coalesceFlushErrors.Inc(1)
+		logger := logging.WithContext(context.Background(), h.instrumentOpts)
+		logger.Error("coalesced write error",
+			zap.Int("numSeries", len(series)),
+			zap.Int("numErrors", len(batchErr.Errors())),
+			zap.Error(batchErr.LastError()))
+		return false
+	}
+	h.metrics.coalesceFlushSuccess.Inc(1)
+	return true
+}
+
+// writeRetried writes a batch of series being retried by the retry queue.
+func (h *PromWriteHandler) writeRetried(
+	series []prompb.TimeSeries,
+	opts ingest.WriteOptions,
+	unit xtime.Unit,
+) ingest.BatchError {
+	req := &prompb.WriteRequest{Timeseries: series}
+	return h.write(context.Background(), req, opts, unit, false, nil)
+}
+
+// writeReplayed writes a batch replayed from the write ahead log, errors are
+// only logged since the client was already told the write was accepted.
+func (h *PromWriteHandler) writeReplayed(series []prompb.TimeSeries, unit xtime.Unit) {
+	req := &prompb.WriteRequest{Timeseries: series}
+	batchErr := h.write(context.Background(), req, ingest.WriteOptions{}, unit, false, nil)
+	h.metrics.walReplayed.Inc(1)
+	if batchErr != nil {
+		h.metrics.walReplayErrors.Inc(1)
+		logger := logging.WithContext(context.Background(), h.instrumentOpts)
+		logger.Error("write ahead log replay error",
+			zap.Int("numSeries", len(series)),
+			zap.Int("numErrors", len(batchErr.Errors())),
+			zap.Error(batchErr.LastError()))
+	}
+}
+
+func (h *PromWriteHandler) walDone(entry walEntry) {
+	if err := h.wal.Done(entry); err != nil {
+		h.metrics.walDoneErrors.Inc(1)
+		logger := logging.WithContext(context.Background(), h.instrumentOpts)
+		logger.Error("write ahead log done error", zap.Error(err))
+	}
+}
+
 type parseRequestResult struct {
 	Request        *prompb.WriteRequest
 	Options        ingest.WriteOptions
 	CompressResult prometheus.ParsePromCompressedRequestResult
+	PartialSuccess bool
+	// Unit is the precision of the sample timestamps in the request.
+	Unit xtime.Unit
+	// LabelsSorted is true if the client set the labels sorted header and
+	// the labels of every series were validated to be sorted by name.
+	LabelsSorted bool
+	// ResultTrailers is true if the client set the result trailers header,
+	// the request is HTTP/2 and result trailers are allowed.
+	ResultTrailers bool
+	// TagOptions if not nil are the tag options of the ID scheme selected by
+	// the client, which override the tag options of the handler.
+	TagOptions models.TagOptions
+	// CounterRateUpdates are the previous samples of the counters that had
+	// their rates derived, which are recorded once the request is written.
+	CounterRateUpdates []counterRateUpdate
+}
+
+// partialSuccessResponse is the body of a partial success response.
+type partialSuccessResponse struct {
+	SamplesWritten int `json:"samplesWritten"`
+	SamplesFailed  int `json:"samplesFailed"`
+	// FailedSeries are the series that failed to be written.
+	FailedSeries []partialSuccessFailedSeries `json:"failedSeries"`
+}
+
+// partialSuccessFailedSeries is a series of a partial success response that
+// failed to be written.
+type partialSuccessFailedSeries struct {
+	// Index is the position of the series in the series written, which may
+	// differ from its position in the request since series may have been
+	// dropped, merged or added before being written.
+	Index int `json:"index"`
+	// Labels are the labels of the series written, so include any changes
+	// such as mapped tags.
+	Labels map[string]string `json:"labels"`
+}
+
+// failedSeries returns the sorted indices of the series that failed to be
+// written, the result is false if any error was not specific to a series
+// in which case the request cannot be reported as a partial success.
+func failedSeries(batchErr ingest.BatchError) ([]int, bool) {
+	var (
+		errs    = batchErr.Errors()
+		indices = make(map[int]struct{}, len(errs))
+	)
+	for _, err := range errs {
+		index, ok := ingest.SeriesErrorIndex(err)
+		if !ok {
+			return nil, false
+		}
+		indices[index] = struct{}{}
+	}
+
+	failed := make([]int, 0, len(indices))
+	for index := range indices {
+		failed = append(failed, index)
+	}
+	sort.Ints(failed)
+	return failed, true
+}
+
+// firstFailedSeriesFields returns log fields that identify the first series
+// of the request that failed to be written, the series is identified by its
+// metric name and a fingerprint of its labels. No fields are returned if no
+// error is for a series of the request.
+func firstFailedSeriesFields(
+	req *prompb.WriteRequest,
+	errs []error,
+	metricNameLabels [][]byte,
+) []zap.Field {
+	first := -1
+	for _, err := range errs {
+		index, ok := ingest.SeriesErrorIndex(err)
+		if ok && index < len(req.Timeseries) && (first < 0 || index < first) {
+			first = index
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	labels := req.Timeseries[first].Labels
+	name, _ := metricNameValue(labels, metricNameLabels)
+	fingerprint := seriesKey(labels)
+	return []zap.Field{
+		zap.Int("firstFailedSeriesIndex", first),
+		zap.ByteString("firstFailedSeriesName", name),
+		zap.String("firstFailedSeriesFingerprint", hex.EncodeToString(fingerprint[:])),
+	}
+}
+
+func (h *PromWriteHandler) writePartialSuccess(
+	w http.ResponseWriter,
+	req *prompb.WriteRequest,
+	failed []int,
+) {
+	resp := partialSuccessResponse{
+		FailedSeries: make([]partialSuccessFailedSeries, 0, len(failed)),
+	}
+	for _, series := range req.Timeseries {
+		resp.SamplesWritten += len(series.Samples)
+	}
+	for _, index := range failed {
+		if index >= len(req.Timeseries) {
+			continue
+		}
+		series := req.Timeseries[index]
+		resp.SamplesFailed += len(series.Samples)
+		labels := make(map[string]string, len(series.Labels))
+		for _, label := range series.Labels {
+			labels[string(label.Name)] = string(label.Value)
+		}
+		resp.FailedSeries = append(resp.FailedSeries, partialSuccessFailedSeries{
+			Index:  index,
+			Labels: labels,
+		})
+	}
+	resp.SamplesWritten -= resp.SamplesFailed
+
+	w.Header().Set(headers.SamplesWrittenHeader, strconv.Itoa(resp.SamplesWritten))
+	w.Header().Set(headers.SamplesFailedHeader, strconv.Itoa(resp.SamplesFailed))
+	xhttp.WriteJSONResponse(w, resp, h.instrumentOpts.Logger())
+	h.metrics.writePartialSuccess.Inc(1)
 }
 
 func (h *PromWriteHandler) checkedParseRequest(
@@ -402,30 +1184,9 @@ func (h *PromWriteHandler) parseRequest(
 			return parseRequestResult{}, err
 		}
 
-		// Ensure ingest options specify we are overriding the
-		// downsampling rules with zero rules to be applied (so
-		// only direct writes will be made).
-		opts.DownsampleOverride = true
-		opts.DownsampleMappingRules = nil
-
 		strPolicy := strings.TrimSpace(r.Header.Get(headers.MetricsStoragePolicyHeader))
-		switch metricsType {
-		case storagemetadata.UnaggregatedMetricsType:
-			if strPolicy != emptyStoragePolicyVar {
-				return parseRequestResult{}, errUnaggregatedStoragePolicySet
-			}
-		default:
-			parsed, err := policy.ParseStoragePolicy(strPolicy)
-			if err != nil {
-				err = fmt.Errorf("could not parse storage policy: %v", err)
-				return parseRequestResult{}, err
-			}
-
-			// Make sure this specific storage policy is used for the writes.
-			opts.WriteOverride = true
-			opts.WriteStoragePolicies = policy.StoragePolicies{
-				parsed,
-			}
+		if err := setMetricsTypeWriteOptions(&opts, metricsType, strPolicy); err != nil {
+			return parseRequestResult{}, err
 		}
 	}
 	if v := strings.TrimSpace(r.Header.Get(headers.WriteTypeHeader)); v != "" {
@@ -440,14 +1201,132 @@ func (h *PromWriteHandler) parseRequest(
 		}
 	}
 
-	result, err := prometheus.ParsePromCompressedRequest(r)
-	if err != nil {
-		return parseRequestResult{}, err
+	opts.FailFast = h.writeConfig.FailFast
+
+	for name, values := range r.Header {
+		if len(values) == 0 || !strings.HasPrefix(name, headers.AnnotationHeaderPrefix) {
+			continue
+		}
+		annotation := strings.ToLower(strings.TrimPrefix(name, headers.AnnotationHeaderPrefix))
+		if annotation == "" {
+			continue
+		}
+		if opts.Annotations == nil {
+			opts.Annotations = make(map[string]string)
+		}
+		opts.Annotations[annotation] = values[0]
 	}
 
-	var req prompb.WriteRequest
-	if err := proto.Unmarshal(result.UncompressedBody, &req); err != nil {
-		return parseRequestResult{}, err
+	var partialSuccess bool
+	if v := strings.TrimSpace(r.Header.Get(headers.PartialSuccessHeader)); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			err = fmt.Errorf("could not parse partial success: %v", err)
+			return parseRequestResult{}, err
+		}
+		partialSuccess = parsed
+	}
+
+	unit := xtime.Millisecond
+	if v := strings.TrimSpace(r.Header.Get(headers.TimestampPrecisionHeader)); v != "" {
+		parsed, err := parseTimestampPrecision(v)
+		if err != nil {
+			return parseRequestResult{}, err
+		}
+		unit = parsed
+	}
+
+	var tagOpts models.TagOptions
+	if v := strings.TrimSpace(r.Header.Get(headers.IDSchemeHeader)); v != "" &&
+		len(h.idSchemeTagOptions) > 0 {
+		schemeOpts, ok := h.idSchemeTagOptions[v]
+		if !ok {
+			return parseRequestResult{}, fmt.Errorf("unknown id scheme: %s", v)
+		}
+		if schemeOpts.IDSchemeType() != h.tagOptions.IDSchemeType() {
+			tagOpts = schemeOpts
+		}
+	}
+
+	var resultTrailers bool
+	if v := strings.TrimSpace(r.Header.Get(headers.ResultTrailersHeader)); v != "" &&
+		h.writeConfig.ResultTrailers && r.ProtoMajor >= 2 {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			err = fmt.Errorf("could not parse result trailers: %v", err)
+			return parseRequestResult{}, err
+		}
+		resultTrailers = parsed
+	}
+
+	var labelsSorted bool
+	if v := strings.TrimSpace(r.Header.Get(headers.LabelsSortedHeader)); v != "" &&
+		h.writeConfig.TrustSortedLabels {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			err = fmt.Errorf("could not parse labels sorted: %v", err)
+			return parseRequestResult{}, err
+		}
+		labelsSorted = parsed
+	}
+
+	parseStopwatch := h.metrics.parseDuration.Start()
+	result, err := prometheus.ParsePromCompressedRequestWithOptions(r, h.parseOptions)
+	parseStopwatch.Stop()
+	if err != nil {
+		if prometheus.IsDecompressionRatioError(err) {
+			h.metrics.compressionRatioRejected.Inc(1)
+		}
+		return parseRequestResult{}, err
+	}
+
+	var req prompb.WriteRequest
+	unmarshalStopwatch := h.metrics.unmarshalDuration.Start()
+	err = proto.Unmarshal(result.UncompressedBody, &req)
+	unmarshalStopwatch.Stop()
+	if err != nil {
+		return parseRequestResult{}, err
+	}
+
+	if h.decodedObserver != nil {
+		// Copy the body since the observer may retain it beyond the
+		// lifetime of the request.
+		raw := make([]byte, len(result.UncompressedBody))
+		copy(raw, result.UncompressedBody)
+		h.decodedObserver(raw)
+	}
+
+	if isEncodedSamplesRequest(r) {
+		if !h.writeConfig.EncodedSamples {
+			return parseRequestResult{}, errEncodedSamplesNotAllowed
+		}
+		if err := decodeEncodedSamples(result.UncompressedBody, &req, unit); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if h.writeConfig.StrictDecode {
+		if err := validateStrict(result.UncompressedBody, &req); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if labelsSorted {
+		// Validate the labels as sent by the client, the labels of series
+		// changed after this point are sorted again when converted to tags.
+		if err := validateSortedLabels(&req); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if h.writeConfig.SamplePolicyHints {
+		hints, err := decodeSamplePolicyHints(result.UncompressedBody)
+		if err != nil {
+			return parseRequestResult{}, err
+		}
+		if err := applySamplePolicyHints(&req, hints); err != nil {
+			return parseRequestResult{}, err
+		}
 	}
 
 	if mapStr := r.Header.Get(headers.MapTagsByJSONHeader); mapStr != "" {
@@ -461,24 +1340,914 @@ func (h *PromWriteHandler) parseRequest(
 		}
 	}
 
+	if err := h.checkLabels(&req); err != nil {
+		return parseRequestResult{}, err
+	}
+
+	if h.histogramCollapser != nil {
+		h.histogramCollapser.Collapse(&req)
+	}
+
+	if h.writeConfig.SummaryGrouping {
+		if err := groupSummaries(&req); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if v := strings.TrimSpace(r.Header.Get(headers.TimestampOffsetHeader)); v != "" {
+		if !h.writeConfig.AllowTimestampOffset {
+			return parseRequestResult{}, errTimestampOffsetNotAllowed
+		}
+
+		offset, err := time.ParseDuration(v)
+		if err != nil {
+			err = fmt.Errorf("could not parse timestamp offset: %v", err)
+			return parseRequestResult{}, err
+		}
+
+		offsetTimestamps(&req, offset, unit)
+	}
+
+	if mode := h.writeConfig.InvalidTimestamps; mode != "" {
+		if err := h.handleInvalidTimestamps(&req, mode); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if v := h.writeConfig.ValueRanges; len(v.Metrics) > 0 {
+		if err := h.handleValueRanges(&req, v); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if h.counterMonotonicity != nil {
+		h.counterMonotonicity.Check(&req)
+	}
+
+	if mode := h.writeConfig.DuplicateTimestamps; mode != "" {
+		if err := h.handleDuplicateTimestamps(&req, mode); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	if v := h.writeConfig.SeriesSampleLimit; v.MaxSamplesPerSeries > 0 {
+		if err := h.handleSeriesSampleLimit(&req, v); err != nil {
+			return parseRequestResult{}, err
+		}
+	}
+
+	var counterRateUpdates []counterRateUpdate
+	if h.counterRates != nil {
+		counterRateUpdates = h.counterRates.Apply(&req, unit)
+	}
+
 	return parseRequestResult{
-		Request:        &req,
-		Options:        opts,
-		CompressResult: result,
+		Request:            &req,
+		Options:            opts,
+		CompressResult:     result,
+		PartialSuccess:     partialSuccess,
+		Unit:               unit,
+		LabelsSorted:       labelsSorted,
+		ResultTrailers:     resultTrailers,
+		TagOptions:         tagOpts,
+		CounterRateUpdates: counterRateUpdates,
 	}, nil
 }
 
+// checkLabels lower cases the label names of the request if enabled and
+// validates the label names and values, it is run on the labels as sent by the
+// client and again on any labels mapped by the admission webhook.
+func (h *PromWriteHandler) checkLabels(req *prompb.WriteRequest) error {
+	if h.writeConfig.LowerCaseLabelNames {
+		lowerCaseLabelNames(req)
+	}
+
+	if err := validateNames(req, h.writeConfig.NameValidation, h.metricNameLabels); err != nil {
+		return err
+	}
+
+	if mode := h.writeConfig.EmptyLabelValues; mode != "" {
+		if err := h.handleEmptyLabelValues(req, mode); err != nil {
+			return err
+		}
+	}
+
+	if h.reservedLabels != nil {
+		if err := h.reservedLabels.Check(req); err != nil {
+			return err
+		}
+	}
+
+	if h.requiredLabels != nil {
+		if err := h.requiredLabels.Check(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StoragePolicyParseError is returned when the storage policy that a write
+// request or series is written with cannot be parsed.
+type StoragePolicyParseError struct {
+	// Policy is the storage policy that could not be parsed.
+	Policy string
+	// Err is the parse error.
+	Err error
+}
+
+func (e StoragePolicyParseError) Error() string {
+	return fmt.Sprintf("could not parse storage policy: %v", e.Err)
+}
+
+// InnerError returns the parse error.
+func (e StoragePolicyParseError) InnerError() error {
+	return e.Err
+}
+
+// IsStoragePolicyParseError returns whether the error is or contains a
+// storage policy parse error.
+func IsStoragePolicyParseError(err error) bool {
+	for err != nil {
+		if _, ok := err.(StoragePolicyParseError); ok {
+			return true
+		}
+		err = xerrors.InnerError(err)
+	}
+	return false
+}
+
+// writeMode returns the write mode of the write options, which is empty if
+// the options neither write directly to storage nor downsample. Series that
+// set their own metrics type with the reserved labels or are routed by type
+// may be written with a different mode.
+func writeMode(opts ingest.WriteOptions) string {
+	var (
+		direct      = !opts.WriteOverride || len(opts.WriteStoragePolicies) > 0
+		downsampled = !opts.DownsampleOverride || len(opts.DownsampleMappingRules) > 0
+	)
+	switch {
+	case direct && downsampled:
+		return headers.BothWriteMode
+	case direct:
+		return headers.DirectWriteMode
+	case downsampled:
+		return headers.DownsampledWriteMode
+	default:
+		return ""
+	}
+}
+
+// setMetricsTypeWriteOptions sets the write options to write directly with
+// the metrics type and storage policy, rather than with the default rules
+// and policies.
+func setMetricsTypeWriteOptions(
+	opts *ingest.WriteOptions,
+	metricsType storagemetadata.MetricsType,
+	strPolicy string,
+) error {
+	// Ensure ingest options specify we are overriding the
+	// downsampling rules with zero rules to be applied (so
+	// only direct writes will be made).
+	opts.DownsampleOverride = true
+	opts.DownsampleMappingRules = nil
+
+	switch metricsType {
+	case storagemetadata.UnaggregatedMetricsType:
+		if strPolicy != emptyStoragePolicyVar {
+			return errUnaggregatedStoragePolicySet
+		}
+		opts.WriteOverride = false
+		opts.WriteStoragePolicies = nil
+	default:
+		parsed, err := policy.ParseStoragePolicy(strPolicy)
+		if err != nil {
+			return StoragePolicyParseError{Policy: strPolicy, Err: err}
+		}
+
+		// Make sure this specific storage policy is used for the writes.
+		opts.WriteOverride = true
+		opts.WriteStoragePolicies = policy.StoragePolicies{
+			parsed,
+		}
+	}
+	return nil
+}
+
+// parseTimestampPrecision parses the value of the timestamp precision header.
+func parseTimestampPrecision(v string) (xtime.Unit, error) {
+	switch v {
+	case "ns":
+		return xtime.Nanosecond, nil
+	case "us":
+		return xtime.Microsecond, nil
+	case "ms":
+		return xtime.Millisecond, nil
+	case "s":
+		return xtime.Second, nil
+	default:
+		return xtime.None, fmt.Errorf("unrecognized timestamp precision: %s", v)
+	}
+}
+
+// sampleTime converts a sample timestamp with the given precision to a time.
+func sampleTime(timestamp int64, unit xtime.Unit) time.Time {
+	d, err := unit.Value()
+	if err != nil {
+		d = time.Millisecond
+	}
+	return xtime.FromNormalizedTime(timestamp, d)
+}
+
+// validateNames validates the metric and label names of all series in the
+// request using the given validation mode, the values of any of the metric
+// name labels are validated as metric names.
+func validateNames(
+	req *prompb.WriteRequest,
+	mode config.NameValidationMode,
+	metricNameLabels [][]byte,
+) error {
+	var isValidMetricName, isValidLabelName func([]byte) bool
+	switch mode {
+	case config.NameValidationLegacy:
+		isValidMetricName, isValidLabelName = isLegacyMetricName, isLegacyLabelName
+	case config.NameValidationUTF8:
+		isValidMetricName, isValidLabelName = isUTF8Name, isUTF8Name
+	default:
+		return nil
+	}
+
+	for _, series := range req.Timeseries {
+		for _, label := range series.Labels {
+			if !isValidLabelName(label.Name) {
+				return fmt.Errorf("invalid label name: %q", label.Name)
+			}
+			if isMetricNameLabel(label.Name, metricNameLabels) &&
+				!isValidMetricName(label.Value) {
+				return fmt.Errorf("invalid metric name: %q", label.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// newMetricNameLabels returns the names of the labels that carry the metric
+// name of a series, the __name__ label is converted to the metric name tag of
+// the tag options so a label with the name of the tag also carries the metric
+// name when it differs from __name__.
+func newMetricNameLabels(tagOptions models.TagOptions) [][]byte {
+	labels := [][]byte{metricNameLabel}
+	if name := tagOptions.MetricName(); !bytes.Equal(name, metricNameLabel) {
+		labels = append(labels, name)
+	}
+	return labels
+}
+
+func isMetricNameLabel(name []byte, metricNameLabels [][]byte) bool {
+	for _, l := range metricNameLabels {
+		if bytes.Equal(name, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// metricNameValue returns the metric name of the series from the first of
+// the metric name labels that the series has.
+func metricNameValue(labels []prompb.Label, metricNameLabels [][]byte) ([]byte, bool) {
+	for _, name := range metricNameLabels {
+		if v, ok := labelValue(labels, name); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func isLegacyMetricName(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for i, c := range b {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == ':' ||
+			(c >= '0' && c <= '9' && i > 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLegacyLabelName(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for i, c := range b {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+			(c >= '0' && c <= '9' && i > 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isUTF8Name(b []byte) bool {
+	return len(b) > 0 && utf8.Valid(b)
+}
+
+// validateSortedLabels returns an error if the labels of any series in the
+// request are not strictly sorted by name.
+func validateSortedLabels(req *prompb.WriteRequest) error {
+	for i, series := range req.Timeseries {
+		for j := 1; j < len(series.Labels); j++ {
+			if bytes.Compare(series.Labels[j-1].Name, series.Labels[j].Name) >= 0 {
+				return fmt.Errorf("series %d labels are not sorted: %q is not before %q",
+					i, series.Labels[j-1].Name, series.Labels[j].Name)
+			}
+		}
+	}
+	return nil
+}
+
+// lowerCaseLabelNames folds the label names of all series in the request to
+// lower case, ASCII names are folded in place to avoid allocating.
+func lowerCaseLabelNames(req *prompb.WriteRequest) {
+	for i := range req.Timeseries {
+		labels := req.Timeseries[i].Labels
+		for j := range labels {
+			labels[j].Name = lowerCaseInPlace(labels[j].Name)
+		}
+	}
+}
+
+func lowerCaseInPlace(b []byte) []byte {
+	for i, c := range b {
+		if c >= utf8.RuneSelf {
+			// Non-ASCII so fallback to the unicode aware conversion.
+			return bytes.ToLower(b)
+		}
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return b
+}
+
+// authorize checks each series of the request with the authorizer, series
+// that are not authorized either fail the request with a 403 status or are
+// removed from the request depending on the authorizer mode.
+func (h *PromWriteHandler) authorize(ctx context.Context, req *prompb.WriteRequest) error {
+	series := req.Timeseries[:0]
+	for i, s := range req.Timeseries {
+		labels := s.Labels
+		if !sort.SliceIsSorted(labels, func(i, j int) bool {
+			return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+		}) {
+			sort.Slice(labels, func(i, j int) bool {
+				return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+			})
+		}
+
+		err := h.authorizer.Authorizer.Allowed(ctx, labels)
+		if err == nil {
+			series = append(series, s)
+			continue
+		}
+		h.metrics.authorizationDenied.Inc(1)
+		if h.authorizer.Mode != options.PromWriteAuthorizerModeDrop {
+			return xhttp.NewError(fmt.Errorf("series %d not authorized: %v", i, err),
+				http.StatusForbidden)
+		}
+	}
+	req.Timeseries = series
+	return nil
+}
+
+// handleEmptyLabelValues rejects or drops series with a label that has an
+// empty value, or removes the labels with empty values, depending on the
+// mode. Removing labels keeps the remaining labels in the same order.
+func (h *PromWriteHandler) handleEmptyLabelValues(
+	req *prompb.WriteRequest,
+	mode config.EmptyLabelValueMode,
+) error {
+	var (
+		numEmpty int
+		series   = req.Timeseries[:0]
+	)
+	for i, s := range req.Timeseries {
+		var empty int
+		for _, label := range s.Labels {
+			if len(label.Value) > 0 {
+				continue
+			}
+			empty++
+			if mode == config.EmptyLabelValueReject {
+				h.metrics.emptyLabelValues.Inc(int64(numEmpty + empty))
+				return fmt.Errorf("series %d has label with empty value: %s", i, label.Name)
+			}
+		}
+		numEmpty += empty
+		if empty == 0 {
+			series = append(series, s)
+			continue
+		}
+		if mode == config.EmptyLabelValueDropSeries {
+			continue
+		}
+
+		labels := make([]prompb.Label, 0, len(s.Labels)-empty)
+		for _, label := range s.Labels {
+			if len(label.Value) > 0 {
+				labels = append(labels, label)
+			}
+		}
+		s.Labels = labels
+		series = append(series, s)
+	}
+	req.Timeseries = series
+	h.metrics.emptyLabelValues.Inc(int64(numEmpty))
+	return nil
+}
+
+// handleInvalidTimestamps rejects or drops samples with a zero or negative
+// timestamp depending on the mode, in drop mode series left without any
+// samples are removed from the request.
+func (h *PromWriteHandler) handleInvalidTimestamps(
+	req *prompb.WriteRequest,
+	mode config.InvalidTimestampMode,
+) error {
+	var (
+		numInvalid int
+		series     = req.Timeseries[:0]
+	)
+	for i, s := range req.Timeseries {
+		samples := s.Samples[:0]
+		for _, sample := range s.Samples {
+			if sample.Timestamp > 0 {
+				samples = append(samples, sample)
+				continue
+			}
+			numInvalid++
+			if mode == config.InvalidTimestampReject {
+				h.metrics.invalidTimestamps.Inc(int64(numInvalid))
+				return fmt.Errorf("series %d has a sample with invalid timestamp: %d",
+					i, sample.Timestamp)
+			}
+		}
+		if len(samples) == 0 && len(s.Samples) > 0 {
+			continue
+		}
+		s.Samples = samples
+		series = append(series, s)
+	}
+	req.Timeseries = series
+	h.metrics.invalidTimestamps.Inc(int64(numInvalid))
+	return nil
+}
+
+// handleValueRanges rejects or drops samples with a value outside of the
+// range configured for the metric name of their series depending on the
+// mode, in drop mode series left without any samples are removed from the
+// request.
+func (h *PromWriteHandler) handleValueRanges(
+	req *prompb.WriteRequest,
+	cfg config.PromRemoteWriteValueRangesConfiguration,
+) error {
+	var (
+		numOutOfRange int
+		series        = req.Timeseries[:0]
+	)
+	for i, s := range req.Timeseries {
+		name, ok := metricNameValue(s.Labels, h.metricNameLabels)
+		if !ok {
+			series = append(series, s)
+			continue
+		}
+		valueRange, ok := cfg.Metrics[string(name)]
+		if !ok {
+			series = append(series, s)
+			continue
+		}
+
+		samples := s.Samples[:0]
+		for _, sample := range s.Samples {
+			v := sample.Value
+			if math.IsNaN(v) || (v >= valueRange.Min && v <= valueRange.Max) {
+				samples = append(samples, sample)
+				continue
+			}
+			numOutOfRange++
+			if cfg.Mode == config.ValueRangeReject {
+				h.metrics.outOfRangeValues.Inc(int64(numOutOfRange))
+				return fmt.Errorf("series %d has a %s sample with out of range value: %v",
+					i, name, v)
+			}
+		}
+		if len(samples) == 0 && len(s.Samples) > 0 {
+			continue
+		}
+		s.Samples = samples
+		series = append(series, s)
+	}
+	req.Timeseries = series
+	h.metrics.outOfRangeValues.Inc(int64(numOutOfRange))
+	return nil
+}
+
+// handleDuplicateTimestamps sorts the samples of each series by timestamp
+// and reduces samples that share a timestamp to a single sample depending on
+// the mode, in reject mode samples that share a timestamp are only rejected
+// if their values differ.
+func (h *PromWriteHandler) handleDuplicateTimestamps(
+	req *prompb.WriteRequest,
+	mode config.DuplicateTimestampMode,
+) error {
+	var numDuplicate int
+	for i := range req.Timeseries {
+		s := &req.Timeseries[i]
+		if len(s.Samples) < 2 {
+			continue
+		}
+		if !sort.SliceIsSorted(s.Samples, func(a, b int) bool {
+			return s.Samples[a].Timestamp < s.Samples[b].Timestamp
+		}) {
+			// Sort stably so that first and last refer to the request order.
+			sort.SliceStable(s.Samples, func(a, b int) bool {
+				return s.Samples[a].Timestamp < s.Samples[b].Timestamp
+			})
+		}
+
+		samples := s.Samples[:1]
+		for _, sample := range s.Samples[1:] {
+			last := &samples[len(samples)-1]
+			if sample.Timestamp != last.Timestamp {
+				samples = append(samples, sample)
+				continue
+			}
+			numDuplicate++
+			switch mode {
+			case config.DuplicateTimestampLastWins:
+				last.Value = sample.Value
+			case config.DuplicateTimestampReject:
+				if math.Float64bits(sample.Value) != math.Float64bits(last.Value) {
+					h.metrics.duplicateTimestamps.Inc(int64(numDuplicate))
+					return fmt.Errorf("series %d %s has samples with different values at timestamp: %d",
+						i, DeterministicSeriesID(s.Labels), sample.Timestamp)
+				}
+			case config.DuplicateTimestampMax:
+				if sample.Value > last.Value {
+					last.Value = sample.Value
+				}
+			case config.DuplicateTimestampMin:
+				if sample.Value < last.Value {
+					last.Value = sample.Value
+				}
+			}
+		}
+		s.Samples = samples
+	}
+	h.metrics.duplicateTimestamps.Inc(int64(numDuplicate))
+	return nil
+}
+
+// handleSeriesSampleLimit rejects the request if a series has more samples
+// than the limit or truncates the series to its newest samples depending on
+// the mode. Truncated series have their samples sorted by timestamp.
+func (h *PromWriteHandler) handleSeriesSampleLimit(
+	req *prompb.WriteRequest,
+	cfg config.PromRemoteWriteSeriesSampleLimitConfiguration,
+) error {
+	var (
+		numOverLimit int
+		limit        = cfg.MaxSamplesPerSeries
+	)
+	for i := range req.Timeseries {
+		s := &req.Timeseries[i]
+		over := len(s.Samples) - limit
+		if over <= 0 {
+			continue
+		}
+		numOverLimit += over
+		if cfg.Mode != config.SeriesSampleLimitTruncate {
+			h.metrics.seriesSamplesOverLimit.Inc(int64(numOverLimit))
+			name, _ := metricNameValue(s.Labels, h.metricNameLabels)
+			return fmt.Errorf("series %d %s has %d samples, max samples per series: %d",
+				i, name, len(s.Samples), limit)
+		}
+
+		if !sort.SliceIsSorted(s.Samples, func(a, b int) bool {
+			return s.Samples[a].Timestamp < s.Samples[b].Timestamp
+		}) {
+			sort.SliceStable(s.Samples, func(a, b int) bool {
+				return s.Samples[a].Timestamp < s.Samples[b].Timestamp
+			})
+		}
+		s.Samples = s.Samples[over:]
+	}
+	h.metrics.seriesSamplesOverLimit.Inc(int64(numOverLimit))
+	return nil
+}
+
+// offsetTimestamps shifts the timestamps of all samples in the request by the
+// given offset, truncated to the precision of the timestamps.
+func offsetTimestamps(req *prompb.WriteRequest, offset time.Duration, unit xtime.Unit) {
+	d, err := unit.Value()
+	if err != nil {
+		d = time.Millisecond
+	}
+	normalizedOffset := xtime.ToNormalizedDuration(offset, d)
+	for i := range req.Timeseries {
+		samples := req.Timeseries[i].Samples
+		for j := range samples {
+			samples[j].Timestamp += normalizedOffset
+		}
+	}
+}
+
 func (h *PromWriteHandler) write(
 	ctx context.Context,
 	r *prompb.WriteRequest,
 	opts ingest.WriteOptions,
+	unit xtime.Unit,
+	labelsSorted bool,
+	tagOpts models.TagOptions,
 ) ingest.BatchError {
-	iter, err := newPromTSIter(r.Timeseries, h.tagOptions, h.storeMetricsType)
+	if !h.seriesMetricsTypeLabels() && h.sampleAgeDeadlines == nil &&
+		(h.typeRouter == nil || !isDefaultWriteOptions(opts)) {
+		return h.writeBatch(ctx, r, opts, unit, labelsSorted, tagOpts)
+	}
+
+	routes, errs := h.routeSeries(r.Timeseries, opts, unit)
+	if errs.Empty() && len(routes) == 1 && routes[0].key == (writeRouteKey{}) &&
+		routes[0].timeout == 0 {
+		return h.writeBatch(ctx, r, opts, unit, labelsSorted, tagOpts)
+	}
+
+	// Write the series of each route as a separate batch, the indexes of
+	// series errors are mapped back to the indexes within the request so
+	// that partial success responses report the correct series.
+	for _, route := range routes {
+		routeReq := r
+		if len(route.indexes) != len(r.Timeseries) {
+			series := make([]prompb.TimeSeries, 0, len(route.indexes))
+			for _, idx := range route.indexes {
+				series = append(series, r.Timeseries[idx])
+			}
+			routeReq = &prompb.WriteRequest{Timeseries: series}
+		}
+
+		routeCtx, cancel := ctx, func() {}
+		if route.timeout > 0 {
+			routeCtx, cancel = context.WithTimeout(ctx, route.timeout)
+		}
+		batchErr := h.writeBatch(routeCtx, routeReq, route.opts, unit, labelsSorted, tagOpts)
+		cancel()
+		if batchErr == nil {
+			continue
+		}
+		for _, err := range batchErr.Errors() {
+			if idx, ok := ingest.SeriesErrorIndex(err); ok {
+				err = ingest.NewSeriesError(err, route.indexes[idx])
+			}
+			errs = errs.Add(err)
+		}
+		if opts.FailFast {
+			break
+		}
+	}
+	if errs.Empty() {
+		return nil
+	}
+	return errs
+}
+
+// writeRouteKey identifies the write options that a route writes with, the
+// zero value is the route of series written with the request options.
+type writeRouteKey struct {
+	labelled    bool
+	metricsType storagemetadata.MetricsType
+	policy      policy.StoragePolicy
+	class       metricTypeClass
+	stale       bool
+}
+
+// writeRoute is a set of series within a batch that are written with the
+// same write options and deadline, if the timeout is zero then the series
+// are written with the deadline of the request.
+type writeRoute struct {
+	key     writeRouteKey
+	opts    ingest.WriteOptions
+	timeout time.Duration
+	indexes []int
+}
+
+// routeSeries groups the indexes of the series by the write options they
+// are written with, in the order that each route is first seen. Series with
+// invalid metrics type labels are not routed and returned as series errors.
+func (h *PromWriteHandler) routeSeries(
+	series []prompb.TimeSeries,
+	opts ingest.WriteOptions,
+	unit xtime.Unit,
+) ([]writeRoute, xerrors.MultiError) {
+	var (
+		routes     []writeRoute
+		routeIndex = make(map[writeRouteKey]int)
+		errs       xerrors.MultiError
+		typeRouter = h.typeRouter
+		deadlines  = h.sampleAgeDeadlines
+		now        time.Time
+	)
+	if !isDefaultWriteOptions(opts) {
+		typeRouter = nil
+	}
+	if deadlines != nil {
+		now = deadlines.nowFn()
+	}
+	for i := range series {
+		var (
+			key       writeRouteKey
+			routeOpts = opts
+		)
+		if h.seriesMetricsTypeLabels() {
+			var err error
+			key, routeOpts, err = routeSeriesMetricsType(&series[i], opts)
+			if err != nil {
+				err = xerrors.NewInvalidParamsError(err)
+				errs = errs.Add(ingest.NewSeriesError(err, i))
+				continue
+			}
+		}
+		if !key.labelled && typeRouter != nil {
+			class, policies := typeRouter.Policies(series[i])
+			if len(policies) > 0 {
+				key.class = class
+				routeOpts.DownsampleOverride = true
+				routeOpts.WriteOverride = true
+				routeOpts.WriteStoragePolicies = policies
+			}
+		}
+
+		var timeout time.Duration
+		if deadlines != nil {
+			key.stale = deadlines.Stale(series[i], now, unit)
+			timeout = deadlines.Timeout(key.stale)
+		}
+
+		idx, ok := routeIndex[key]
+		if !ok {
+			idx = len(routes)
+			routeIndex[key] = idx
+			routes = append(routes, writeRoute{key: key, opts: routeOpts, timeout: timeout})
+		}
+		routes[idx].indexes = append(routes[idx].indexes, i)
+	}
+	return routes, errs
+}
+
+func (h *PromWriteHandler) writeBatch(
+	ctx context.Context,
+	r *prompb.WriteRequest,
+	opts ingest.WriteOptions,
+	unit xtime.Unit,
+	labelsSorted bool,
+	tagOpts models.TagOptions,
+) ingest.BatchError {
+	stopwatch := h.metrics.writeDuration.Start()
+	defer stopwatch.Stop()
+
+	if tagOpts == nil {
+		tagOpts = h.tagOptions
+	}
+	prepared, err := prepareWriteRequest(r.Timeseries, prepareWriteRequestOptions{
+		tagOpts:          tagOpts,
+		storeMetricsType: h.storeMetricsType,
+		observer:         h.seriesObserver,
+		idOverrideLabel:  h.idOverrideLabel,
+		deterministicIDs: h.writeConfig.DeterministicSeriesIDs,
+		unit:             unit,
+		labelsSorted:     labelsSorted,
+	})
 	if err != nil {
 		var errs xerrors.MultiError
 		return errs.Add(err)
 	}
-	return h.downsamplerAndWriter.WriteBatch(ctx, iter, opts)
+
+	if h.tee.Writer != nil {
+		switch h.tee.Mode {
+		case options.PromWriteTeeModeShadow:
+			// Detach from the request context so that the shadow write is
+			// not cancelled once the response has been written.
+			go h.writeTee(context.Background(), prepared, opts)
+		default:
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				h.writeTee(ctx, prepared, opts)
+				wg.Done()
+			}()
+			defer wg.Wait()
+		}
+	}
+
+	if shards := h.writeShards(prepared.Len()); shards > 1 {
+		return h.writeSharded(ctx, prepared, opts, shards)
+	}
+	return h.downsamplerAndWriter.WriteBatch(ctx, prepared.Iter(), opts)
+}
+
+// writeShards returns the number of shards to split a batch of the given
+// number of series into.
+func (h *PromWriteHandler) writeShards(numSeries int) int {
+	cfg := h.writeConfig.WriteConcurrency
+	if cfg.Shards <= 1 {
+		return 1
+	}
+	minSeries := defaultWriteConcurrencyMinSeries
+	if cfg.MinSeries > 0 {
+		minSeries = cfg.MinSeries
+	}
+	if numSeries < minSeries {
+		return 1
+	}
+	return cfg.Shards
+}
+
+// writeSharded writes disjoint ranges of the prepared series concurrently,
+// the indexes of series errors are mapped back to the indexes within the
+// whole batch.
+func (h *PromWriteHandler) writeSharded(
+	ctx context.Context,
+	prepared *PreparedWriteRequest,
+	opts ingest.WriteOptions,
+	shards int,
+) ingest.BatchError {
+	var (
+		wg        sync.WaitGroup
+		errsLock  sync.Mutex
+		errs      xerrors.MultiError
+		numSeries = prepared.Len()
+		shardSize = (numSeries + shards - 1) / shards
+		cancel    = func() {}
+	)
+	if opts.FailFast {
+		// Cancel the writes of the other shards once one has failed.
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+	}
+	for start := 0; start < numSeries; start += shardSize {
+		end := start + shardSize
+		if end > numSeries {
+			end = numSeries
+		}
+		shard := prepared.slice(start, end)
+
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			batchErr := h.downsamplerAndWriter.WriteBatch(ctx, shard.Iter(), opts)
+			if batchErr == nil {
+				return
+			}
+			errsLock.Lock()
+			for _, err := range batchErr.Errors() {
+				if opts.FailFast && !errs.Empty() {
+					break
+				}
+				if idx, ok := ingest.SeriesErrorIndex(err); ok {
+					err = ingest.NewSeriesError(err, start+idx)
+				}
+				errs = errs.Add(err)
+			}
+			errsLock.Unlock()
+			if opts.FailFast {
+				cancel()
+			}
+		}(start)
+	}
+	wg.Wait()
+
+	if errs.Empty() {
+		return nil
+	}
+	return errs
+}
+
+// writeTee writes the request to the secondary writer, errors are only
+// counted and logged since the result of the primary write is authoritative.
+func (h *PromWriteHandler) writeTee(
+	ctx context.Context,
+	prepared *PreparedWriteRequest,
+	opts ingest.WriteOptions,
+) {
+	batchErr := h.tee.Writer.WriteBatch(ctx, prepared.Iter(), opts)
+	if batchErr == nil {
+		h.metrics.teeSuccess.Inc(1)
+		return
+	}
+
+	h.metrics.teeErrors.Inc(1)
+	logger := logging.WithContext(ctx, h.instrumentOpts)
+	logger.Error("tee write error",
+		zap.Int("numErrors", len(batchErr.Errors())),
+		zap.Error(batchErr.LastError()))
 }
 
 func (h *PromWriteHandler) forward(
@@ -507,6 +2276,12 @@ func (h *PromWriteHandler) forward(
 				req.Header.Add(h, header.Get(h))
 			}
 		}
+
+		// The body is forwarded as is so the target must decode it with
+		// the same content encoding as the original request.
+		if v := header.Get(xhttp.HeaderContentEncoding); v != "" {
+			req.Header.Set(xhttp.HeaderContentEncoding, v)
+		}
 	}
 
 	if targetHeaders := target.Headers; targetHeaders != nil {
@@ -535,21 +2310,86 @@ func (h *PromWriteHandler) forward(
 	return nil
 }
 
-func newPromTSIter(
+// PreparedWriteRequest holds the tags, datapoints and series attributes
+// constructed from a set of Prometheus time series. Preparing a request
+// once allows multiple iterators to be created from it cheaply, so that
+// writing to multiple sinks or retrying a write does not redo the per
+// series conversion.
+type PreparedWriteRequest struct {
+	attributes       []ts.SeriesAttributes
+	tags             []models.Tags
+	datapoints       []ts.Datapoints
+	ids              [][]byte
+	unit             xtime.Unit
+	storeMetricsType bool
+}
+
+// NewPreparedWriteRequest converts the given time series into a prepared
+// write request.
+func NewPreparedWriteRequest(
 	timeseries []prompb.TimeSeries,
 	tagOpts models.TagOptions,
 	storeMetricsType bool,
-) (*promTSIter, error) {
-	// Construct the tags and datapoints upfront so that if the iterator
-	// is reset, we don't have to generate them twice.
+) (*PreparedWriteRequest, error) {
+	return prepareWriteRequest(timeseries, prepareWriteRequestOptions{
+		tagOpts:          tagOpts,
+		storeMetricsType: storeMetricsType,
+	})
+}
+
+type prepareWriteRequestOptions struct {
+	tagOpts          models.TagOptions
+	storeMetricsType bool
+	observer         options.PromWriteSeriesObserver
+	// idOverrideLabel if set is the name of the label that supplies the
+	// series ID when present, the label is not stored as a tag.
+	idOverrideLabel []byte
+	// deterministicIDs forces series IDs that are not overridden to be
+	// generated with DeterministicSeriesID.
+	deterministicIDs bool
+	// unit is the precision of the sample timestamps, milliseconds if unset.
+	unit xtime.Unit
+	// labelsSorted is true if the labels of the series are known to be sorted
+	// by name, in which case the tags are not sorted again unless required.
+	labelsSorted bool
+}
+
+func prepareWriteRequest(
+	timeseries []prompb.TimeSeries,
+	prepareOpts prepareWriteRequestOptions,
+) (*PreparedWriteRequest, error) {
 	var (
 		tags             = make([]models.Tags, 0, len(timeseries))
 		datapoints       = make([]ts.Datapoints, 0, len(timeseries))
 		seriesAttributes = make([]ts.SeriesAttributes, 0, len(timeseries))
+		tagOpts          = prepareOpts.tagOpts
+		ids              [][]byte
+		unit             = prepareOpts.unit
 	)
+	if unit == xtime.None {
+		unit = xtime.Millisecond
+	}
+	if len(prepareOpts.idOverrideLabel) > 0 || prepareOpts.deterministicIDs {
+		ids = make([][]byte, 0, len(timeseries))
+	}
+
+	// Most series carry a single sample, so the datapoints of all single
+	// sample series are sliced from one shared backing array rather than
+	// allocating a slice for each series.
+	var numSingleSample int
+	for _, promTS := range timeseries {
+		if len(promTS.Samples) == 1 {
+			numSingleSample++
+		}
+	}
+	singleSampleDatapoints := make([]ts.Datapoint, numSingleSample)
 
 	graphiteTagOpts := tagOpts.SetIDSchemeType(models.TypeGraphite)
 	for _, promTS := range timeseries {
+		if prepareOpts.observer != nil {
+			prepareOpts.observer(promTS.Labels)
+		}
+
 		attributes, err := storage.PromTimeSeriesToSeriesAttributes(promTS)
 		if err != nil {
 			return nil, err
@@ -561,26 +2401,143 @@ func newPromTSIter(
 			opts = graphiteTagOpts
 		}
 
+		labels := promTS.Labels
+		if ids != nil {
+			var id []byte
+			if len(prepareOpts.idOverrideLabel) > 0 {
+				id, labels = extractIDOverride(labels, prepareOpts.idOverrideLabel)
+			}
+			if id == nil && prepareOpts.deterministicIDs {
+				id = DeterministicSeriesID(labels)
+			}
+			ids = append(ids, id)
+		}
+
 		seriesAttributes = append(seriesAttributes, attributes)
-		tags = append(tags, storage.PromLabelsToM3Tags(promTS.Labels, opts))
-		datapoints = append(datapoints, storage.PromSamplesToM3Datapoints(promTS.Samples))
+		if prepareOpts.labelsSorted {
+			tags = append(tags, storage.PromSortedLabelsToM3Tags(labels, opts))
+		} else {
+			tags = append(tags, storage.PromLabelsToM3Tags(labels, opts))
+		}
+		if len(promTS.Samples) != 1 {
+			datapoints = append(datapoints, samplesToDatapoints(promTS.Samples, unit))
+			continue
+		}
+
+		sample := promTS.Samples[0]
+		singleSampleDatapoints[0] = ts.Datapoint{
+			Timestamp: sampleTime(sample.Timestamp, unit),
+			Value:     sample.Value,
+		}
+		// Limit the capacity so that appending to the datapoints of one
+		// series can never overwrite those of the next.
+		datapoints = append(datapoints, singleSampleDatapoints[:1:1])
+		singleSampleDatapoints = singleSampleDatapoints[1:]
 	}
 
-	return &promTSIter{
+	return &PreparedWriteRequest{
 		attributes:       seriesAttributes,
-		idx:              -1,
 		tags:             tags,
 		datapoints:       datapoints,
-		storeMetricsType: storeMetricsType,
+		ids:              ids,
+		unit:             unit,
+		storeMetricsType: prepareOpts.storeMetricsType,
 	}, nil
 }
 
+// samplesToDatapoints converts samples with timestamps of the given
+// precision to datapoints.
+func samplesToDatapoints(samples []prompb.Sample, unit xtime.Unit) ts.Datapoints {
+	if unit == xtime.Millisecond {
+		return storage.PromSamplesToM3Datapoints(samples)
+	}
+	datapoints := make(ts.Datapoints, 0, len(samples))
+	for _, sample := range samples {
+		datapoints = append(datapoints, ts.Datapoint{
+			Timestamp: sampleTime(sample.Timestamp, unit),
+			Value:     sample.Value,
+		})
+	}
+	return datapoints
+}
+
+// DeterministicSeriesID returns a series ID generated from the labels that
+// depends only on the label names and values, not on their order or on any
+// configured tag options. The labels are sorted by name and the ID is
+// generated using the quoted ID scheme, e.g. the labels job="a" and
+// __name__="up" produce the ID {__name__="up",job="a"}. The given labels
+// are not modified.
+func DeterministicSeriesID(labels []prompb.Label) []byte {
+	return storage.PromLabelsToM3Tags(labels, deterministicIDTagOptions).ID()
+}
+
+// extractIDOverride returns the value of the ID override label and the
+// labels without it, the given labels are not modified.
+func extractIDOverride(labels []prompb.Label, name []byte) ([]byte, []prompb.Label) {
+	for i, l := range labels {
+		if !bytes.Equal(l.Name, name) {
+			continue
+		}
+		// Limit the capacity so that the labels are copied rather than
+		// the labels after the override label being shifted in place.
+		rest := append(labels[:i:i], labels[i+1:]...)
+		if len(l.Value) == 0 {
+			return nil, rest
+		}
+		return l.Value, rest
+	}
+	return nil, labels
+}
+
+// slice returns the series in the range [start, end) of the prepared request.
+// The capacity of each slice is limited to the range so that a write of one
+// range can never modify the series of another.
+func (p *PreparedWriteRequest) slice(start, end int) *PreparedWriteRequest {
+	result := &PreparedWriteRequest{
+		attributes:       p.attributes[start:end:end],
+		tags:             p.tags[start:end:end],
+		datapoints:       p.datapoints[start:end:end],
+		unit:             p.unit,
+		storeMetricsType: p.storeMetricsType,
+	}
+	if p.ids != nil {
+		result.ids = p.ids[start:end:end]
+	}
+	return result
+}
+
+// Len returns the number of series in the prepared request.
+func (p *PreparedWriteRequest) Len() int {
+	return len(p.tags)
+}
+
+// Iter returns a new iterator over the prepared series. Iterators share
+// the prepared tags and datapoints but each has its own position and
+// metadata, so they may be consumed independently.
+func (p *PreparedWriteRequest) Iter() ingest.DownsampleAndWriteIter {
+	return p.newIter()
+}
+
+func (p *PreparedWriteRequest) newIter() *promTSIter {
+	return &promTSIter{
+		attributes:       p.attributes,
+		idx:              -1,
+		tags:             p.tags,
+		datapoints:       p.datapoints,
+		ids:              p.ids,
+		unit:             p.unit,
+		storeMetricsType: p.storeMetricsType,
+	}
+}
+
 type promTSIter struct {
 	idx        int
 	err        error
 	attributes []ts.SeriesAttributes
 	tags       []models.Tags
 	datapoints []ts.Datapoints
+	ids        [][]byte
+	unit       xtime.Unit
 	metadatas  []ts.Metadata
 	annotation []byte
 
@@ -629,12 +2586,15 @@ func (i *promTSIter) Current() ingest.IterValue {
 		Tags:       i.tags[i.idx],
 		Datapoints: i.datapoints[i.idx],
 		Attributes: i.attributes[i.idx],
-		Unit:       xtime.Millisecond,
+		Unit:       i.unit,
 		Annotation: i.annotation,
 	}
 	if i.idx < len(i.metadatas) {
 		value.Metadata = i.metadatas[i.idx]
 	}
+	if i.idx < len(i.ids) {
+		value.ID = i.ids[i.idx]
+	}
 	return value
 }
 
@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultAdmissionWebhookTimeout = time.Second
+
+	// maxAdmissionResponseSize bounds how much of a webhook response is read.
+	maxAdmissionResponseSize = 1 << 20
+)
+
+var errAdmissionWebhookUnavailable = errors.New("admission webhook unavailable")
+
+// admissionRequest is the summary of a write request posted to the
+// admission webhook.
+type admissionRequest struct {
+	Client     string   `json:"client"`
+	NumSeries  int      `json:"numSeries"`
+	NumSamples int      `json:"numSamples"`
+	LabelNames []string `json:"labelNames"`
+	Bytes      int      `json:"bytes"`
+}
+
+// admissionResponse is the decision of the admission webhook.
+type admissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	// MapTags if set mutates the tags of the series before they are
+	// written, exactly as the map tags header does.
+	MapTags *handleroptions.MapTagsOptions `json:"mapTags,omitempty"`
+}
+
+// admissionWebhook posts a summary of each write request to an external
+// service that decides whether the request is written.
+type admissionWebhook struct {
+	url          string
+	timeout      time.Duration
+	failOpen     bool
+	clientHeader string
+	client       *http.Client
+	allowed      tally.Counter
+	denied       tally.Counter
+	errors       tally.Counter
+	invalid      tally.Counter
+}
+
+func newAdmissionWebhook(
+	cfg config.PromRemoteWriteAdmissionWebhookConfiguration,
+	scope tally.Scope,
+) *admissionWebhook {
+	timeout := defaultAdmissionWebhookTimeout
+	if v := cfg.Timeout; v > 0 {
+		timeout = v
+	}
+	httpOpts := xhttp.DefaultHTTPClientOptions()
+	httpOpts.RequestTimeout = timeout
+	return &admissionWebhook{
+		url:          cfg.URL,
+		timeout:      timeout,
+		failOpen:     cfg.FailOpen,
+		clientHeader: cfg.ClientHeader,
+		client:       xhttp.NewHTTPClient(httpOpts),
+		allowed:      scope.SubScope("admission").Counter("allowed"),
+		denied:       scope.SubScope("admission").Counter("denied"),
+		errors:       scope.SubScope("admission").Counter("errors"),
+		invalid:      scope.SubScope("admission").Counter("invalid-mappings"),
+	}
+}
+
+// Admit returns a 403 error if the webhook denies the write request and
+// otherwise applies any tag mapping returned by the webhook to the request,
+// returning true if the tags of the request were mapped. A 400 error is
+// returned without mapping any tags if the mapping is invalid. If the webhook
+// cannot be reached or returns an invalid response then the request is
+// admitted if failing open, or else a 503 error is returned.
+func (a *admissionWebhook) Admit(
+	ctx context.Context,
+	r *http.Request,
+	req *prompb.WriteRequest,
+	bodySize int,
+) (bool, error) {
+	resp, err := a.decide(ctx, admissionSummary(requestClient(r, a.clientHeader), req, bodySize))
+	if err != nil {
+		a.errors.Inc(1)
+		if a.failOpen {
+			return false, nil
+		}
+		return false, xhttp.NewError(fmt.Errorf("%v: %v", errAdmissionWebhookUnavailable, err),
+			http.StatusServiceUnavailable)
+	}
+
+	if !resp.Allowed {
+		a.denied.Inc(1)
+		return false, xhttp.NewError(fmt.Errorf("write denied by admission webhook: %s", resp.Reason),
+			http.StatusForbidden)
+	}
+
+	if resp.MapTags == nil {
+		a.allowed.Inc(1)
+		return false, nil
+	}
+	if err := mapTags(req, *resp.MapTags); err != nil {
+		a.invalid.Inc(1)
+		return false, xhttp.NewError(fmt.Errorf("invalid admission webhook tag mapping: %v", err),
+			http.StatusBadRequest)
+	}
+	a.allowed.Inc(1)
+	return true, nil
+}
+
+func (a *admissionWebhook) decide(
+	ctx context.Context,
+	summary admissionRequest,
+) (admissionResponse, error) {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return admissionResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return admissionResponse{}, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set(xhttp.HeaderContentType, xhttp.ContentTypeJSON)
+
+	httpResp, err := a.client.Do(httpReq)
+	if err != nil {
+		return admissionResponse{}, err
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, httpResp.Body)
+		httpResp.Body.Close()
+	}()
+
+	if httpResp.StatusCode/100 != 2 {
+		return admissionResponse{}, fmt.Errorf("unexpected status: %d", httpResp.StatusCode)
+	}
+
+	var resp admissionResponse
+	dec := json.NewDecoder(io.LimitReader(httpResp.Body, maxAdmissionResponseSize))
+	if err := dec.Decode(&resp); err != nil {
+		return admissionResponse{}, fmt.Errorf("invalid response: %v", err)
+	}
+	return resp, nil
+}
+
+// admissionSummary returns the summary of the write request posted to the
+// webhook, label names are deduplicated and sorted.
+func admissionSummary(client string, req *prompb.WriteRequest, bodySize int) admissionRequest {
+	var (
+		numSamples int
+		names      = make(map[string]struct{})
+	)
+	for _, series := range req.Timeseries {
+		numSamples += len(series.Samples)
+		for _, label := range series.Labels {
+			// The string conversion does not allocate for the map lookup.
+			if _, ok := names[string(label.Name)]; !ok {
+				names[string(label.Name)] = struct{}{}
+			}
+		}
+	}
+
+	labelNames := make([]string, 0, len(names))
+	for name := range names {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+
+	return admissionRequest{
+		Client:     client,
+		NumSeries:  len(req.Timeseries),
+		NumSamples: numSamples,
+		LabelNames: labelNames,
+		Bytes:      bodySize,
+	}
+}
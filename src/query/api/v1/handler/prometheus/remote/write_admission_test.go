@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionSummary(t *testing.T) {
+	summary := admissionSummary("client-a", test.GeneratePromWriteRequest(), 100)
+	require.Equal(t, admissionRequest{
+		Client:     "client-a",
+		NumSeries:  2,
+		NumSamples: 4,
+		LabelNames: []string{"__name__", "bar", "biz", "foo"},
+		Bytes:      100,
+	}, summary)
+}
+
+func TestPromWriteAdmissionWebhook(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		response       admissionResponse
+		failOpen       bool
+		nameValidation config.NameValidationMode
+		expected       int
+		// tag is the tag expected to be added to written series.
+		tag string
+	}{
+		{
+			name:     "allowed",
+			status:   http.StatusOK,
+			response: admissionResponse{Allowed: true},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "denied",
+			status:   http.StatusOK,
+			response: admissionResponse{Reason: "over quota"},
+			expected: http.StatusForbidden,
+		},
+		{
+			name:   "map tags",
+			status: http.StatusOK,
+			response: admissionResponse{
+				Allowed: true,
+				MapTags: &handleroptions.MapTagsOptions{
+					TagMappers: []handleroptions.TagMapper{
+						{Write: handleroptions.WriteOp{Tag: "tier", Value: "gold"}},
+					},
+				},
+			},
+			expected: http.StatusOK,
+			tag:      "tier",
+		},
+		{
+			name:   "invalid map tags",
+			status: http.StatusOK,
+			response: admissionResponse{
+				Allowed: true,
+				MapTags: &handleroptions.MapTagsOptions{
+					TagMappers: []handleroptions.TagMapper{
+						{Write: handleroptions.WriteOp{Tag: "tier", Value: "gold"}},
+						{Drop: handleroptions.DropOp{Tag: "env"}},
+					},
+				},
+			},
+			failOpen: true,
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:   "map tags with invalid name",
+			status: http.StatusOK,
+			response: admissionResponse{
+				Allowed: true,
+				MapTags: &handleroptions.MapTagsOptions{
+					TagMappers: []handleroptions.TagMapper{
+						{Write: handleroptions.WriteOp{Tag: "bad-tier", Value: "gold"}},
+					},
+				},
+			},
+			nameValidation: config.NameValidationLegacy,
+			expected:       http.StatusBadRequest,
+		},
+		{
+			name:     "fail closed",
+			status:   http.StatusInternalServerError,
+			expected: http.StatusServiceUnavailable,
+		},
+		{
+			name:     "fail open",
+			status:   http.StatusInternalServerError,
+			failOpen: true,
+			expected: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := xtest.NewController(t)
+			defer ctrl.Finish()
+
+			var posted admissionRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+				w.WriteHeader(tt.status)
+				require.NoError(t, json.NewEncoder(w).Encode(tt.response))
+			}))
+			defer server.Close()
+
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+			if tt.expected == http.StatusOK {
+				mockDownsamplerAndWriter.
+					EXPECT().
+					WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+						for iter.Next() {
+							_, ok := iter.Current().Tags.Get([]byte("tier"))
+							require.Equal(t, tt.tag != "", ok)
+						}
+						return nil
+					})
+			}
+
+			opts := makeOptions(mockDownsamplerAndWriter).
+				SetConfig(config.Configuration{
+					PromRemoteWrite: config.PromRemoteWriteConfiguration{
+						AdmissionWebhook: config.PromRemoteWriteAdmissionWebhookConfiguration{
+							URL:          server.URL,
+							FailOpen:     tt.failOpen,
+							ClientHeader: "X-Client",
+						},
+						NameValidation: tt.nameValidation,
+					},
+				})
+			handler, err := NewPromWriteHandler(opts)
+			require.NoError(t, err)
+
+			promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+			req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+			req.Header.Set("X-Client", "client-a")
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			require.Equal(t, tt.expected, writer.Result().StatusCode)
+			require.Equal(t, "client-a", posted.Client)
+			require.Equal(t, 2, posted.NumSeries)
+		})
+	}
+}
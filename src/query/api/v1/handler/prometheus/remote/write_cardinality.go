@@ -0,0 +1,262 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/m3db/bloom/v4"
+)
+
+const (
+	defaultCardinalityLimitWindow            = time.Minute
+	defaultCardinalityLimitExpectedSeries    = 1 << 20
+	defaultCardinalityLimitFalsePositiveRate = 0.01
+)
+
+var errCardinalityLimitExceeded = xhttp.NewError(
+	errors.New("cardinality limit exceeded: too many new series"),
+	http.StatusTooManyRequests)
+
+// rollingSeriesFilter tracks the series seen within a rolling window. Seen
+// series are tracked in two bloom filters, one for the current window and
+// one for the previous window, a series is new only if it is in neither.
+// When a window elapses the previous filter is cleared and becomes the
+// current filter, so memory use stays fixed. It is not safe for concurrent
+// use.
+type rollingSeriesFilter struct {
+	window      time.Duration
+	nowFn       clock.NowFn
+	current     *bloom.BloomFilter
+	previous    *bloom.BloomFilter
+	windowStart time.Time
+}
+
+func newRollingSeriesFilter(
+	window time.Duration,
+	expectedSeries int,
+	falsePositiveRate float64,
+	nowFn clock.NowFn,
+) *rollingSeriesFilter {
+	if window <= 0 {
+		window = defaultCardinalityLimitWindow
+	}
+	if expectedSeries <= 0 {
+		expectedSeries = defaultCardinalityLimitExpectedSeries
+	}
+	if falsePositiveRate <= 0 {
+		falsePositiveRate = defaultCardinalityLimitFalsePositiveRate
+	}
+
+	m, k := bloom.EstimateFalsePositiveRate(uint(expectedSeries), falsePositiveRate)
+	return &rollingSeriesFilter{
+		window:      window,
+		nowFn:       nowFn,
+		current:     bloom.NewBloomFilter(m, k),
+		previous:    bloom.NewBloomFilter(m, k),
+		windowStart: nowFn(),
+	}
+}
+
+// Rotate starts a new window if the current window has elapsed and returns
+// whether it did.
+func (f *rollingSeriesFilter) Rotate() bool {
+	now := f.nowFn()
+	elapsed := now.Sub(f.windowStart)
+	if elapsed < f.window {
+		return false
+	}
+
+	f.previous, f.current = f.current, f.previous
+	f.current.BitSet().ClearAll()
+	if elapsed >= 2*f.window {
+		// No series were seen within the last full window.
+		f.previous.BitSet().ClearAll()
+	}
+	f.windowStart = now
+	return true
+}
+
+// Test returns whether the series was seen within the current window and
+// whether it was seen within either window.
+func (f *rollingSeriesFilter) Test(key [8]byte) (inCurrent bool, seen bool) {
+	if f.current.Test(key[:]) {
+		return true, true
+	}
+	return false, f.previous.Test(key[:])
+}
+
+// Add records the series as seen within the current window, series only
+// seen in the previous window should also be added so that they are
+// retained once it is rotated.
+func (f *rollingSeriesFilter) Add(key [8]byte) {
+	f.current.Add(key[:])
+}
+
+// cardinalityLimiter limits the number of new series admitted within a
+// rolling window.
+type cardinalityLimiter struct {
+	sync.Mutex
+
+	limit     int
+	filter    *rollingSeriesFilter
+	newSeries int
+	keys      [][8]byte
+	seen      []bool
+	// requestKeys are the keys of the series of the request being admitted,
+	// so that series repeated within a request are only counted once.
+	requestKeys map[[8]byte]struct{}
+}
+
+func newCardinalityLimiter(
+	cfg config.PromRemoteWriteCardinalityLimitConfiguration,
+	nowFn clock.NowFn,
+) *cardinalityLimiter {
+	return &cardinalityLimiter{
+		limit: cfg.NewSeriesLimit,
+		filter: newRollingSeriesFilter(cfg.Window, cfg.ExpectedSeries,
+			cfg.FalsePositiveRate, nowFn),
+		requestKeys: make(map[[8]byte]struct{}),
+	}
+}
+
+// Admit returns an error if writing the series would exceed the new series
+// limit for the current window, in which case none of the series are
+// recorded as seen. Otherwise all of the series are recorded as seen.
+func (l *cardinalityLimiter) Admit(timeseries []prompb.TimeSeries) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.filter.Rotate() {
+		l.newSeries = 0
+	}
+
+	var (
+		keys      = l.keys[:0]
+		seen      = l.seen[:0]
+		newSeries int
+	)
+	for key := range l.requestKeys {
+		delete(l.requestKeys, key)
+	}
+	for _, series := range timeseries {
+		key := seriesKey(series.Labels)
+		if _, ok := l.requestKeys[key]; ok {
+			continue
+		}
+		l.requestKeys[key] = struct{}{}
+		inCurrent, inEither := l.filter.Test(key)
+		if !inEither {
+			newSeries++
+		}
+		keys = append(keys, key)
+		seen = append(seen, inCurrent)
+	}
+	// Retain the slices between calls to avoid allocating for each request.
+	l.keys, l.seen = keys, seen
+
+	if l.newSeries+newSeries > l.limit {
+		return errCardinalityLimitExceeded
+	}
+
+	l.newSeries += newSeries
+	for i := range keys {
+		if !seen[i] {
+			l.filter.Add(keys[i])
+		}
+	}
+	return nil
+}
+
+// seriesKey returns a hash of the series labels that does not depend on the
+// order of the labels, so that the labels do not need to be sorted. The hash
+// sums the hashes of the labels so is only suitable for estimates such as of
+// cardinality, sortedSeriesKey must be used to key the state of a series.
+func seriesKey(labels []prompb.Label) [8]byte {
+	var (
+		sum uint64
+		d   = xxhash.New()
+	)
+	for _, label := range labels {
+		d.Reset()
+		_, _ = d.Write(label.Name)
+		// Separate the name and value so that they cannot be confused.
+		_, _ = d.Write([]byte{0xff})
+		_, _ = d.Write(label.Value)
+		sum += d.Sum64()
+	}
+
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], sum)
+	return key
+}
+
+// sortedSeriesKey returns a hash of the series labels sorted by name and
+// value, each name and value is length prefixed and hashed in sequence so
+// that series with different labels do not collide other than by chance.
+func sortedSeriesKey(labels []prompb.Label) [8]byte {
+	less := func(a, b prompb.Label) bool {
+		if c := bytes.Compare(a.Name, b.Name); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.Value, b.Value) < 0
+	}
+	if !sort.SliceIsSorted(labels, func(i, j int) bool {
+		return less(labels[i], labels[j])
+	}) {
+		// Sort a copy since the labels of the series must not be reordered.
+		sorted := make([]prompb.Label, len(labels))
+		copy(sorted, labels)
+		sort.Slice(sorted, func(i, j int) bool {
+			return less(sorted[i], sorted[j])
+		})
+		labels = sorted
+	}
+
+	var (
+		d      = xxhash.New()
+		length [4]byte
+	)
+	for _, label := range labels {
+		binary.LittleEndian.PutUint32(length[:], uint32(len(label.Name)))
+		_, _ = d.Write(length[:])
+		_, _ = d.Write(label.Name)
+		binary.LittleEndian.PutUint32(length[:], uint32(len(label.Value)))
+		_, _ = d.Write(length[:])
+		_, _ = d.Write(label.Value)
+	}
+
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], d.Sum64())
+	return key
+}
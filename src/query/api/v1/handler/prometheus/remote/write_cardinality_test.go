@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCardinalityLimiterAdmit(t *testing.T) {
+	now := time.Now()
+	nowFn := func() time.Time { return now }
+	limiter := newCardinalityLimiter(config.PromRemoteWriteCardinalityLimitConfiguration{
+		NewSeriesLimit: 3,
+		Window:         time.Minute,
+		ExpectedSeries: 100,
+	}, nowFn)
+
+	require.NoError(t, limiter.Admit(test.NamedSeries("a", "b")))
+
+	// Existing series do not count towards the limit.
+	require.NoError(t, limiter.Admit(test.NamedSeries("a", "b")))
+
+	// A request that would exceed the limit is rejected entirely.
+	err := limiter.Admit(test.NamedSeries("c", "d"))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, err.(xhttp.Error).Code())
+	require.NoError(t, limiter.Admit(test.NamedSeries("c")))
+	require.Error(t, limiter.Admit(test.NamedSeries("d")))
+
+	// The budget is reset once the window elapses, series seen in the
+	// previous window are still known.
+	now = now.Add(time.Minute)
+	require.NoError(t, limiter.Admit(test.NamedSeries("a", "b", "c", "d", "e", "f")))
+	require.Error(t, limiter.Admit(test.NamedSeries("g")))
+
+	// Series are forgotten once a full window elapses without them.
+	now = now.Add(2 * time.Minute)
+	require.Error(t, limiter.Admit(test.NamedSeries("a", "b", "c", "d")))
+
+	// Series repeated within a request are only counted once.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, limiter.Admit(test.NamedSeries("h", "h", "h", "h")))
+	require.NoError(t, limiter.Admit(test.NamedSeries("i", "j")))
+	require.Error(t, limiter.Admit(test.NamedSeries("k")))
+}
+
+func TestSeriesKeyIndependentOfLabelOrder(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: []byte("a"), Value: []byte("b")},
+		{Name: []byte("c"), Value: []byte("d")},
+	}
+	reversed := []prompb.Label{labels[1], labels[0]}
+	assert.Equal(t, seriesKey(labels), seriesKey(reversed))
+
+	swapped := []prompb.Label{
+		{Name: []byte("b"), Value: []byte("a")},
+		{Name: []byte("c"), Value: []byte("d")},
+	}
+	assert.NotEqual(t, seriesKey(labels), seriesKey(swapped))
+}
+
+func TestPromWriteCardinalityLimit(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				CardinalityLimit: config.PromRemoteWriteCardinalityLimitConfiguration{
+					NewSeriesLimit: 2,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		promReq := test.NewWriteRequest(
+			test.NamedSeries(fmt.Sprintf("x%d", i), fmt.Sprintf("y%d", i))...)
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		require.Equal(t, expected, writer.Result().StatusCode)
+	}
+}
+
+func TestSortedSeriesKey(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: []byte("a"), Value: []byte("b")},
+		{Name: []byte("c"), Value: []byte("d")},
+	}
+	reversed := []prompb.Label{labels[1], labels[0]}
+	assert.Equal(t, sortedSeriesKey(labels), sortedSeriesKey(reversed))
+	// The labels are not reordered.
+	assert.Equal(t, "c", string(reversed[0].Name))
+
+	// Names and values cannot be confused even if they contain the byte that
+	// separates them in the unsorted key.
+	separated := []prompb.Label{{Name: []byte("a\xff"), Value: []byte("b")}}
+	shifted := []prompb.Label{{Name: []byte("a"), Value: []byte("\xffb")}}
+	assert.Equal(t, seriesKey(separated), seriesKey(shifted))
+	assert.NotEqual(t, sortedSeriesKey(separated), sortedSeriesKey(shifted))
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+)
+
+const (
+	defaultCoalesceMaxDelay  = 50 * time.Millisecond
+	defaultCoalesceMaxSeries = 1000
+)
+
+// coalesceFlushFn writes a coalesced batch and returns true if the batch
+// was written successfully.
+type coalesceFlushFn func(series []prompb.TimeSeries) bool
+
+// writeCoalescer buffers the series of many write requests and flushes them
+// together as a single batch once either the max delay has elapsed since the
+// first series was buffered or the max number of series has been buffered.
+type writeCoalescer struct {
+	sync.Mutex
+
+	maxDelay  time.Duration
+	maxSeries int
+	flushFn   coalesceFlushFn
+	series    []prompb.TimeSeries
+	written   []func()
+	timer     *time.Timer
+	// flushing tracks pending timer flushes and in progress flushes so
+	// that Close can wait for them to complete.
+	flushing sync.WaitGroup
+}
+
+func newWriteCoalescer(
+	cfg config.PromRemoteWriteCoalesceConfiguration,
+	flushFn coalesceFlushFn,
+) *writeCoalescer {
+	maxDelay := defaultCoalesceMaxDelay
+	if v := cfg.MaxDelay; v > 0 {
+		maxDelay = v
+	}
+	maxSeries := defaultCoalesceMaxSeries
+	if v := cfg.MaxSeries; v > 0 {
+		maxSeries = v
+	}
+	return &writeCoalescer{
+		maxDelay:  maxDelay,
+		maxSeries: maxSeries,
+		flushFn:   flushFn,
+	}
+}
+
+// Add buffers the series to be flushed with the current batch, the series
+// must not be mutated by the caller after being added. If not nil, written
+// is called once the batch containing the series is written successfully.
+func (c *writeCoalescer) Add(series []prompb.TimeSeries, written func()) {
+	c.Lock()
+	if len(c.series) == 0 {
+		c.flushing.Add(1)
+		c.timer = time.AfterFunc(c.maxDelay, c.flushBuffered)
+	}
+	c.series = append(c.series, series...)
+	if written != nil {
+		c.written = append(c.written, written)
+	}
+	if len(c.series) < c.maxSeries {
+		c.Unlock()
+		return
+	}
+	batch, batchWritten := c.takeWithLock()
+	c.flushing.Add(1)
+	c.Unlock()
+
+	// Flush asynchronously so that the request that filled the batch is not
+	// held up waiting for the whole batch to be written.
+	go func() {
+		c.flush(batch, batchWritten)
+		c.flushing.Done()
+	}()
+}
+
+// Close flushes any buffered series and waits for all flushes to complete,
+// no series may be added once closed.
+func (c *writeCoalescer) Close() {
+	c.Lock()
+	batch, written := c.takeWithLock()
+	c.Unlock()
+
+	c.flush(batch, written)
+	c.flushing.Wait()
+}
+
+func (c *writeCoalescer) flushBuffered() {
+	defer c.flushing.Done()
+
+	c.Lock()
+	batch, written := c.takeWithLock()
+	c.Unlock()
+
+	c.flush(batch, written)
+}
+
+func (c *writeCoalescer) flush(batch []prompb.TimeSeries, written []func()) {
+	if len(batch) == 0 || !c.flushFn(batch) {
+		return
+	}
+	for _, fn := range written {
+		fn()
+	}
+}
+
+func (c *writeCoalescer) takeWithLock() ([]prompb.TimeSeries, []func()) {
+	batch, written := c.series, c.written
+	c.series, c.written = nil, nil
+	if c.timer != nil {
+		if c.timer.Stop() {
+			// The timer will not fire so is no longer a pending flush.
+			c.flushing.Done()
+		}
+		c.timer = nil
+	}
+	return batch, written
+}
+
+// isDefaultWriteOptions returns true if the write options do not override
+// any of the default downsampling or storage policy behavior, only writes
+// with default options can be coalesced with the writes of other requests.
+// Annotations are not considered since they do not change how series are
+// written, callers that merge writes also require there to be none.
+func isDefaultWriteOptions(opts ingest.WriteOptions) bool {
+	return !opts.DownsampleOverride &&
+		!opts.WriteOverride &&
+		len(opts.DownsampleMappingRules) == 0 &&
+		len(opts.WriteStoragePolicies) == 0
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xclock "github.com/m3db/m3/src/x/clock"
+	"github.com/m3db/m3/src/x/headers"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+type capturedBatches struct {
+	sync.Mutex
+	batches [][]prompb.TimeSeries
+}
+
+func (c *capturedBatches) flush(series []prompb.TimeSeries) bool {
+	c.Lock()
+	c.batches = append(c.batches, series)
+	c.Unlock()
+	return true
+}
+
+func (c *capturedBatches) numBatches() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.batches)
+}
+
+func TestWriteCoalescerFlushOnMaxSeries(t *testing.T) {
+	var captured capturedBatches
+	c := newWriteCoalescer(config.PromRemoteWriteCoalesceConfiguration{
+		MaxDelay:  time.Hour,
+		MaxSeries: 3,
+	}, captured.flush)
+
+	c.Add(make([]prompb.TimeSeries, 2), nil)
+	require.Equal(t, 0, captured.numBatches())
+
+	c.Add(make([]prompb.TimeSeries, 2), nil)
+	require.True(t, xclock.WaitUntil(func() bool {
+		return captured.numBatches() == 1
+	}, 5*time.Second))
+	require.Equal(t, 4, len(captured.batches[0]))
+}
+
+func TestWriteCoalescerFlushOnMaxDelay(t *testing.T) {
+	var captured capturedBatches
+	c := newWriteCoalescer(config.PromRemoteWriteCoalesceConfiguration{
+		MaxDelay:  10 * time.Millisecond,
+		MaxSeries: 100,
+	}, captured.flush)
+
+	c.Add(make([]prompb.TimeSeries, 1), nil)
+	c.Add(make([]prompb.TimeSeries, 1), nil)
+	require.True(t, xclock.WaitUntil(func() bool {
+		return captured.numBatches() == 1
+	}, 5*time.Second))
+	require.Equal(t, 2, len(captured.batches[0]))
+}
+
+func TestWriteCoalescerClose(t *testing.T) {
+	var captured capturedBatches
+	c := newWriteCoalescer(config.PromRemoteWriteCoalesceConfiguration{
+		MaxDelay:  time.Hour,
+		MaxSeries: 2,
+	}, captured.flush)
+
+	c.Add(make([]prompb.TimeSeries, 2), nil)
+	c.Add(make([]prompb.TimeSeries, 1), nil)
+
+	// Close flushes the buffered series and waits for the async flush.
+	c.Close()
+	require.Equal(t, 2, captured.numBatches())
+}
+
+func TestWriteCoalescerWrittenCallbacks(t *testing.T) {
+	var (
+		success = true
+		written int
+	)
+	c := newWriteCoalescer(config.PromRemoteWriteCoalesceConfiguration{
+		MaxDelay:  time.Hour,
+		MaxSeries: 100,
+	}, func([]prompb.TimeSeries) bool { return success })
+
+	// Callbacks are only called once the batch is written successfully.
+	c.Add(make([]prompb.TimeSeries, 1), func() { written++ })
+	c.Add(make([]prompb.TimeSeries, 1), nil)
+	c.Add(make([]prompb.TimeSeries, 1), func() { written++ })
+	c.Close()
+	require.Equal(t, 2, written)
+
+	success = false
+	c.Add(make([]prompb.TimeSeries, 1), func() { written++ })
+	c.Close()
+	require.Equal(t, 2, written)
+}
+
+func TestPromWriteCoalesced(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		numSeries int
+		wg        sync.WaitGroup
+	)
+	wg.Add(1)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), ingest.WriteOptions{}).
+		Do(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			defer wg.Done()
+			for iter.Next() {
+				numSeries++
+			}
+			return nil
+		})
+	// Requests with overridden write options are written synchronously.
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Not(ingest.WriteOptions{}))
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				Coalesce: config.PromRemoteWriteCoalesceConfiguration{
+					Enabled:   true,
+					MaxDelay:  time.Hour,
+					MaxSeries: 4,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		require.Equal(t, http.StatusAccepted, writer.Result().StatusCode)
+	}
+
+	promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.WriteTypeHeader, headers.AggregateWriteType)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+
+	wg.Wait()
+	require.Equal(t, 4, numSeries)
+}
+
+func TestPromWriteDrainCoalescerTimeout(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		unblock = make(chan struct{})
+		written = make(chan struct{})
+	)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, _ ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			defer close(written)
+			<-unblock
+			return nil
+		})
+
+	dir := newTestWALDir(t)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				Coalesce: config.PromRemoteWriteCoalesceConfiguration{
+					Enabled:   true,
+					MaxDelay:  time.Hour,
+					MaxSeries: 100,
+				},
+				WAL: config.PromRemoteWriteWALConfiguration{
+					Enabled: true,
+					Path:    dir,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writeHandler := handler.(*PromWriteHandler)
+
+	promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusAccepted, writer.Result().StatusCode)
+
+	// The write ahead log is still closed if the context is done while the
+	// coalesced series are being flushed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, writeHandler.Drain(ctx))
+	_, err = writeHandler.wal.Append(nil, xtime.Millisecond)
+	require.Equal(t, errWALClosed, err)
+
+	// The entry of the abandoned write is retained to be replayed.
+	close(unblock)
+	<-written
+	require.Len(t, walSegments(t, dir), 1)
+}
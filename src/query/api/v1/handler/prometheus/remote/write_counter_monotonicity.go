@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"math"
+	"sort"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// counterMonotonicity reports counters whose samples decrease within a
+// series without resetting to zero, which usually indicates a double scrape
+// or relabeling bug.
+type counterMonotonicity struct {
+	metricNameLabels [][]byte
+	scope            tally.Scope
+	logger           *zap.Logger
+}
+
+func newCounterMonotonicity(
+	metricNameLabels [][]byte,
+	scope tally.Scope,
+	logger *zap.Logger,
+) *counterMonotonicity {
+	return &counterMonotonicity{
+		metricNameLabels: metricNameLabels,
+		scope:            scope.SubScope("counter"),
+		logger:           logger,
+	}
+}
+
+// Check counts and logs the counters of the request that are not monotonic,
+// the request is not modified.
+func (c *counterMonotonicity) Check(req *prompb.WriteRequest) {
+	for i, s := range req.Timeseries {
+		if classifyMetricType(s) != metricTypeCounter || isMonotonic(s.Samples) {
+			continue
+		}
+		name, _ := metricNameValue(s.Labels, c.metricNameLabels)
+		c.scope.Tagged(map[string]string{"metric": string(name)}).
+			Counter("non-monotonic").Inc(1)
+		c.logger.Warn("non-monotonic counter",
+			zap.Int("seriesIndex", i),
+			zap.ByteString("seriesName", name))
+	}
+}
+
+// isMonotonic returns whether the values of the samples in timestamp order
+// never decrease other than by resetting to zero, NaN staleness markers are
+// ignored.
+func isMonotonic(samples []prompb.Sample) bool {
+	if len(samples) < 2 {
+		return true
+	}
+	if !sort.SliceIsSorted(samples, func(a, b int) bool {
+		return samples[a].Timestamp < samples[b].Timestamp
+	}) {
+		// Sort a copy so that the request is not modified.
+		samples = append([]prompb.Sample(nil), samples...)
+		sort.SliceStable(samples, func(a, b int) bool {
+			return samples[a].Timestamp < samples[b].Timestamp
+		})
+	}
+
+	prev := math.NaN()
+	for _, sample := range samples {
+		v := sample.Value
+		if math.IsNaN(v) {
+			continue
+		}
+		if v < prev && v != 0 {
+			return false
+		}
+		prev = v
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"math"
+	"testing"
+
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCounterMonotonicityCheck(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	core, logs := observer.New(zap.WarnLevel)
+	c := newCounterMonotonicity([][]byte{metricNameLabel}, scope, zap.New(core))
+
+	req := test.NewWriteRequest(
+		// Resets to zero and staleness markers are allowed.
+		test.WithSamples(test.NewSeries("resets_total", "job", "a"),
+			prompb.Sample{Value: 5, Timestamp: 1000},
+			prompb.Sample{Value: 0, Timestamp: 2000},
+			prompb.Sample{Value: math.NaN(), Timestamp: 3000},
+			prompb.Sample{Value: 1, Timestamp: 4000}),
+		// Samples are checked in timestamp order.
+		test.WithSamples(test.NewSeries("unsorted_total", "job", "a"),
+			prompb.Sample{Value: 2, Timestamp: 2000},
+			prompb.Sample{Value: 1, Timestamp: 1000}),
+		test.WithSamples(test.NewSeries("backwards_total", "job", "a"),
+			prompb.Sample{Value: 5, Timestamp: 1000},
+			prompb.Sample{Value: 3, Timestamp: 2000}),
+		// Gauges are not checked.
+		test.WithSamples(test.NewSeries("inflight", "job", "a"),
+			prompb.Sample{Value: 5, Timestamp: 1000},
+			prompb.Sample{Value: 3, Timestamp: 2000}),
+	)
+	c.Check(req)
+
+	counters := scope.Snapshot().Counters()
+	require.Len(t, counters, 1)
+	require.Equal(t, int64(1),
+		counters["counter.non-monotonic+metric=backwards_total"].Value())
+	require.Equal(t, 1, logs.Len())
+	require.Equal(t, int64(2), logs.All()[0].ContextMap()["seriesIndex"])
+
+	// The request is not modified.
+	require.Equal(t, int64(2000), req.Timeseries[1].Samples[0].Timestamp)
+}
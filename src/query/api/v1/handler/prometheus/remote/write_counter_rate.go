@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultCounterRateSuffix    = ":rate"
+	defaultCounterRateMaxSeries = 1 << 18
+	defaultCounterRateRetention = 10 * time.Minute
+)
+
+// counterSample is the previous sample of a counter.
+type counterSample struct {
+	key     [8]byte
+	time    time.Time
+	value   float64
+	updated time.Time
+}
+
+// counterRateUpdate is the previous sample of a counter that is recorded
+// once the counter and its rate series are written.
+type counterRateUpdate struct {
+	key     [8]byte
+	rateKey [8]byte
+	time    time.Time
+	value   float64
+}
+
+// counterRates derives rate series from counters using the previous sample
+// of recently written counters, the least recently written counters are
+// evicted once full.
+type counterRates struct {
+	sync.Mutex
+
+	pattern          *regexp.Regexp
+	mode             config.CounterRateMode
+	suffix           []byte
+	maxSeries        int
+	retention        time.Duration
+	metricNameLabels [][]byte
+	nowFn            clock.NowFn
+	entries          map[[8]byte]*list.Element
+	lru              *list.List
+	samples          tally.Counter
+}
+
+func newCounterRates(
+	cfg config.PromRemoteWriteCounterRatesConfiguration,
+	metricNameLabels [][]byte,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) (*counterRates, error) {
+	var pattern *regexp.Regexp
+	if v := cfg.MetricNamePattern; v != "" {
+		var err error
+		pattern, err = regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter rate metric name pattern: %v", err)
+		}
+	}
+	suffix := defaultCounterRateSuffix
+	if v := cfg.Suffix; v != "" {
+		suffix = v
+	}
+	maxSeries := defaultCounterRateMaxSeries
+	if v := cfg.MaxSeries; v > 0 {
+		maxSeries = v
+	}
+	retention := defaultCounterRateRetention
+	if v := cfg.Retention; v > 0 {
+		retention = v
+	}
+	return &counterRates{
+		pattern:          pattern,
+		mode:             cfg.Mode,
+		suffix:           []byte(suffix),
+		maxSeries:        maxSeries,
+		retention:        retention,
+		metricNameLabels: metricNameLabels,
+		nowFn:            nowFn,
+		entries:          make(map[[8]byte]*list.Element),
+		lru:              list.New(),
+		samples:          scope.SubScope("write").Counter("counter-rate-samples"),
+	}, nil
+}
+
+// Apply adds a rate series after each matching counter of the request, or
+// replaces the counter with its rate series in replace mode. Counters that
+// have no rate samples, such as when first written, are removed in replace
+// mode. The samples of each counter are expected to be sorted by timestamp,
+// samples at or before the previous sample are skipped. The returned updates
+// must be passed to Written once the request is written for the previous
+// samples to be recorded, so that the rates of a request that is rejected or
+// fails to be written are derived again if the request is retried.
+func (c *counterRates) Apply(req *prompb.WriteRequest, unit xtime.Unit) []counterRateUpdate {
+	c.Lock()
+	defer c.Unlock()
+
+	var (
+		now        = c.nowFn()
+		numSamples int
+		series     = make([]prompb.TimeSeries, 0, len(req.Timeseries))
+		updates    []counterRateUpdate
+	)
+	for _, s := range req.Timeseries {
+		rate, update, ok := c.rateSeriesWithLock(s, unit, now, updates)
+		if !ok {
+			series = append(series, s)
+			continue
+		}
+		if c.mode != config.CounterRateReplace {
+			series = append(series, s)
+		}
+		if len(rate.Samples) > 0 {
+			series = append(series, rate)
+			numSamples += len(rate.Samples)
+		}
+		if !update.time.IsZero() {
+			updates = append(updates, update)
+		}
+	}
+	req.Timeseries = series
+	c.samples.Inc(int64(numSamples))
+	return updates
+}
+
+// Written records the previous samples of the counters of the written
+// request, counters for which either the counter or its rate series failed
+// to be written are not recorded.
+func (c *counterRates) Written(
+	req *prompb.WriteRequest,
+	updates []counterRateUpdate,
+	batchErr ingest.BatchError,
+) {
+	if len(updates) == 0 {
+		return
+	}
+
+	var failed map[[8]byte]struct{}
+	if batchErr != nil {
+		indices, ok := failedSeries(batchErr)
+		if !ok {
+			return
+		}
+		failed = make(map[[8]byte]struct{}, len(indices))
+		for _, idx := range indices {
+			if idx < len(req.Timeseries) {
+				failed[sortedSeriesKey(req.Timeseries[idx].Labels)] = struct{}{}
+			}
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.nowFn()
+	for _, update := range updates {
+		if _, ok := failed[update.key]; ok {
+			continue
+		}
+		if _, ok := failed[update.rateKey]; ok {
+			continue
+		}
+		c.setWithLock(update.key, update.time, update.value, now)
+	}
+}
+
+// rateSeriesWithLock returns the rate series of the series, the update of
+// its previous sample which has a zero time if the series has no samples
+// other than staleness markers, and whether the series is a matching counter. The
+// pending updates of earlier series of the same request take precedence
+// over the recorded previous samples.
+func (c *counterRates) rateSeriesWithLock(
+	s prompb.TimeSeries,
+	unit xtime.Unit,
+	now time.Time,
+	pending []counterRateUpdate,
+) (prompb.TimeSeries, counterRateUpdate, bool) {
+	if classifyMetricType(s) != metricTypeCounter {
+		return prompb.TimeSeries{}, counterRateUpdate{}, false
+	}
+	name, ok := metricNameValue(s.Labels, c.metricNameLabels)
+	if !ok || (c.pattern != nil && !c.pattern.Match(name)) {
+		return prompb.TimeSeries{}, counterRateUpdate{}, false
+	}
+
+	key := sortedSeriesKey(s.Labels)
+	prev, hasPrev := c.getWithLock(key, now)
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].key == key {
+			prev.time, prev.value, hasPrev = pending[i].time, pending[i].value, true
+			break
+		}
+	}
+	samples := make([]prompb.Sample, 0, len(s.Samples))
+	for _, sample := range s.Samples {
+		if math.IsNaN(sample.Value) {
+			// Staleness markers have no rate.
+			continue
+		}
+		t := sampleTime(sample.Timestamp, unit)
+		if hasPrev && !t.After(prev.time) {
+			continue
+		}
+		if hasPrev {
+			delta := sample.Value - prev.value
+			if delta < 0 {
+				// The counter was reset so increased from zero.
+				delta = sample.Value
+			}
+			samples = append(samples, prompb.Sample{
+				Value:     delta / t.Sub(prev.time).Seconds(),
+				Timestamp: sample.Timestamp,
+			})
+		}
+		prev.time, prev.value, hasPrev = t, sample.Value, true
+	}
+
+	labels := make([]prompb.Label, 0, len(s.Labels))
+	for _, label := range s.Labels {
+		if isMetricNameLabel(label.Name, c.metricNameLabels) {
+			value := make([]byte, 0, len(label.Value)+len(c.suffix))
+			value = append(append(value, label.Value...), c.suffix...)
+			label.Value = value
+		}
+		labels = append(labels, label)
+	}
+	update := counterRateUpdate{
+		key:     key,
+		rateKey: sortedSeriesKey(labels),
+		time:    prev.time,
+		value:   prev.value,
+	}
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: samples,
+		Type:    prompb.MetricType_GAUGE,
+	}, update, true
+}
+
+func (c *counterRates) getWithLock(key [8]byte, now time.Time) (counterSample, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return counterSample{}, false
+	}
+	entry := elem.Value.(*counterSample)
+	if now.Sub(entry.updated) > c.retention {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return counterSample{}, false
+	}
+	return *entry, true
+}
+
+func (c *counterRates) setWithLock(key [8]byte, t time.Time, value float64, now time.Time) {
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*counterSample)
+		if t.After(entry.time) {
+			// Concurrent requests may be written out of order, only ever
+			// advance the previous sample.
+			entry.time, entry.value = t, value
+		}
+		entry.updated = now
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&counterSample{
+		key:     key,
+		time:    t,
+		value:   value,
+		updated: now,
+	})
+	for c.lru.Len() > c.maxSeries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*counterSample).key)
+	}
+}
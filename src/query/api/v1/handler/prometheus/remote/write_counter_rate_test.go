@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestCounterRatesAlongside(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	c, err := newCounterRates(config.PromRemoteWriteCounterRatesConfiguration{
+		MetricNamePattern: "requests_.*",
+	}, [][]byte{metricNameLabel}, time.Now, scope)
+	require.NoError(t, err)
+
+	req := test.NewWriteRequest(
+		test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+			prompb.Sample{Value: 10, Timestamp: 1000},
+			prompb.Sample{Value: 20, Timestamp: 2000},
+			prompb.Sample{Value: 5, Timestamp: 4000}),
+		test.WithSamples(test.NewSeries("errors_total", "job", "a"),
+			prompb.Sample{Value: 1, Timestamp: 1000},
+			prompb.Sample{Value: 2, Timestamp: 2000}),
+		test.WithSamples(test.NewSeries("requests_inflight", "job", "a"),
+			prompb.Sample{Value: 1, Timestamp: 1000},
+			prompb.Sample{Value: 2, Timestamp: 2000}),
+	)
+	c.Written(req, c.Apply(req, xtime.Millisecond), nil)
+
+	// Resets are treated as an increase from zero.
+	rate := test.WithType(test.WithSamples(test.NewSeries("requests_total:rate", "job", "a"),
+		prompb.Sample{Value: 10, Timestamp: 2000},
+		prompb.Sample{Value: 2.5, Timestamp: 4000}), prompb.MetricType_GAUGE)
+	require.Len(t, req.Timeseries, 4)
+	require.Equal(t, "requests_total", string(req.Timeseries[0].Labels[0].Value))
+	require.Equal(t, rate, req.Timeseries[1])
+	require.Equal(t, "errors_total", string(req.Timeseries[2].Labels[0].Value))
+	require.Equal(t, "requests_inflight", string(req.Timeseries[3].Labels[0].Value))
+
+	// The previous sample is remembered across requests and samples at or
+	// before it are skipped.
+	req = test.NewWriteRequest(
+		test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+			prompb.Sample{Value: 1, Timestamp: 3000},
+			prompb.Sample{Value: 15, Timestamp: 5000}),
+	)
+	c.Apply(req, xtime.Millisecond)
+	require.Len(t, req.Timeseries, 2)
+	require.Equal(t, []prompb.Sample{{Value: 10, Timestamp: 5000}}, req.Timeseries[1].Samples)
+	require.Equal(t, int64(3), scope.Snapshot().Counters()["write.counter-rate-samples+"].Value())
+}
+
+func TestCounterRatesReplace(t *testing.T) {
+	c, err := newCounterRates(config.PromRemoteWriteCounterRatesConfiguration{
+		Mode:   config.CounterRateReplace,
+		Suffix: "_per_second",
+	}, [][]byte{metricNameLabel}, time.Now, tally.NoopScope)
+	require.NoError(t, err)
+
+	// Counters without a rate sample are removed.
+	req := test.NewWriteRequest(
+		test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+			prompb.Sample{Value: 10, Timestamp: 1000}),
+	)
+	c.Written(req, c.Apply(req, xtime.Millisecond), nil)
+	require.Len(t, req.Timeseries, 0)
+
+	req = test.NewWriteRequest(
+		test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+			prompb.Sample{Value: 30, Timestamp: 3000}),
+	)
+	c.Apply(req, xtime.Millisecond)
+	require.Len(t, req.Timeseries, 1)
+	require.Equal(t, "requests_total_per_second", string(req.Timeseries[0].Labels[0].Value))
+	require.Equal(t, []prompb.Sample{{Value: 10, Timestamp: 3000}}, req.Timeseries[0].Samples)
+}
+
+func TestCounterRatesNotWritten(t *testing.T) {
+	c, err := newCounterRates(config.PromRemoteWriteCounterRatesConfiguration{},
+		[][]byte{metricNameLabel}, time.Now, tally.NoopScope)
+	require.NoError(t, err)
+
+	newRequest := func() *prompb.WriteRequest {
+		return test.NewWriteRequest(
+			test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+				prompb.Sample{Value: 10, Timestamp: 1000}),
+		)
+	}
+	c.Written(newRequest(), c.Apply(newRequest(), xtime.Millisecond), nil)
+
+	rateRequest := func() *prompb.WriteRequest {
+		return test.NewWriteRequest(
+			test.WithSamples(test.NewSeries("requests_total", "job", "a"),
+				prompb.Sample{Value: 20, Timestamp: 2000}),
+		)
+	}
+	expected := []prompb.Sample{{Value: 10, Timestamp: 2000}}
+
+	// The previous sample is not recorded if the request is not written, or
+	// if the rate series fails to be written, so the rate is derived again
+	// when the request is retried.
+	req := rateRequest()
+	c.Apply(req, xtime.Millisecond)
+	require.Equal(t, expected, req.Timeseries[1].Samples)
+
+	req = rateRequest()
+	updates := c.Apply(req, xtime.Millisecond)
+	require.Equal(t, expected, req.Timeseries[1].Samples)
+	c.Written(req, updates, seriesBatchError(ingest.NewSeriesError(errors.New("unavailable"), 1)))
+
+	req = rateRequest()
+	updates = c.Apply(req, xtime.Millisecond)
+	require.Equal(t, expected, req.Timeseries[1].Samples)
+	c.Written(req, updates, nil)
+
+	// Once written the samples at or before the previous sample are skipped.
+	req = rateRequest()
+	c.Apply(req, xtime.Millisecond)
+	require.Len(t, req.Timeseries, 1)
+}
+
+func TestCounterRatesInvalidPattern(t *testing.T) {
+	_, err := newCounterRates(config.PromRemoteWriteCounterRatesConfiguration{
+		MetricNamePattern: "(",
+	}, [][]byte{metricNameLabel}, time.Now, tally.NoopScope)
+	require.Error(t, err)
+}
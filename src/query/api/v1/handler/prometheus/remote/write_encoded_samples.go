@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// PromWriteEncodedSamplesContentType is the content type of write
+	// requests where the samples of each series are encoded as a single M3TSZ
+	// stream rather than as individual samples.
+	PromWriteEncodedSamplesContentType = "application/x-m3tsz-protobuf"
+
+	// encodedSamplesField is the field of the TimeSeries message with the
+	// M3TSZ encoded samples of the series.
+	encodedSamplesField protowire.Number = 103
+)
+
+var encodedSamplesOptions = encoding.NewOptions()
+
+// isEncodedSamplesRequest returns true if the request has the encoded
+// samples content type.
+func isEncodedSamplesRequest(r *http.Request) bool {
+	v := r.Header.Get(xhttp.HeaderContentType)
+	if v == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(v)
+	return err == nil && mediaType == PromWriteEncodedSamplesContentType
+}
+
+// decodeEncodedSamples decodes the M3TSZ encoded samples of each series of
+// the write request body and appends them to the samples of the series in
+// the request, with timestamps at the given precision. The streams are
+// decoded with the same options that series are encoded with for storage so
+// that encoding samples with M3TSZ is lossless.
+func decodeEncodedSamples(
+	body []byte,
+	req *prompb.WriteRequest,
+	unit xtime.Unit,
+) error {
+	d, err := unit.Value()
+	if err != nil {
+		d = time.Millisecond
+	}
+
+	seriesIdx := -1
+	return consumeMessageFields(body, func(num protowire.Number, series []byte) error {
+		if num != 1 {
+			return nil
+		}
+		seriesIdx++
+		if seriesIdx >= len(req.Timeseries) {
+			return nil
+		}
+		return consumeMessageFields(series, func(num protowire.Number, stream []byte) error {
+			if num != encodedSamplesField {
+				return nil
+			}
+			samples, err := decodeSamplesStream(stream, d, req.Timeseries[seriesIdx].Samples)
+			if err != nil {
+				return fmt.Errorf("series %d has invalid encoded samples: %v", seriesIdx, err)
+			}
+			req.Timeseries[seriesIdx].Samples = samples
+			return nil
+		})
+	})
+}
+
+func decodeSamplesStream(
+	stream []byte,
+	unit time.Duration,
+	samples []prompb.Sample,
+) ([]prompb.Sample, error) {
+	iter := m3tsz.NewReaderIterator(bytes.NewReader(stream),
+		m3tsz.DefaultIntOptimizationEnabled, encodedSamplesOptions)
+	defer iter.Close()
+
+	for iter.Next() {
+		dp, _, _ := iter.Current()
+		samples = append(samples, prompb.Sample{
+			Value:     dp.Value,
+			Timestamp: xtime.ToNormalizedTime(dp.Timestamp, unit),
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
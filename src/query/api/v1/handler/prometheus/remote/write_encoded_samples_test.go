@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
+	"github.com/m3db/m3/src/dbnode/ts"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/checked"
+	xcontext "github.com/m3db/m3/src/x/context"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodedSamplesRequestBody returns the encoded request with the samples of
+// each series encoded as an M3TSZ stream.
+func encodedSamplesRequestBody(t *testing.T, req *prompb.WriteRequest) []byte {
+	var body []byte
+	for _, series := range req.Timeseries {
+		seriesBytes, err := proto.Marshal(&prompb.TimeSeries{Labels: series.Labels})
+		require.NoError(t, err)
+
+		start := time.Unix(0, series.Samples[0].Timestamp*int64(time.Millisecond))
+		encoder := m3tsz.NewEncoder(start, checked.NewBytes(nil, nil),
+			m3tsz.DefaultIntOptimizationEnabled, encoding.NewOptions())
+		for _, sample := range series.Samples {
+			require.NoError(t, encoder.Encode(ts.Datapoint{
+				Timestamp: time.Unix(0, sample.Timestamp*int64(time.Millisecond)),
+				Value:     sample.Value,
+			}, xtime.Millisecond, nil))
+		}
+		ctx := xcontext.NewContext()
+		reader, ok := encoder.Stream(ctx)
+		require.True(t, ok)
+		stream, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		ctx.Close()
+
+		seriesBytes = protowire.AppendTag(seriesBytes, encodedSamplesField, protowire.BytesType)
+		seriesBytes = protowire.AppendBytes(seriesBytes, stream)
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, seriesBytes)
+	}
+	return body
+}
+
+func TestDecodeEncodedSamples(t *testing.T) {
+	expected := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{{Name: []byte("__name__"), Value: []byte("up")}},
+				Samples: []prompb.Sample{
+					{Value: 1, Timestamp: 1000},
+					{Value: 1.5, Timestamp: 11000},
+					{Value: -3.25, Timestamp: 21500},
+				},
+			},
+			{
+				Labels:  []prompb.Label{{Name: []byte("__name__"), Value: []byte("down")}},
+				Samples: []prompb.Sample{{Value: 42, Timestamp: 5000}},
+			},
+		},
+	}
+	body := encodedSamplesRequestBody(t, expected)
+
+	var req prompb.WriteRequest
+	require.NoError(t, proto.Unmarshal(body, &req))
+	require.NoError(t, decodeEncodedSamples(body, &req, xtime.Millisecond))
+	require.Equal(t, expected.Timeseries, req.Timeseries)
+
+	// Timestamps are converted to the request precision.
+	req = prompb.WriteRequest{}
+	require.NoError(t, proto.Unmarshal(body, &req))
+	require.NoError(t, decodeEncodedSamples(body, &req, xtime.Second))
+	require.Equal(t, []int64{1, 11, 21}, []int64{
+		req.Timeseries[0].Samples[0].Timestamp,
+		req.Timeseries[0].Samples[1].Timestamp,
+		req.Timeseries[0].Samples[2].Timestamp,
+	})
+}
+
+func TestPromWriteEncodedSamples(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels: []prompb.Label{{Name: []byte("__name__"), Value: []byte("up")}},
+			Samples: []prompb.Sample{
+				{Value: 1, Timestamp: 1000},
+				{Value: 2, Timestamp: 2000},
+			},
+		}},
+	}
+	newRequest := func() *http.Request {
+		body := encodedSamplesRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL,
+			bytes.NewReader(snappy.Encode(nil, body)))
+		req.Header.Set(xhttp.HeaderContentType, PromWriteEncodedSamplesContentType)
+		return req
+	}
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			require.True(t, iter.Next())
+			datapoints := iter.Current().Datapoints
+			require.Len(t, datapoints, 2)
+			require.Equal(t, float64(2), datapoints[1].Value)
+			require.Equal(t, int64(2000), datapoints[1].Timestamp.UnixNano()/int64(time.Millisecond))
+			require.False(t, iter.Next())
+			return nil
+		})
+
+	newHandler := func(enabled bool) http.Handler {
+		opts := makeOptions(mockDownsamplerAndWriter).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					EncodedSamples: enabled,
+					StrictDecode:   true,
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler
+	}
+
+	writer := httptest.NewRecorder()
+	newHandler(true).ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+
+	writer = httptest.NewRecorder()
+	newHandler(false).ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "encoded samples content type is not enabled")
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/headers"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// PromWriteFreezeURL is the url for the prom write freeze handler, a GET
+	// returns the freeze rules, a POST replaces them and a DELETE removes
+	// them.
+	PromWriteFreezeURL = handler.RoutePrefixV1 + "/prom/remote/write/freeze"
+
+	defaultFreezeRetryAfter = 30 * time.Second
+)
+
+var errWriteFrozen = xhttp.NewError(
+	errors.New("write frozen: series match a freeze rule"),
+	http.StatusServiceUnavailable)
+
+// PromWriteFreezeHTTPMethods are the HTTP methods used with the prom write
+// freeze handler.
+var PromWriteFreezeHTTPMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodDelete,
+}
+
+// writeFreezeRule is a freeze rule as set and returned by the freeze handler.
+type writeFreezeRule struct {
+	Namespace         string `json:"namespace,omitempty"`
+	MetricNamePattern string `json:"metricNamePattern,omitempty"`
+}
+
+// writeFreezeRules is the body of requests to and responses from the freeze
+// handler.
+type writeFreezeRules struct {
+	Rules []writeFreezeRule `json:"rules"`
+}
+
+type compiledFreezeRule struct {
+	rule writeFreezeRule
+	// unaggregated is true if the rule matches the unaggregated namespace,
+	// otherwise policy is the storage policy of the namespace if set.
+	unaggregated bool
+	policy       *policy.StoragePolicy
+	pattern      *regexp.Regexp
+}
+
+func compileFreezeRule(rule writeFreezeRule) (compiledFreezeRule, error) {
+	compiled := compiledFreezeRule{rule: rule}
+	switch ns := rule.Namespace; ns {
+	case "":
+	case headers.UnaggregatedStoragePolicy:
+		compiled.unaggregated = true
+	default:
+		p, err := policy.ParseStoragePolicy(ns)
+		if err != nil {
+			return compiledFreezeRule{}, fmt.Errorf("invalid freeze namespace: %v", err)
+		}
+		compiled.policy = &p
+	}
+	if v := rule.MetricNamePattern; v != "" {
+		pattern, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return compiledFreezeRule{}, fmt.Errorf("invalid freeze metric name pattern: %v", err)
+		}
+		compiled.pattern = pattern
+	}
+	if rule.Namespace == "" && rule.MetricNamePattern == "" {
+		return compiledFreezeRule{}, errors.New("freeze rule must set a namespace or metric name pattern")
+	}
+	return compiled, nil
+}
+
+// matchesNamespace returns whether the rule matches any of the namespaces
+// that the request is written to directly.
+func (r compiledFreezeRule) matchesNamespace(opts ingest.WriteOptions) bool {
+	switch {
+	case r.unaggregated:
+		return !opts.WriteOverride
+	case r.policy != nil:
+		for _, p := range opts.WriteStoragePolicies {
+			if p.Equivalent(*r.policy) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// writeFreezes rejects write requests with series that match any of a set of
+// freeze rules that can be replaced at runtime.
+type writeFreezes struct {
+	sync.RWMutex
+
+	rules            []compiledFreezeRule
+	retryAfter       time.Duration
+	metricNameLabels [][]byte
+}
+
+func newWriteFreezes(
+	cfg config.PromRemoteWriteFreezeConfiguration,
+	metricNameLabels [][]byte,
+) (*writeFreezes, error) {
+	retryAfter := defaultFreezeRetryAfter
+	if v := cfg.RetryAfter; v > 0 {
+		retryAfter = v
+	}
+	f := &writeFreezes{
+		retryAfter:       retryAfter,
+		metricNameLabels: metricNameLabels,
+	}
+	rules := make([]writeFreezeRule, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		rules = append(rules, writeFreezeRule{
+			Namespace:         rule.Namespace,
+			MetricNamePattern: rule.MetricNamePattern,
+		})
+	}
+	if err := f.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetRules replaces the freeze rules, the rules are left unchanged if any
+// rule is invalid.
+func (f *writeFreezes) SetRules(rules []writeFreezeRule) error {
+	compiled := make([]compiledFreezeRule, 0, len(rules))
+	for _, rule := range rules {
+		c, err := compileFreezeRule(rule)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, c)
+	}
+
+	f.Lock()
+	f.rules = compiled
+	f.Unlock()
+	return nil
+}
+
+// Rules returns the freeze rules.
+func (f *writeFreezes) Rules() []writeFreezeRule {
+	f.RLock()
+	defer f.RUnlock()
+
+	rules := make([]writeFreezeRule, 0, len(f.rules))
+	for _, rule := range f.rules {
+		rules = append(rules, rule.rule)
+	}
+	return rules
+}
+
+// Frozen returns whether any series of the request matches a freeze rule.
+func (f *writeFreezes) Frozen(req *prompb.WriteRequest, opts ingest.WriteOptions) bool {
+	f.RLock()
+	defer f.RUnlock()
+
+	for _, rule := range f.rules {
+		if !rule.matchesNamespace(opts) {
+			continue
+		}
+		if rule.pattern == nil {
+			return len(req.Timeseries) > 0
+		}
+		for _, s := range req.Timeseries {
+			name, ok := metricNameValue(s.Labels, f.metricNameLabels)
+			if ok && rule.pattern.Match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FreezeHandler returns the handler that returns and replaces the freeze
+// rules of the write handler at runtime.
+func (h *PromWriteHandler) FreezeHandler() http.Handler {
+	return http.HandlerFunc(h.serveFreezeHTTP)
+}
+
+func (h *PromWriteHandler) serveFreezeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var body writeFreezeRules
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			xhttp.WriteError(w, xhttp.NewError(err, http.StatusBadRequest))
+			return
+		}
+		if err := h.freezes.SetRules(body.Rules); err != nil {
+			xhttp.WriteError(w, xhttp.NewError(err, http.StatusBadRequest))
+			return
+		}
+		logger := h.instrumentOpts.Logger()
+		logger.Info("set write freeze rules", zap.Int("numRules", len(body.Rules)))
+	case http.MethodDelete:
+		// Removing the rules cannot fail.
+		_ = h.freezes.SetRules(nil)
+		h.instrumentOpts.Logger().Info("removed write freeze rules")
+	}
+	xhttp.WriteJSONResponse(w, writeFreezeRules{Rules: h.freezes.Rules()},
+		h.instrumentOpts.Logger())
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFreezesFrozen(t *testing.T) {
+	f, err := newWriteFreezes(config.PromRemoteWriteFreezeConfiguration{
+		Rules: []config.PromRemoteWriteFreezeRule{
+			{Namespace: "unaggregated", MetricNamePattern: "reindex_.*"},
+			{Namespace: "1m:48h"},
+		},
+	}, [][]byte{metricNameLabel})
+	require.NoError(t, err)
+
+	req := test.NewWriteRequest(
+		test.NewSeries("up"),
+		test.NewSeries("reindex_series"),
+	)
+	aggregated := ingest.WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: policy.StoragePolicies{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+	}
+	require.True(t, f.Frozen(req, ingest.WriteOptions{}))
+	require.True(t, f.Frozen(req, aggregated))
+
+	req.Timeseries = req.Timeseries[:1]
+	require.False(t, f.Frozen(req, ingest.WriteOptions{}))
+	require.True(t, f.Frozen(req, aggregated))
+
+	require.NoError(t, f.SetRules(nil))
+	require.False(t, f.Frozen(req, aggregated))
+}
+
+func TestWriteFreezesInvalidRules(t *testing.T) {
+	f, err := newWriteFreezes(config.PromRemoteWriteFreezeConfiguration{}, nil)
+	require.NoError(t, err)
+
+	for _, rule := range []writeFreezeRule{
+		{},
+		{Namespace: "not-a-policy"},
+		{MetricNamePattern: "("},
+	} {
+		require.Error(t, f.SetRules([]writeFreezeRule{rule}))
+	}
+}
+
+func TestPromWriteFreeze(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil)
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	freezeHandler := handler.(*PromWriteHandler).FreezeHandler()
+
+	setRules := func(method, body string) string {
+		req := httptest.NewRequest(method, PromWriteFreezeURL, strings.NewReader(body))
+		writer := httptest.NewRecorder()
+		freezeHandler.ServeHTTP(writer, req)
+		require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+		return strings.TrimSpace(writer.Body.String())
+	}
+	write := func() *http.Response {
+		promReq := test.GeneratePromWriteRequest()
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		return writer.Result()
+	}
+
+	rules := `{"rules":[{"namespace":"unaggregated"}]}`
+	require.Equal(t, rules, setRules(http.MethodPost, rules))
+	require.Equal(t, rules, setRules(http.MethodGet, ""))
+
+	resp := write()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "30", resp.Header.Get(xhttp.HeaderRetryAfter))
+
+	require.Equal(t, `{"rules":[]}`, setRules(http.MethodDelete, ""))
+	require.Equal(t, http.StatusOK, write().StatusCode)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/prometheus/common/model"
+)
+
+var (
+	metricNameLabel    = []byte(model.MetricNameLabel)
+	bucketLabel        = []byte(model.BucketLabel)
+	bucketMetricSuffix = []byte("_bucket")
+)
+
+// histogramBucketCollapser collapses the buckets of classic Prometheus
+// histograms to a coarser set of boundaries. Since bucket counts are
+// cumulative, the count for a retained boundary is the count of the
+// largest source bucket at or below it, this is equivalent to summing the
+// per bucket counts of all source buckets into the nearest retained
+// boundary above them.
+type histogramBucketCollapser struct {
+	boundaries []float64
+	formatted  [][]byte
+}
+
+func newHistogramBucketCollapser(boundaries []float64) *histogramBucketCollapser {
+	sorted := append([]float64(nil), boundaries...)
+	sort.Float64s(sorted)
+
+	formatted := make([][]byte, 0, len(sorted))
+	for _, b := range sorted {
+		formatted = append(formatted, []byte(formatBucketBoundary(b)))
+	}
+	return &histogramBucketCollapser{
+		boundaries: sorted,
+		formatted:  formatted,
+	}
+}
+
+type histogramBucket struct {
+	seriesIdx int
+	labelIdx  int
+	le        float64
+}
+
+// Collapse rewrites the bucket series of the request in place, bucket
+// series that do not map to a retained boundary are removed from the
+// request and all other series are left unchanged.
+func (c *histogramBucketCollapser) Collapse(req *prompb.WriteRequest) {
+	// Group the bucket series of each histogram, keyed by the series labels
+	// other than the bucket boundary.
+	var (
+		groups     = make(map[string][]histogramBucket)
+		groupOrder []string
+		keyBuf     []byte
+		scratch    []prompb.Label
+	)
+	for i, series := range req.Timeseries {
+		bucket, ok := bucketLabelIndex(series.Labels)
+		if !ok {
+			continue
+		}
+		le, err := strconv.ParseFloat(string(series.Labels[bucket].Value), 64)
+		if err != nil {
+			continue
+		}
+
+		scratch = append(scratch[:0], series.Labels...)
+		sort.Slice(scratch, func(a, b int) bool {
+			return bytes.Compare(scratch[a].Name, scratch[b].Name) < 0
+		})
+		keyBuf = keyBuf[:0]
+		for _, l := range scratch {
+			if bytes.Equal(l.Name, bucketLabel) {
+				continue
+			}
+			keyBuf = append(keyBuf, l.Name...)
+			keyBuf = append(keyBuf, 0xff)
+			keyBuf = append(keyBuf, l.Value...)
+			keyBuf = append(keyBuf, 0xfe)
+		}
+
+		key := string(keyBuf)
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], histogramBucket{
+			seriesIdx: i,
+			labelIdx:  bucket,
+			le:        le,
+		})
+	}
+
+	if len(groups) == 0 {
+		return
+	}
+
+	drop := make(map[int]struct{})
+	for _, key := range groupOrder {
+		c.collapseGroup(req, groups[key], drop)
+	}
+
+	if len(drop) == 0 {
+		return
+	}
+
+	kept := req.Timeseries[:0]
+	for i, series := range req.Timeseries {
+		if _, ok := drop[i]; ok {
+			continue
+		}
+		kept = append(kept, series)
+	}
+	req.Timeseries = kept
+}
+
+func (c *histogramBucketCollapser) collapseGroup(
+	req *prompb.WriteRequest,
+	buckets []histogramBucket,
+	drop map[int]struct{},
+) {
+	sort.Slice(buckets, func(a, b int) bool {
+		return buckets[a].le < buckets[b].le
+	})
+
+	// Assign each retained boundary to the largest source bucket at or below
+	// it, a source bucket takes the largest retained boundary assigned to it.
+	assigned := make([]int, len(buckets))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	j := 0
+	for i, b := range c.boundaries {
+		for j+1 < len(buckets) && buckets[j+1].le <= b {
+			j++
+		}
+		if buckets[j].le <= b {
+			assigned[j] = i
+		}
+	}
+
+	for i, bucket := range buckets {
+		if math.IsInf(bucket.le, 1) {
+			// The +Inf bucket is the total count and is always retained.
+			continue
+		}
+		if assigned[i] < 0 {
+			drop[bucket.seriesIdx] = struct{}{}
+			continue
+		}
+		labels := req.Timeseries[bucket.seriesIdx].Labels
+		labels[bucket.labelIdx].Value = c.formatted[assigned[i]]
+	}
+}
+
+// bucketLabelIndex returns the index of the bucket boundary label if the
+// labels are those of a histogram bucket series.
+func bucketLabelIndex(labels []prompb.Label) (int, bool) {
+	var (
+		isBucket bool
+		idx      = -1
+	)
+	for i, l := range labels {
+		switch {
+		case bytes.Equal(l.Name, metricNameLabel):
+			isBucket = bytes.HasSuffix(l.Value, bucketMetricSuffix)
+		case bytes.Equal(l.Name, bucketLabel):
+			idx = i
+		}
+	}
+	return idx, isBucket && idx >= 0
+}
+
+func formatBucketBoundary(b float64) string {
+	if math.IsInf(b, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(b, 'f', -1, 64)
+}
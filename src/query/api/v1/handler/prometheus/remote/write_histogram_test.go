@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"math"
+	"testing"
+
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testBucket struct {
+	name  string
+	host  string
+	le    string
+	count float64
+}
+
+func toTestBuckets(req *prompb.WriteRequest) []testBucket {
+	buckets := make([]testBucket, 0, len(req.Timeseries))
+	for _, series := range req.Timeseries {
+		var b testBucket
+		for _, l := range series.Labels {
+			switch string(l.Name) {
+			case "__name__":
+				b.name = string(l.Value)
+			case "host":
+				b.host = string(l.Value)
+			case "le":
+				b.le = string(l.Value)
+			}
+		}
+		b.count = series.Samples[0].Value
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func TestHistogramBucketCollapse(t *testing.T) {
+	req := test.NewWriteRequest(
+		test.WithValue(test.NewSeries("latency_bucket", "le", "0.1", "host", "a"), 1),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "0.1", "host", "b"), 10),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "0.25", "host", "a"), 2),
+		test.WithValue(test.NewSeries("latency_count", "host", "a"), 5),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "0.5", "host", "a"), 3),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "1", "host", "a"), 4),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "+Inf", "host", "a"), 5),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "+Inf", "host", "b"), 20),
+		test.WithValue(test.NewSeries("other", "le", "0.25", "host", "a"), 1),
+	)
+
+	newHistogramBucketCollapser([]float64{1, 0.3}).Collapse(req)
+
+	// The "b" histogram has no source bucket between 0.1 and +Inf so the 0.1
+	// bucket takes the largest retained boundary above it.
+	assert.Equal(t, []testBucket{
+		{name: "latency_bucket", host: "b", le: "1", count: 10},
+		{name: "latency_bucket", host: "a", le: "0.3", count: 2},
+		{name: "latency_count", host: "a", le: "", count: 5},
+		{name: "latency_bucket", host: "a", le: "1", count: 4},
+		{name: "latency_bucket", host: "a", le: "+Inf", count: 5},
+		{name: "latency_bucket", host: "b", le: "+Inf", count: 20},
+		{name: "other", host: "a", le: "0.25", count: 1},
+	}, toTestBuckets(req))
+}
+
+func TestHistogramBucketCollapseUnchanged(t *testing.T) {
+	req := test.NewWriteRequest(
+		test.WithValue(test.NewSeries("latency_bucket", "le", "1", "host", "a"), 1),
+		test.WithValue(test.NewSeries("latency_bucket", "le", "+Inf", "host", "a"), 2),
+	)
+
+	newHistogramBucketCollapser([]float64{1, math.Inf(1)}).Collapse(req)
+
+	assert.Equal(t, []testBucket{
+		{name: "latency_bucket", host: "a", le: "1", count: 1},
+		{name: "latency_bucket", host: "a", le: "+Inf", count: 2},
+	}, toTestBuckets(req))
+}
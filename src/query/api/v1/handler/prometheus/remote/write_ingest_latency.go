@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/uber-go/tally"
+)
+
+const defaultIngestLatencyQueueSize = 1024
+
+// ingestLatencyJob is the sample timestamps of a written request and the
+// time it was written at.
+type ingestLatencyJob struct {
+	now        time.Time
+	unit       xtime.Unit
+	timestamps []int64
+}
+
+// ingestLatencyRecorder records the ingest latency of written samples with a
+// bounded pool of workers, requests are dropped rather than waiting when the
+// queue of the workers is full.
+type ingestLatencyRecorder struct {
+	sync.RWMutex
+
+	latency tally.Histogram
+	dropped tally.Counter
+	jobs    chan ingestLatencyJob
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newIngestLatencyRecorder(
+	cfg config.PromRemoteWriteIngestLatencyRecordingConfiguration,
+	latency tally.Histogram,
+	scope tally.Scope,
+) *ingestLatencyRecorder {
+	queueSize := defaultIngestLatencyQueueSize
+	if v := cfg.QueueSize; v > 0 {
+		queueSize = v
+	}
+	r := &ingestLatencyRecorder{
+		latency: latency,
+		dropped: scope.SubScope("ingest-latency").Counter("dropped"),
+		jobs:    make(chan ingestLatencyJob, queueSize),
+	}
+	r.workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// Record queues the sample timestamps of the request to have their latency
+// relative to now recorded, the request is dropped if the queue is full or
+// the recorder is closed.
+func (r *ingestLatencyRecorder) Record(
+	req *prompb.WriteRequest,
+	unit xtime.Unit,
+	now time.Time,
+) {
+	var numSamples int
+	for _, series := range req.Timeseries {
+		numSamples += len(series.Samples)
+	}
+	// Copy the timestamps since the request is not retained once written.
+	timestamps := make([]int64, 0, numSamples)
+	for _, series := range req.Timeseries {
+		for _, sample := range series.Samples {
+			timestamps = append(timestamps, sample.Timestamp)
+		}
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	if r.closed {
+		r.dropped.Inc(1)
+		return
+	}
+	select {
+	case r.jobs <- ingestLatencyJob{now: now, unit: unit, timestamps: timestamps}:
+	default:
+		r.dropped.Inc(1)
+	}
+}
+
+// Close stops accepting requests and waits for the queued requests to be
+// recorded.
+func (r *ingestLatencyRecorder) Close() {
+	r.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.jobs)
+	}
+	r.Unlock()
+	r.workers.Wait()
+}
+
+func (r *ingestLatencyRecorder) work() {
+	defer r.workers.Done()
+	for job := range r.jobs {
+		for _, timestamp := range job.timestamps {
+			age := job.now.Sub(sampleTime(timestamp, job.unit))
+			r.latency.RecordDuration(age)
+		}
+	}
+}
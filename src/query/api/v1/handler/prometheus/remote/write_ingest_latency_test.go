@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func numRecordedDurations(scope tally.TestScope) int64 {
+	var n int64
+	for _, count := range scope.Snapshot().Histograms()["latency+"].Durations() {
+		n += count
+	}
+	return n
+}
+
+func TestIngestLatencyRecorderRecords(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	latency := scope.Histogram("latency", tally.MustMakeLinearDurationBuckets(0, time.Second, 10))
+	r := newIngestLatencyRecorder(config.PromRemoteWriteIngestLatencyRecordingConfiguration{
+		Workers: 2,
+	}, latency, scope)
+
+	now := time.Unix(10, 0)
+	req := test.NewWriteRequest(test.WithTimestamps(test.NewSeries("up"), 8000, 9000, 9500))
+	r.Record(req, xtime.Millisecond, now)
+	r.Close()
+
+	require.Equal(t, int64(3), numRecordedDurations(scope))
+	require.Equal(t, int64(0), scope.Snapshot().Counters()["ingest-latency.dropped+"].Value())
+}
+
+func TestIngestLatencyRecorderDropsWhenFull(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	latency := scope.Histogram("latency", tally.MustMakeLinearDurationBuckets(0, time.Second, 10))
+	// No workers are started so the queue is never drained.
+	r := newIngestLatencyRecorder(config.PromRemoteWriteIngestLatencyRecordingConfiguration{
+		QueueSize: 1,
+	}, latency, scope)
+
+	now := time.Unix(10, 0)
+	req := test.NewWriteRequest(test.WithTimestamps(test.NewSeries("up"), 9000))
+	r.Record(req, xtime.Millisecond, now)
+	r.Record(req, xtime.Millisecond, now)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["ingest-latency.dropped+"].Value())
+
+	r.Close()
+	r.Record(req, xtime.Millisecond, now)
+	require.Equal(t, int64(2), scope.Snapshot().Counters()["ingest-latency.dropped+"].Value())
+	require.Equal(t, int64(0), numRecordedDurations(scope))
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/cespare/xxhash/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLabelSamplerInterval  = time.Minute
+	defaultLabelSamplerTopK      = 10
+	defaultLabelSamplerMaxLabels = 256
+
+	// labelSamplerBits is the number of bits used to count the distinct
+	// values of each label, i.e. 8KiB per tracked label. Counts saturate at
+	// roughly 700k distinct values per interval.
+	labelSamplerBits  = 1 << 16
+	labelSamplerWords = labelSamplerBits / 64
+)
+
+// labelCardinality is the approximate number of distinct values of a label
+// seen within a sampling interval.
+type labelCardinality struct {
+	name   string
+	values int
+	// growth is the change in distinct values since the previous interval.
+	growth int
+}
+
+// labelSampler approximates the number of distinct values of each label name
+// written within an interval using linear counting, so that the label names
+// with the fastest growing cardinality can be logged periodically. Memory
+// use is bounded by tracking a fixed size bitmap for at most a max number of
+// label names, label names beyond the max are not tracked until the next
+// interval.
+type labelSampler struct {
+	sync.Mutex
+
+	topK      int
+	maxLabels int
+	logger    *zap.Logger
+	labels    map[string]*[labelSamplerWords]uint64
+	previous  map[string]int
+	free      []*[labelSamplerWords]uint64
+	untracked int
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	closed    sync.WaitGroup
+}
+
+func newLabelSampler(
+	cfg config.PromRemoteWriteLabelSamplerConfiguration,
+	logger *zap.Logger,
+) *labelSampler {
+	topK := defaultLabelSamplerTopK
+	if v := cfg.TopK; v > 0 {
+		topK = v
+	}
+	maxLabels := defaultLabelSamplerMaxLabels
+	if v := cfg.MaxLabels; v > 0 {
+		maxLabels = v
+	}
+	return &labelSampler{
+		topK:      topK,
+		maxLabels: maxLabels,
+		logger:    logger,
+		labels:    make(map[string]*[labelSamplerWords]uint64),
+		previous:  make(map[string]int),
+		closeCh:   make(chan struct{}),
+	}
+}
+
+// Start begins logging the top label cardinalities every interval.
+func (s *labelSampler) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultLabelSamplerInterval
+	}
+	s.closed.Add(1)
+	go s.logEvery(interval)
+}
+
+// Close stops logging and waits for the background goroutine to exit, it
+// is safe to call more than once.
+func (s *labelSampler) Close() {
+	s.closeOnce.Do(func() { close(s.closeCh) })
+	s.closed.Wait()
+}
+
+// Observe records the label values of a series.
+func (s *labelSampler) Observe(labels []prompb.Label) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, label := range labels {
+		// The string conversion does not allocate for the map lookup.
+		bitmap, ok := s.labels[string(label.Name)]
+		if !ok {
+			if len(s.labels) >= s.maxLabels {
+				s.untracked++
+				continue
+			}
+			bitmap = s.newBitmapWithLock()
+			s.labels[string(label.Name)] = bitmap
+		}
+		bit := xxhash.Sum64(label.Value) % labelSamplerBits
+		bitmap[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (s *labelSampler) newBitmapWithLock() *[labelSamplerWords]uint64 {
+	if n := len(s.free); n > 0 {
+		bitmap := s.free[n-1]
+		s.free = s.free[:n-1]
+		return bitmap
+	}
+	return new([labelSamplerWords]uint64)
+}
+
+func (s *labelSampler) logEvery(interval time.Duration) {
+	defer s.closed.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closeCh:
+			return
+		}
+
+		top, untracked := s.sample()
+		for _, label := range top {
+			s.logger.Info("label cardinality",
+				zap.String("label", label.name),
+				zap.Int("distinctValues", label.values),
+				zap.Int("growth", label.growth))
+		}
+		if untracked > 0 {
+			s.logger.Info("label cardinality sampler labels untracked",
+				zap.Int("maxLabels", s.maxLabels),
+				zap.Int("untrackedObservations", untracked))
+		}
+	}
+}
+
+// sample returns the top-K label names ordered by the growth of their
+// distinct values since the previous interval, along with the number of
+// label observations that were not tracked, and starts a new interval.
+func (s *labelSampler) sample() ([]labelCardinality, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		all      = make([]labelCardinality, 0, len(s.labels))
+		previous = make(map[string]int, len(s.labels))
+	)
+	for name, bitmap := range s.labels {
+		values := estimateDistinct(bitmap)
+		all = append(all, labelCardinality{
+			name:   name,
+			values: values,
+			growth: values - s.previous[name],
+		})
+		previous[name] = values
+
+		// Labels are only tracked again once they are next observed so
+		// that labels no longer written do not use memory.
+		*bitmap = [labelSamplerWords]uint64{}
+		s.free = append(s.free, bitmap)
+		delete(s.labels, name)
+	}
+	untracked := s.untracked
+	s.previous = previous
+	s.untracked = 0
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].growth != all[j].growth {
+			return all[i].growth > all[j].growth
+		}
+		return all[i].name < all[j].name
+	})
+	if len(all) > s.topK {
+		all = all[:s.topK]
+	}
+	return all, untracked
+}
+
+// estimateDistinct returns the linear counting estimate of the number of
+// distinct values recorded in the bitmap.
+func estimateDistinct(bitmap *[labelSamplerWords]uint64) int {
+	var set int
+	for _, word := range bitmap {
+		set += bits.OnesCount64(word)
+	}
+	unset := labelSamplerBits - set
+	if unset == 0 {
+		// Saturated, so return the max that can be estimated.
+		unset = 1
+	}
+	return int(math.Round(labelSamplerBits * math.Log(float64(labelSamplerBits)/float64(unset))))
+}
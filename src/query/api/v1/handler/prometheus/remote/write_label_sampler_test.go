@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xclock "github.com/m3db/m3/src/x/clock"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func observeLabelValues(s *labelSampler, name string, numValues int) {
+	for i := 0; i < numValues; i++ {
+		s.Observe([]prompb.Label{
+			{Name: []byte(name), Value: []byte(fmt.Sprintf("value-%d", i))},
+		})
+	}
+}
+
+func TestLabelSamplerTopK(t *testing.T) {
+	s := newLabelSampler(config.PromRemoteWriteLabelSamplerConfiguration{
+		TopK: 2,
+	}, zap.NewNop())
+
+	observeLabelValues(s, "job", 10)
+	observeLabelValues(s, "instance", 100)
+	observeLabelValues(s, "request_id", 1000)
+
+	top, untracked := s.sample()
+	require.Equal(t, 0, untracked)
+	require.Len(t, top, 2)
+	require.Equal(t, "request_id", top[0].name)
+	require.InEpsilon(t, 1000, top[0].values, 0.05)
+	require.Equal(t, top[0].values, top[0].growth)
+	require.Equal(t, "instance", top[1].name)
+	require.InEpsilon(t, 100, top[1].values, 0.05)
+
+	// Growth is relative to the previous interval.
+	observeLabelValues(s, "job", 500)
+	observeLabelValues(s, "instance", 100)
+	observeLabelValues(s, "request_id", 1000)
+
+	top, _ = s.sample()
+	require.Len(t, top, 2)
+	require.Equal(t, "job", top[0].name)
+	require.InEpsilon(t, 490, top[0].growth, 0.05)
+}
+
+func TestLabelSamplerMaxLabels(t *testing.T) {
+	s := newLabelSampler(config.PromRemoteWriteLabelSamplerConfiguration{
+		MaxLabels: 2,
+	}, zap.NewNop())
+
+	observeLabelValues(s, "a", 1)
+	observeLabelValues(s, "b", 1)
+	observeLabelValues(s, "c", 3)
+	require.Len(t, s.labels, 2)
+
+	top, untracked := s.sample()
+	require.Len(t, top, 2)
+	require.Equal(t, 3, untracked)
+
+	// Labels are tracked afresh each interval.
+	require.Len(t, s.labels, 0)
+	observeLabelValues(s, "c", 1)
+	top, untracked = s.sample()
+	require.Len(t, top, 1)
+	require.Equal(t, "c", top[0].name)
+	require.Equal(t, 0, untracked)
+}
+
+func TestLabelSamplerLogs(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	s := newLabelSampler(config.PromRemoteWriteLabelSamplerConfiguration{},
+		zap.New(core))
+	observeLabelValues(s, "job", 1)
+
+	s.Start(10 * time.Millisecond)
+	defer s.Close()
+
+	require.True(t, xclock.WaitUntil(func() bool {
+		return logs.FilterMessage("label cardinality").Len() > 0
+	}, 5*time.Second))
+	entry := logs.FilterMessage("label cardinality").All()[0]
+	require.Equal(t, "job", entry.ContextMap()["label"])
+}
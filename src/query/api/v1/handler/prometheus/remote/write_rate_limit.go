@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/x/clock"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultRateLimitMaxClients = 10000
+
+	// rateLimitDefaultClient is the client tag used for the rejection
+	// metrics of clients without a specific limit, to bound the number of
+	// metrics emitted.
+	rateLimitDefaultClient = "default"
+)
+
+var errRateLimitExceeded = xhttp.NewError(
+	errors.New("rate limit exceeded: too many samples written"),
+	http.StatusTooManyRequests)
+
+// clientRateLimiter applies a token bucket limit of samples written to each
+// client. Since the number of samples is only known once a request has been
+// decoded, a request is admitted as long as the client has not exhausted its
+// tokens and the samples are charged afterwards, which may leave the client
+// in debt until enough tokens are replenished.
+type clientRateLimiter struct {
+	sync.Mutex
+
+	defaultLimit config.PromRemoteWriteClientRateLimitConfiguration
+	limits       map[string]config.PromRemoteWriteClientRateLimitConfiguration
+	clientHeader string
+	maxClients   int
+	nowFn        clock.NowFn
+	rejected     map[string]tally.Counter
+
+	// buckets are the token buckets of recently seen clients, ordered from
+	// most to least recently seen in lru.
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	client     string
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastUpdate time.Time
+}
+
+func newClientRateLimiter(
+	cfg config.PromRemoteWriteRateLimitConfiguration,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) *clientRateLimiter {
+	maxClients := defaultRateLimitMaxClients
+	if v := cfg.MaxClients; v > 0 {
+		maxClients = v
+	}
+
+	scope = scope.SubScope("rate-limit")
+	rejected := make(map[string]tally.Counter, len(cfg.Clients)+1)
+	rejected[rateLimitDefaultClient] = scope.
+		Tagged(map[string]string{"client": rateLimitDefaultClient}).
+		Counter("rejected")
+	for client := range cfg.Clients {
+		rejected[client] = scope.
+			Tagged(map[string]string{"client": client}).
+			Counter("rejected")
+	}
+
+	return &clientRateLimiter{
+		defaultLimit: cfg.Default,
+		limits:       cfg.Clients,
+		clientHeader: cfg.ClientHeader,
+		maxClients:   maxClients,
+		nowFn:        nowFn,
+		rejected:     rejected,
+		buckets:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// Client returns the identifier of the client that made the request.
+func (l *clientRateLimiter) Client(r *http.Request) string {
+	return requestClient(r, l.clientHeader)
+}
+
+// requestClient returns the value of the client header of the request if
+// set, or otherwise the host of the remote address of the request.
+func requestClient(r *http.Request, clientHeader string) string {
+	if clientHeader != "" {
+		if v := strings.TrimSpace(r.Header.Get(clientHeader)); v != "" {
+			return v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Admit returns an error if the client has exhausted its tokens along with
+// the duration after which it will have tokens again.
+func (l *clientRateLimiter) Admit(client string) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	bucket, ok := l.bucketWithLock(client)
+	if !ok || bucket.tokens > 0 {
+		return 0, nil
+	}
+
+	counter, ok := l.rejected[client]
+	if !ok {
+		counter = l.rejected[rateLimitDefaultClient]
+	}
+	counter.Inc(1)
+
+	wait := time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	return wait, errRateLimitExceeded
+}
+
+// Charge consumes tokens for the samples written by the client.
+func (l *clientRateLimiter) Charge(client string, samples int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if bucket, ok := l.bucketWithLock(client); ok {
+		bucket.tokens -= float64(samples)
+	}
+}
+
+// bucketWithLock returns the replenished token bucket for the client, the
+// result is false if the client is not limited.
+func (l *clientRateLimiter) bucketWithLock(client string) (*tokenBucket, bool) {
+	now := l.nowFn()
+	if elem, ok := l.buckets[client]; ok {
+		l.lru.MoveToFront(elem)
+		bucket := elem.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.lastUpdate).Seconds()
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+		bucket.lastUpdate = now
+		return bucket, true
+	}
+
+	limit, ok := l.limits[client]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	if limit.SamplesPerSecond <= 0 {
+		return nil, false
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.SamplesPerSecond
+	}
+	bucket := &tokenBucket{
+		client:     client,
+		rate:       limit.SamplesPerSecond,
+		burst:      burst,
+		tokens:     burst,
+		lastUpdate: now,
+	}
+	l.buckets[client] = l.lru.PushFront(bucket)
+
+	for l.lru.Len() > l.maxClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*tokenBucket).client)
+	}
+	return bucket, true
+}
+
+// writeRetryAfter sets the Retry-After header to the wait rounded up to
+// whole seconds.
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set(xhttp.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	now := time.Now()
+	nowFn := func() time.Time { return now }
+	limiter := newClientRateLimiter(config.PromRemoteWriteRateLimitConfiguration{
+		Default: config.PromRemoteWriteClientRateLimitConfiguration{
+			SamplesPerSecond: 10,
+		},
+		Clients: map[string]config.PromRemoteWriteClientRateLimitConfiguration{
+			"big":       {SamplesPerSecond: 100, Burst: 200},
+			"unlimited": {},
+		},
+	}, nowFn, tally.NoopScope)
+
+	// A client is admitted until it exhausts its tokens.
+	_, err := limiter.Admit("small")
+	require.NoError(t, err)
+	limiter.Charge("small", 15)
+	wait, err := limiter.Admit("small")
+	require.Error(t, err)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Tokens are replenished over time.
+	now = now.Add(time.Second)
+	_, err = limiter.Admit("small")
+	require.NoError(t, err)
+
+	// Clients have independent limits.
+	limiter.Charge("big", 150)
+	_, err = limiter.Admit("big")
+	require.NoError(t, err)
+	limiter.Charge("big", 50)
+	_, err = limiter.Admit("big")
+	require.Error(t, err)
+
+	limiter.Charge("unlimited", 1000000)
+	_, err = limiter.Admit("unlimited")
+	require.NoError(t, err)
+}
+
+func TestClientRateLimiterEvictsClients(t *testing.T) {
+	limiter := newClientRateLimiter(config.PromRemoteWriteRateLimitConfiguration{
+		Default: config.PromRemoteWriteClientRateLimitConfiguration{
+			SamplesPerSecond: 10,
+		},
+		MaxClients: 2,
+	}, time.Now, tally.NoopScope)
+
+	for _, client := range []string{"a", "b", "c"} {
+		_, err := limiter.Admit(client)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, limiter.lru.Len())
+	_, ok := limiter.buckets["a"]
+	require.False(t, ok)
+}
+
+func TestClientRateLimiterClient(t *testing.T) {
+	limiter := newClientRateLimiter(config.PromRemoteWriteRateLimitConfiguration{
+		ClientHeader: "X-Scope-OrgID",
+	}, time.Now, tally.NoopScope)
+
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", limiter.Client(req))
+
+	req.Header.Set("X-Scope-OrgID", "tenant")
+	assert.Equal(t, "tenant", limiter.Client(req))
+}
+
+func TestPromWriteRateLimit(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				RateLimit: config.PromRemoteWriteRateLimitConfiguration{
+					Default: config.PromRemoteWriteClientRateLimitConfiguration{
+						SamplesPerSecond: 0.5,
+						Burst:            1,
+					},
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		resp := writer.Result()
+		require.Equal(t, expected, resp.StatusCode)
+		if expected == http.StatusTooManyRequests {
+			// The 4 samples written leave the client 3 samples in debt.
+			assert.Equal(t, "6", resp.Header.Get(xhttp.HeaderRetryAfter))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/uber-go/tally"
+)
+
+// requiredLabels rejects series that are missing any of a set of labels.
+type requiredLabels struct {
+	names   [][]byte
+	missing []tally.Counter
+}
+
+func newRequiredLabels(names []string, scope tally.Scope) *requiredLabels {
+	r := &requiredLabels{
+		names:   make([][]byte, 0, len(names)),
+		missing: make([]tally.Counter, 0, len(names)),
+	}
+	for _, name := range names {
+		r.names = append(r.names, []byte(name))
+		r.missing = append(r.missing, scope.SubScope("required-labels").
+			Tagged(map[string]string{"label": name}).
+			Counter("missing"))
+	}
+	return r
+}
+
+// Check sorts the labels of each series by name and returns an error naming
+// the first required label that is missing from a series.
+func (r *requiredLabels) Check(req *prompb.WriteRequest) error {
+	for i := range req.Timeseries {
+		labels := req.Timeseries[i].Labels
+		if !sort.SliceIsSorted(labels, func(i, j int) bool {
+			return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+		}) {
+			sort.Slice(labels, func(i, j int) bool {
+				return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+			})
+		}
+
+		for j, name := range r.names {
+			idx := sort.Search(len(labels), func(k int) bool {
+				return bytes.Compare(labels[k].Name, name) >= 0
+			})
+			if idx < len(labels) && bytes.Equal(labels[idx].Name, name) {
+				continue
+			}
+			r.missing[j].Inc(1)
+			return fmt.Errorf("series %d is missing required label: %s", i, name)
+		}
+	}
+	return nil
+}
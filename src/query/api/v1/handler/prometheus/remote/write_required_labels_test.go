@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestRequiredLabelsCheck(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	r := newRequiredLabels([]string{"tenant", "cluster"}, scope)
+
+	req := test.NewWriteRequest(
+		test.NewSeries("", "tenant", "a", "__name__", "up", "cluster", "b"),
+		test.NewSeries("", "tenant", "a", "__name__", "up"),
+	)
+	require.EqualError(t, r.Check(req), "series 1 is missing required label: cluster")
+
+	// The labels of the checked series are sorted.
+	var names []string
+	for _, l := range req.Timeseries[0].Labels {
+		names = append(names, string(l.Name))
+	}
+	require.Equal(t, []string{"__name__", "cluster", "tenant"}, names)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["required-labels.missing+label=cluster"].Value())
+	require.Equal(t, int64(0), counters["required-labels.missing+label=tenant"].Value())
+
+	req.Timeseries = req.Timeseries[:1]
+	require.NoError(t, r.Check(req))
+}
+
+func TestPromWriteRequiredLabels(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				RequiredLabels: []string{"tenant"},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.NewWriteRequest(
+		test.NewSeries("up"),
+	)
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "missing required label: tenant")
+}
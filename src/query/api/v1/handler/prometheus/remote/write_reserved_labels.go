@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/uber-go/tally"
+)
+
+var defaultReservedLabelPrefixes = []string{"__"}
+
+// reservedLabels rejects or strips client supplied labels with names that
+// have a reserved prefix, other than the allowed labels that clients may set
+// such as the metric name labels.
+type reservedLabels struct {
+	mode     config.ReservedLabelMode
+	prefixes [][]byte
+	allowed  [][]byte
+	found    tally.Counter
+}
+
+func newReservedLabels(
+	cfg config.PromRemoteWriteReservedLabelsConfiguration,
+	allowed [][]byte,
+	scope tally.Scope,
+) *reservedLabels {
+	prefixes := cfg.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = defaultReservedLabelPrefixes
+	}
+	r := &reservedLabels{
+		mode:     cfg.Mode,
+		prefixes: make([][]byte, 0, len(prefixes)),
+		allowed:  allowed,
+		found:    scope.SubScope("write").Counter("reserved-labels"),
+	}
+	for _, prefix := range prefixes {
+		r.prefixes = append(r.prefixes, []byte(prefix))
+	}
+	return r
+}
+
+func (r *reservedLabels) isReserved(name []byte) bool {
+	for _, allowed := range r.allowed {
+		if bytes.Equal(name, allowed) {
+			return false
+		}
+	}
+	for _, prefix := range r.prefixes {
+		if bytes.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check rejects the request if any series has a reserved label, or in strip
+// mode removes the reserved labels from the series and sorts the remaining
+// labels by name.
+func (r *reservedLabels) Check(req *prompb.WriteRequest) error {
+	var numReserved int
+	for i := range req.Timeseries {
+		s := &req.Timeseries[i]
+		var reserved int
+		for _, label := range s.Labels {
+			if !r.isReserved(label.Name) {
+				continue
+			}
+			reserved++
+			if r.mode == config.ReservedLabelReject {
+				r.found.Inc(int64(numReserved + reserved))
+				return fmt.Errorf("series %d has reserved label: %s", i, label.Name)
+			}
+		}
+		numReserved += reserved
+		if reserved == 0 {
+			continue
+		}
+
+		labels := make([]prompb.Label, 0, len(s.Labels)-reserved)
+		for _, label := range s.Labels {
+			if !r.isReserved(label.Name) {
+				labels = append(labels, label)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+		})
+		s.Labels = labels
+	}
+	r.found.Inc(int64(numReserved))
+	return nil
+}
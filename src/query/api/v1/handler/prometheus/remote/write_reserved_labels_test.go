@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestReservedLabelsStrip(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	r := newReservedLabels(config.PromRemoteWriteReservedLabelsConfiguration{
+		Mode: config.ReservedLabelStrip,
+	}, [][]byte{metricNameLabel, []byte("__allowed__")}, scope)
+
+	req := test.NewWriteRequest(
+		test.NewSeries("", "job", "a", "__name__", "up", "__internal__", "x",
+			"__allowed__", "y", "__m3_type__", "z"),
+		test.NewSeries("up", "job", "b"),
+	)
+	require.NoError(t, r.Check(req))
+
+	// The reserved labels are removed and the remaining labels sorted.
+	require.Equal(t, []prompb.TimeSeries{
+		test.NewSeries("", "__allowed__", "y", "__name__", "up", "job", "a"),
+		test.NewSeries("up", "job", "b"),
+	}, req.Timeseries)
+	require.Equal(t, int64(2), scope.Snapshot().Counters()["write.reserved-labels+"].Value())
+}
+
+func TestReservedLabelsPrefixes(t *testing.T) {
+	r := newReservedLabels(config.PromRemoteWriteReservedLabelsConfiguration{
+		Mode:     config.ReservedLabelReject,
+		Prefixes: []string{"m3_"},
+	}, [][]byte{metricNameLabel}, tally.NoopScope)
+
+	req := test.NewWriteRequest(
+		test.NewSeries("up", "__other__", "a"),
+		test.NewSeries("up", "m3_id", "a"),
+	)
+	require.EqualError(t, r.Check(req), "series 1 has reserved label: m3_id")
+}
+
+func TestPromWriteReservedLabels(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				ReservedLabels: config.PromRemoteWriteReservedLabelsConfiguration{
+					Mode: config.ReservedLabelReject,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.NewWriteRequest(
+		test.NewSeries("up", "__m3_metrics_type__", "aggregated"),
+	)
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "reserved label: __m3_metrics_type__")
+}
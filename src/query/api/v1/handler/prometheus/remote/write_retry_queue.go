@@ -0,0 +1,342 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+	xerrors "github.com/m3db/m3/src/x/errors"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultRetryQueueMaxSeries      = 100000
+	defaultRetryQueueTTL            = 5 * time.Minute
+	defaultRetryQueueInitialBackoff = time.Second
+	defaultRetryQueueMaxBackoff     = 30 * time.Second
+)
+
+// retryWriteFn writes a batch of series that is being retried.
+type retryWriteFn func(
+	series []prompb.TimeSeries,
+	opts ingest.WriteOptions,
+	unit xtime.Unit,
+) ingest.BatchError
+
+// retryBatch is a batch of series queued to be retried.
+type retryBatch struct {
+	series  []prompb.TimeSeries
+	opts    ingest.WriteOptions
+	unit    xtime.Unit
+	expires time.Time
+	next    time.Time
+	backoff time.Duration
+	// done if not nil is called once the batch is written or dropped.
+	done func()
+}
+
+// writeRetryQueue retries batches that failed to be written with retryable
+// errors in the background with an exponential backoff, until they are
+// written or their TTL expires. The queue is bounded by the number of series
+// it holds and the oldest batches are dropped to make room for new ones.
+type writeRetryQueue struct {
+	sync.Mutex
+
+	maxSeries      int
+	ttl            time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	nowFn          clock.NowFn
+	writeFn        retryWriteFn
+	batches        []*retryBatch
+	numSeries      int
+	closed         chan struct{}
+	closeOnce      sync.Once
+	worker         sync.WaitGroup
+	metrics        writeRetryQueueMetrics
+}
+
+type writeRetryQueueMetrics struct {
+	enqueued tally.Counter
+	success  tally.Counter
+	errors   tally.Counter
+	dropped  tally.Counter
+	expired  tally.Counter
+	series   tally.Gauge
+}
+
+func newWriteRetryQueue(
+	cfg config.PromRemoteWriteRetryQueueConfiguration,
+	nowFn clock.NowFn,
+	writeFn retryWriteFn,
+	scope tally.Scope,
+) *writeRetryQueue {
+	maxSeries := defaultRetryQueueMaxSeries
+	if v := cfg.MaxSeries; v > 0 {
+		maxSeries = v
+	}
+	ttl := defaultRetryQueueTTL
+	if v := cfg.TTL; v > 0 {
+		ttl = v
+	}
+	initialBackoff := defaultRetryQueueInitialBackoff
+	if v := cfg.InitialBackoff; v > 0 {
+		initialBackoff = v
+	}
+	maxBackoff := defaultRetryQueueMaxBackoff
+	if v := cfg.MaxBackoff; v > 0 {
+		maxBackoff = v
+	}
+	scope = scope.SubScope("retry-queue")
+	return &writeRetryQueue{
+		maxSeries:      maxSeries,
+		ttl:            ttl,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		nowFn:          nowFn,
+		writeFn:        writeFn,
+		closed:         make(chan struct{}),
+		metrics: writeRetryQueueMetrics{
+			enqueued: scope.Counter("enqueued"),
+			success:  scope.Counter("success"),
+			errors:   scope.Counter("errors"),
+			dropped:  scope.Counter("dropped"),
+			expired:  scope.Counter("expired"),
+			series:   scope.Gauge("series"),
+		},
+	}
+}
+
+// Start starts retrying queued batches in the background.
+func (q *writeRetryQueue) Start() {
+	q.worker.Add(1)
+	go func() {
+		defer q.worker.Done()
+
+		ticker := time.NewTicker(q.initialBackoff)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.closed:
+				return
+			case <-ticker.C:
+				q.retryDue()
+			}
+		}
+	}()
+}
+
+// Close stops retrying queued batches, batches that are still queued are
+// dropped without calling their done function so that they are replayed if
+// they were persisted to the write ahead log. It is safe to call Close more
+// than once.
+func (q *writeRetryQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+	q.worker.Wait()
+}
+
+// AddFailed queues the series of the request that failed to be written to be
+// retried and returns true, or returns false if any of the errors are not
+// retryable or the series do not fit in the queue. If not nil, done is called
+// once the queued series are written or dropped.
+func (q *writeRetryQueue) AddFailed(
+	req *prompb.WriteRequest,
+	batchErr ingest.BatchError,
+	opts ingest.WriteOptions,
+	unit xtime.Unit,
+	done func(),
+) bool {
+	series, ok := retryableSeries(req, batchErr)
+	if !ok || len(series) > q.maxSeries {
+		return false
+	}
+
+	now := q.nowFn()
+	batch := &retryBatch{
+		series:  series,
+		opts:    storageRetryWriteOptions(opts),
+		unit:    unit,
+		expires: now.Add(q.ttl),
+		next:    now.Add(q.initialBackoff),
+		backoff: q.initialBackoff,
+		done:    done,
+	}
+
+	var dropped []*retryBatch
+	q.Lock()
+	for len(q.batches) > 0 && q.numSeries+len(series) > q.maxSeries {
+		dropped = append(dropped, q.batches[0])
+		q.numSeries -= len(q.batches[0].series)
+		q.batches = q.batches[1:]
+	}
+	q.batches = append(q.batches, batch)
+	q.numSeries += len(series)
+	numSeries := q.numSeries
+	q.Unlock()
+
+	q.metrics.enqueued.Inc(1)
+	q.metrics.dropped.Inc(int64(len(dropped)))
+	q.metrics.series.Update(float64(numSeries))
+	for _, b := range dropped {
+		b.finish()
+	}
+	return true
+}
+
+// retryDue retries the queued batches that are due to be retried.
+func (q *writeRetryQueue) retryDue() {
+	now := q.nowFn()
+
+	q.Lock()
+	var (
+		due     []*retryBatch
+		pending = q.batches[:0]
+	)
+	for _, b := range q.batches {
+		if !now.Before(b.next) {
+			due = append(due, b)
+			q.numSeries -= len(b.series)
+			continue
+		}
+		pending = append(pending, b)
+	}
+	q.batches = pending
+	q.Unlock()
+
+	for _, b := range due {
+		batchErr := q.writeFn(b.series, b.opts, b.unit)
+		if batchErr == nil {
+			q.metrics.success.Inc(1)
+			b.finish()
+			continue
+		}
+
+		q.metrics.errors.Inc(1)
+		series, ok := retryableSeries(&prompb.WriteRequest{Timeseries: b.series}, batchErr)
+		now = q.nowFn()
+		if !ok || !now.Before(b.expires) {
+			if ok {
+				q.metrics.expired.Inc(1)
+			} else {
+				q.metrics.dropped.Inc(1)
+			}
+			b.finish()
+			continue
+		}
+
+		b.series = series
+		b.backoff *= 2
+		if b.backoff > q.maxBackoff {
+			b.backoff = q.maxBackoff
+		}
+		b.next = now.Add(b.backoff)
+
+		// Requeue at the back so that the oldest batches are dropped first
+		// if the queue fills up.
+		q.Lock()
+		q.batches = append(q.batches, b)
+		q.numSeries += len(b.series)
+		q.Unlock()
+	}
+
+	q.Lock()
+	numSeries := q.numSeries
+	q.Unlock()
+	q.metrics.series.Update(float64(numSeries))
+}
+
+func (b *retryBatch) finish() {
+	if b.done != nil {
+		b.done()
+	}
+}
+
+// retryableSeries returns the series of the request that failed to be
+// written to storage, or all of the series if the errors are not for specific
+// series, and returns false if any of the errors are not retryable or if the
+// only errors are for writes to the downsampler. Writes to the downsampler
+// are not retried since the series that were written to it would be
+// aggregated again, and the downsampler is in process so is not expected to
+// recover in the way that storage may.
+func retryableSeries(
+	req *prompb.WriteRequest,
+	batchErr ingest.BatchError,
+) ([]prompb.TimeSeries, bool) {
+	var (
+		errs        = batchErr.Errors()
+		failed      = make(map[int]struct{}, len(errs))
+		allFailed   bool
+		numRetrying int
+	)
+	for _, err := range errs {
+		if isBadRequestWriteError(err) {
+			return nil, false
+		}
+		if ingest.IsAggregatedError(err) {
+			continue
+		}
+		numRetrying++
+		index, ok := ingest.SeriesErrorIndex(err)
+		if !ok {
+			allFailed = true
+			continue
+		}
+		failed[index] = struct{}{}
+	}
+	if numRetrying == 0 {
+		return nil, false
+	}
+	if allFailed || len(failed) == len(req.Timeseries) {
+		return req.Timeseries, true
+	}
+	series := make([]prompb.TimeSeries, 0, len(failed))
+	for idx, s := range req.Timeseries {
+		if _, ok := failed[idx]; ok {
+			series = append(series, s)
+		}
+	}
+	return series, true
+}
+
+// storageRetryWriteOptions returns the write options used to retry a write,
+// which disable downsampling so that only the write to storage is retried.
+func storageRetryWriteOptions(opts ingest.WriteOptions) ingest.WriteOptions {
+	// Overriding the mapping rules with no rules disables downsampling.
+	opts.DownsampleOverride = true
+	opts.DownsampleMappingRules = nil
+	return opts
+}
+
+// isBadRequestWriteError returns true if the write error is caused by the
+// request rather than by storage, such errors are not worth retrying.
+func isBadRequestWriteError(err error) bool {
+	return client.IsBadRequestError(err) || xerrors.IsInvalidParams(err)
+}
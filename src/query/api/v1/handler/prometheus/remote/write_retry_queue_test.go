@@ -0,0 +1,241 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xclock "github.com/m3db/m3/src/x/clock"
+	xerrors "github.com/m3db/m3/src/x/errors"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+type retryQueueTestWriter struct {
+	errs    []ingest.BatchError
+	written [][]prompb.TimeSeries
+	opts    []ingest.WriteOptions
+}
+
+func (w *retryQueueTestWriter) write(
+	series []prompb.TimeSeries,
+	opts ingest.WriteOptions,
+	_ xtime.Unit,
+) ingest.BatchError {
+	w.written = append(w.written, series)
+	w.opts = append(w.opts, opts)
+	if len(w.errs) == 0 {
+		return nil
+	}
+	err := w.errs[0]
+	w.errs = w.errs[1:]
+	return err
+}
+
+func seriesBatchError(errs ...error) ingest.BatchError {
+	multiErr := xerrors.NewMultiError()
+	for _, err := range errs {
+		multiErr = multiErr.Add(err)
+	}
+	return multiErr
+}
+
+func TestWriteRetryQueueRetries(t *testing.T) {
+	now := time.Unix(0, 0)
+	nowFn := func() time.Time { return now }
+
+	writer := &retryQueueTestWriter{
+		errs: []ingest.BatchError{
+			seriesBatchError(ingest.NewSeriesError(errors.New("unavailable"), 0)),
+		},
+	}
+	q := newWriteRetryQueue(config.PromRemoteWriteRetryQueueConfiguration{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second,
+	}, nowFn, writer.write, tally.NoopScope)
+
+	var done int
+	req := test.NewWriteRequest(test.NamedSeries("a", "b")...)
+	batchErr := seriesBatchError(ingest.NewSeriesError(errors.New("unavailable"), 1))
+	require.True(t, q.AddFailed(req, batchErr, ingest.WriteOptions{}, xtime.Millisecond,
+		func() { done++ }))
+
+	// Nothing is retried before the backoff has elapsed.
+	q.retryDue()
+	require.Len(t, writer.written, 0)
+
+	// Only the failed series is retried, it fails again and is retried after
+	// the max backoff.
+	now = now.Add(time.Second)
+	q.retryDue()
+	require.Len(t, writer.written, 1)
+	require.Equal(t, req.Timeseries[1:], writer.written[0])
+	require.Equal(t, 0, done)
+	// Only the write to storage is retried.
+	require.True(t, writer.opts[0].DownsampleOverride)
+	require.Len(t, writer.opts[0].DownsampleMappingRules, 0)
+
+	now = now.Add(time.Second)
+	q.retryDue()
+	require.Len(t, writer.written, 2)
+	require.Equal(t, 1, done)
+
+	now = now.Add(time.Minute)
+	q.retryDue()
+	require.Len(t, writer.written, 2)
+}
+
+func TestWriteRetryQueueNotRetryable(t *testing.T) {
+	q := newWriteRetryQueue(config.PromRemoteWriteRetryQueueConfiguration{},
+		time.Now, (&retryQueueTestWriter{}).write, tally.NoopScope)
+
+	req := test.NewWriteRequest(test.NamedSeries("a")...)
+	batchErr := seriesBatchError(xerrors.NewInvalidParamsError(errors.New("bad")))
+	require.False(t, q.AddFailed(req, batchErr, ingest.WriteOptions{}, xtime.Millisecond, nil))
+}
+
+func TestWriteRetryQueueAggregatedErrors(t *testing.T) {
+	q := newWriteRetryQueue(config.PromRemoteWriteRetryQueueConfiguration{},
+		time.Now, (&retryQueueTestWriter{}).write, tally.NoopScope)
+
+	// Writes that only failed to be written to the downsampler are not
+	// retried.
+	req := test.NewWriteRequest(test.NamedSeries("a", "b")...)
+	batchErr := seriesBatchError(ingest.NewAggregatedError(
+		ingest.NewSeriesError(errors.New("unavailable"), 0)))
+	require.False(t, q.AddFailed(req, batchErr, ingest.WriteOptions{}, xtime.Millisecond, nil))
+
+	// Only the series that failed to be written to storage are retried.
+	batchErr = seriesBatchError(
+		ingest.NewAggregatedError(ingest.NewSeriesError(errors.New("unavailable"), 0)),
+		ingest.NewSeriesError(errors.New("unavailable"), 1))
+	series, ok := retryableSeries(req, batchErr)
+	require.True(t, ok)
+	require.Equal(t, req.Timeseries[1:], series)
+}
+
+func TestWriteRetryQueueBounded(t *testing.T) {
+	now := time.Unix(0, 0)
+	nowFn := func() time.Time { return now }
+
+	scope := tally.NewTestScope("", nil)
+	writer := &retryQueueTestWriter{}
+	q := newWriteRetryQueue(config.PromRemoteWriteRetryQueueConfiguration{
+		MaxSeries: 2,
+		TTL:       time.Minute,
+	}, nowFn, writer.write, scope)
+
+	var done []string
+	add := func(names ...string) bool {
+		return q.AddFailed(test.NewWriteRequest(test.NamedSeries(names...)...),
+			seriesBatchError(errors.New("unavailable")), ingest.WriteOptions{},
+			xtime.Millisecond, func() { done = append(done, names[0]) })
+	}
+	require.True(t, add("a"))
+	require.True(t, add("b"))
+	require.False(t, add("c", "d", "e"))
+
+	// The oldest batch is dropped to make room.
+	require.True(t, add("f"))
+	require.Equal(t, []string{"a"}, done)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["retry-queue.dropped+"].Value())
+
+	// Batches that keep failing are dropped once expired.
+	writer.errs = []ingest.BatchError{
+		seriesBatchError(errors.New("unavailable")),
+		seriesBatchError(errors.New("unavailable")),
+	}
+	now = now.Add(2 * time.Minute)
+	q.retryDue()
+	require.Equal(t, []string{"a", "b", "f"}, done)
+	require.Equal(t, int64(2), scope.Snapshot().Counters()["retry-queue.expired+"].Value())
+}
+
+func TestPromWriteRetryQueue(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		mu      sync.Mutex
+		written int
+	)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	gomock.InOrder(
+		mockDownsamplerAndWriter.
+			EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(seriesBatchError(errors.New("unavailable"))),
+		mockDownsamplerAndWriter.
+			EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+				mu.Lock()
+				for iter.Next() {
+					written++
+				}
+				mu.Unlock()
+				return nil
+			}),
+	)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				RetryQueue: config.PromRemoteWriteRetryQueueConfiguration{
+					Enabled:        true,
+					InitialBackoff: 10 * time.Millisecond,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+
+	require.True(t, xclock.WaitUntil(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return written == len(promReq.Timeseries)
+	}, 5*time.Second))
+	require.NoError(t, handler.(*PromWriteHandler).Drain(context.Background()))
+
+	// Draining again after the handler is drained is a no-op.
+	require.NoError(t, handler.(*PromWriteHandler).Drain(context.Background()))
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+	xtime "github.com/m3db/m3/src/x/time"
+)
+
+const (
+	defaultSampleAgeFreshThreshold = time.Minute
+	defaultSampleAgeFreshTimeout   = 5 * time.Second
+	defaultSampleAgeStaleTimeout   = time.Minute
+)
+
+// sampleAgeDeadlines classifies series as fresh or stale by the age of their
+// newest sample and returns the deadline each is written with.
+type sampleAgeDeadlines struct {
+	freshThreshold time.Duration
+	freshTimeout   time.Duration
+	staleTimeout   time.Duration
+	nowFn          clock.NowFn
+}
+
+// newSampleAgeDeadlines returns the sample age deadlines for the config or
+// nil if they are not enabled.
+func newSampleAgeDeadlines(
+	cfg config.PromRemoteWriteSampleAgeDeadlinesConfiguration,
+	nowFn clock.NowFn,
+) *sampleAgeDeadlines {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	d := &sampleAgeDeadlines{
+		freshThreshold: defaultSampleAgeFreshThreshold,
+		freshTimeout:   defaultSampleAgeFreshTimeout,
+		staleTimeout:   defaultSampleAgeStaleTimeout,
+		nowFn:          nowFn,
+	}
+	if cfg.FreshThreshold > 0 {
+		d.freshThreshold = cfg.FreshThreshold
+	}
+	if cfg.FreshTimeout > 0 {
+		d.freshTimeout = cfg.FreshTimeout
+	}
+	if cfg.StaleTimeout > 0 {
+		d.staleTimeout = cfg.StaleTimeout
+	}
+	return d
+}
+
+// Stale returns whether the newest sample of the series is older than the
+// fresh threshold, series without samples are fresh.
+func (d *sampleAgeDeadlines) Stale(
+	series prompb.TimeSeries,
+	now time.Time,
+	unit xtime.Unit,
+) bool {
+	if len(series.Samples) == 0 {
+		return false
+	}
+
+	newest := series.Samples[0].Timestamp
+	for _, sample := range series.Samples[1:] {
+		if sample.Timestamp > newest {
+			newest = sample.Timestamp
+		}
+	}
+	return now.Sub(sampleTime(newest, unit)) >= d.freshThreshold
+}
+
+// Timeout returns the deadline that fresh or stale series are written with.
+func (d *sampleAgeDeadlines) Timeout(stale bool) time.Duration {
+	if stale {
+		return d.staleTimeout
+	}
+	return d.freshTimeout
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleAgeDeadlines(t *testing.T) {
+	require.Nil(t, newSampleAgeDeadlines(
+		config.PromRemoteWriteSampleAgeDeadlinesConfiguration{}, time.Now))
+
+	d := newSampleAgeDeadlines(config.PromRemoteWriteSampleAgeDeadlinesConfiguration{
+		Enabled:      true,
+		StaleTimeout: 2 * time.Minute,
+	}, time.Now)
+	require.NotNil(t, d)
+	require.Equal(t, defaultSampleAgeFreshTimeout, d.Timeout(false))
+	require.Equal(t, 2*time.Minute, d.Timeout(true))
+
+	now := time.Unix(1000, 0)
+	seriesAt := func(timestamps ...time.Time) prompb.TimeSeries {
+		var series prompb.TimeSeries
+		for _, ts := range timestamps {
+			series.Samples = append(series.Samples, prompb.Sample{
+				Timestamp: ts.UnixNano() / int64(time.Millisecond),
+			})
+		}
+		return series
+	}
+	require.False(t, d.Stale(prompb.TimeSeries{}, now, xtime.Millisecond))
+	require.False(t, d.Stale(seriesAt(now.Add(-time.Second)), now, xtime.Millisecond))
+	require.True(t, d.Stale(seriesAt(now.Add(-time.Hour)), now, xtime.Millisecond))
+	// The newest sample of the series decides its age.
+	require.False(t, d.Stale(seriesAt(now.Add(-time.Hour), now), now, xtime.Millisecond))
+}
+
+func TestPromWriteSampleAgeDeadlines(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	expectWrite := func(
+		mock *ingest.MockDownsamplerAndWriter,
+		timeout time.Duration,
+		numSeries int,
+	) {
+		mock.
+			EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+				deadline, ok := ctx.Deadline()
+				require.True(t, ok)
+				require.WithinDuration(t, time.Now().Add(timeout), deadline, 10*time.Second)
+
+				var n int
+				for iter.Next() {
+					n++
+				}
+				require.Equal(t, numSeries, n)
+				return nil
+			})
+	}
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	expectWrite(mockDownsamplerAndWriter, time.Second, 2)
+	expectWrite(mockDownsamplerAndWriter, time.Hour, 1)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				SampleAgeDeadlines: config.PromRemoteWriteSampleAgeDeadlinesConfiguration{
+					Enabled:      true,
+					FreshTimeout: time.Second,
+					StaleTimeout: time.Hour,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	series := func(name string, ts time.Time) prompb.TimeSeries {
+		return test.WithTimestamps(test.NewSeries(name, "job", "test"),
+			ts.UnixNano()/int64(time.Millisecond))
+	}
+	promReq := test.NewWriteRequest(
+		series("fresh_a", now),
+		series("stale", now.Add(-time.Hour)),
+		series("fresh_b", now.Add(-time.Second)),
+	)
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+}
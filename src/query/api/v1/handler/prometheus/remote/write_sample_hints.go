@@ -0,0 +1,202 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"sort"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/storage/m3/storagemetadata"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// samplePolicyHintField is the field of the Sample message that extends the
+// Prometheus sample with a storage policy hint, a string such as "1m:48h".
+const samplePolicyHintField protowire.Number = 100
+
+var aggregatedMetricsTypeValue = []byte(storagemetadata.AggregatedMetricsType.String())
+
+// samplePolicyHint is the storage policy hint of a sample of a series.
+type samplePolicyHint struct {
+	sample int
+	policy string
+}
+
+// decodeSamplePolicyHints returns the storage policy hints of the samples of
+// a write request keyed by the index of the series, series without any
+// hints are not included. The regular decoding ignores the hint field since
+// it is not part of the Prometheus schema.
+func decodeSamplePolicyHints(body []byte) (map[int][]samplePolicyHint, error) {
+	var (
+		hints     map[int][]samplePolicyHint
+		seriesIdx = -1
+	)
+	err := consumeMessageFields(body, func(num protowire.Number, series []byte) error {
+		if num != 1 {
+			return nil
+		}
+		seriesIdx++
+		sampleIdx := -1
+		return consumeMessageFields(series, func(num protowire.Number, sample []byte) error {
+			if num != 2 {
+				return nil
+			}
+			sampleIdx++
+			return consumeMessageFields(sample, func(num protowire.Number, v []byte) error {
+				if num != samplePolicyHintField || len(v) == 0 {
+					return nil
+				}
+				if hints == nil {
+					hints = make(map[int][]samplePolicyHint)
+				}
+				hints[seriesIdx] = append(hints[seriesIdx], samplePolicyHint{
+					sample: sampleIdx,
+					policy: string(v),
+				})
+				return nil
+			})
+		})
+	})
+	return hints, err
+}
+
+// consumeMessageFields calls the function with the value of each length
+// delimited field of the message, other fields are skipped.
+func consumeMessageFields(
+	b []byte,
+	fn func(num protowire.Number, v []byte) error,
+) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// applySamplePolicyHints moves the samples of each series with a storage
+// policy hint to a copy of the series for each hinted storage policy, the
+// copies are appended to the request with the reserved metrics type and
+// storage policy labels set so that they are written to the hinted policy.
+// Series left without any samples are removed from the request.
+func applySamplePolicyHints(
+	req *prompb.WriteRequest,
+	hints map[int][]samplePolicyHint,
+) error {
+	if len(hints) == 0 {
+		return nil
+	}
+
+	// Split the series in request order so that the copies are deterministic.
+	hinted := make([]int, 0, len(hints))
+	for idx := range hints {
+		if idx < len(req.Timeseries) {
+			hinted = append(hinted, idx)
+		}
+	}
+	sort.Ints(hinted)
+
+	var removed int
+	for _, idx := range hinted {
+		series := req.Timeseries[idx]
+		policies := make([]string, len(series.Samples))
+		for _, hint := range hints[idx] {
+			if hint.sample >= len(policies) {
+				continue
+			}
+			parsed, err := policy.ParseStoragePolicy(hint.policy)
+			if err != nil {
+				return StoragePolicyParseError{Policy: hint.policy, Err: err}
+			}
+			policies[hint.sample] = parsed.String()
+		}
+
+		var (
+			kept    = make([]prompb.Sample, 0, len(series.Samples))
+			byHint  = make(map[string]int)
+			copies  []prompb.TimeSeries
+			labelsN = len(series.Labels)
+		)
+		for i, sample := range series.Samples {
+			hint := policies[i]
+			if hint == "" {
+				kept = append(kept, sample)
+				continue
+			}
+			c, ok := byHint[hint]
+			if !ok {
+				labels := make([]prompb.Label, 0, labelsN+2)
+				labels = append(labels, series.Labels...)
+				labels = append(labels,
+					prompb.Label{Name: seriesMetricsTypeLabel, Value: aggregatedMetricsTypeValue},
+					prompb.Label{Name: seriesStoragePolicyLabel, Value: []byte(hint)})
+
+				copied := series
+				copied.Labels = labels
+				copied.Samples = nil
+				c = len(copies)
+				byHint[hint] = c
+				copies = append(copies, copied)
+			}
+			copies[c].Samples = append(copies[c].Samples, sample)
+		}
+
+		req.Timeseries[idx].Samples = kept
+		if len(kept) == 0 {
+			removed++
+		}
+		req.Timeseries = append(req.Timeseries, copies...)
+	}
+
+	if removed == 0 {
+		return nil
+	}
+	series := req.Timeseries[:0]
+	for _, s := range req.Timeseries {
+		if len(s.Samples) > 0 {
+			series = append(series, s)
+		}
+	}
+	req.Timeseries = series
+	return nil
+}
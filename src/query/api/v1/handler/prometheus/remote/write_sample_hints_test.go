@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// hintedWriteRequestBody returns the encoded request with the storage policy
+// hints, keyed by series then sample index, added to the samples.
+func hintedWriteRequestBody(
+	t *testing.T,
+	req *prompb.WriteRequest,
+	hints map[int]map[int]string,
+) []byte {
+	var body []byte
+	for i := range req.Timeseries {
+		series := req.Timeseries[i]
+		var seriesBytes []byte
+		for _, l := range series.Labels {
+			label, err := proto.Marshal(&l)
+			require.NoError(t, err)
+			seriesBytes = protowire.AppendTag(seriesBytes, 1, protowire.BytesType)
+			seriesBytes = protowire.AppendBytes(seriesBytes, label)
+		}
+		for j := range series.Samples {
+			sample, err := proto.Marshal(&series.Samples[j])
+			require.NoError(t, err)
+			if hint, ok := hints[i][j]; ok {
+				sample = protowire.AppendTag(sample, samplePolicyHintField, protowire.BytesType)
+				sample = protowire.AppendString(sample, hint)
+			}
+			seriesBytes = protowire.AppendTag(seriesBytes, 2, protowire.BytesType)
+			seriesBytes = protowire.AppendBytes(seriesBytes, sample)
+		}
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, seriesBytes)
+	}
+	return body
+}
+
+func TestApplySamplePolicyHints(t *testing.T) {
+	req := test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("mixed"), 1000, 2000, 3000),
+		test.WithTimestamps(test.NewSeries("plain"), 1000),
+		test.WithTimestamps(test.NewSeries("hinted"), 1000),
+	)
+	body := hintedWriteRequestBody(t, req, map[int]map[int]string{
+		0: {1: "1m:48h", 2: "10s:2d"},
+		2: {0: "1m:48h"},
+	})
+
+	var decoded prompb.WriteRequest
+	require.NoError(t, proto.Unmarshal(body, &decoded))
+	hints, err := decodeSamplePolicyHints(body)
+	require.NoError(t, err)
+	require.NoError(t, applySamplePolicyHints(&decoded, hints))
+
+	type written struct {
+		name       string
+		policy     string
+		timestamps []int64
+	}
+	value := func(labels []prompb.Label, name []byte) string {
+		v, _ := labelValue(labels, name)
+		return string(v)
+	}
+	var actual []written
+	for _, series := range decoded.Timeseries {
+		w := written{
+			name:   value(series.Labels, []byte("__name__")),
+			policy: value(series.Labels, seriesStoragePolicyLabel),
+		}
+		if w.policy != "" {
+			require.Equal(t, "aggregated", value(series.Labels, seriesMetricsTypeLabel))
+		}
+		for _, s := range series.Samples {
+			w.timestamps = append(w.timestamps, s.Timestamp)
+		}
+		actual = append(actual, w)
+	}
+
+	// The fully hinted series is replaced by its copy.
+	require.Equal(t, []written{
+		{name: "mixed", timestamps: []int64{1000}},
+		{name: "plain", timestamps: []int64{1000}},
+		{name: "mixed", policy: "1m:2d", timestamps: []int64{2000}},
+		{name: "mixed", policy: "10s:2d", timestamps: []int64{3000}},
+		{name: "hinted", policy: "1m:2d", timestamps: []int64{1000}},
+	}, actual)
+}
+
+func TestPromWriteSamplePolicyHints(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedPolicy := policy.MustParseStoragePolicy("1m:48h")
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	expectWrite := func(opts ingest.WriteOptions, samples int) {
+		mockDownsamplerAndWriter.
+			EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), opts).
+			DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+				var written int
+				for iter.Next() {
+					written += len(iter.Current().Datapoints)
+				}
+				require.Equal(t, samples, written)
+				return nil
+			})
+	}
+	expectWrite(ingest.WriteOptions{}, 1)
+	expectWrite(ingest.WriteOptions{
+		DownsampleOverride:   true,
+		WriteOverride:        true,
+		WriteStoragePolicies: policy.StoragePolicies{aggregatedPolicy},
+	}, 2)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				SamplePolicyHints: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	body := hintedWriteRequestBody(t, test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("up"), 1000, 2000, 3000),
+	), map[int]map[int]string{0: {1: "1m:48h", 2: "1m:48h"}})
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL,
+		bytes.NewReader(snappy.Encode(nil, body)))
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+}
+
+func TestPromWriteInvalidSamplePolicyHint(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				SamplePolicyHints: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	body := hintedWriteRequestBody(t, test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("up"), 1000),
+	), map[int]map[int]string{0: {0: "invalid"}})
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL,
+		bytes.NewReader(snappy.Encode(nil, body)))
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "invalid")
+}
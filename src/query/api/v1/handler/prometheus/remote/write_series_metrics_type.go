@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/storage/m3/storagemetadata"
+)
+
+var (
+	// seriesMetricsTypeLabel is the reserved label that sets the metrics
+	// type of a series, with the values of the metrics type header.
+	seriesMetricsTypeLabel = []byte("__m3_metrics_type__")
+	// seriesStoragePolicyLabel is the reserved label that sets the storage
+	// policy of an aggregated series, with the values of the storage policy
+	// header.
+	seriesStoragePolicyLabel = []byte("__m3_storage_policy__")
+
+	errSeriesStoragePolicyWithoutMetricsType = errors.New(
+		"storage policy label should not be set without a metrics type label")
+)
+
+// seriesMetricsTypeLabels returns whether the reserved metrics type and
+// storage policy labels of series are honored.
+func (h *PromWriteHandler) seriesMetricsTypeLabels() bool {
+	return h.writeConfig.SeriesMetricsTypeLabels || h.writeConfig.SamplePolicyHints
+}
+
+// routeSeriesMetricsType removes the reserved metrics type and storage
+// policy labels from the series and returns the route and write options of
+// the metrics type and storage policy they set. If the series has no metrics
+// type label then the zero route and the request options are returned.
+func routeSeriesMetricsType(
+	series *prompb.TimeSeries,
+	opts ingest.WriteOptions,
+) (writeRouteKey, ingest.WriteOptions, error) {
+	metricsTypeValue, strPolicy, found := removeSeriesMetricsTypeLabels(series)
+	if !found {
+		return writeRouteKey{}, opts, nil
+	}
+	if metricsTypeValue == "" {
+		return writeRouteKey{}, opts, errSeriesStoragePolicyWithoutMetricsType
+	}
+
+	metricsType, err := storagemetadata.ParseMetricsType(metricsTypeValue)
+	if err != nil {
+		return writeRouteKey{}, opts, err
+	}
+	if err := setMetricsTypeWriteOptions(&opts, metricsType, strPolicy); err != nil {
+		return writeRouteKey{}, opts, err
+	}
+
+	key := writeRouteKey{labelled: true, metricsType: metricsType}
+	if len(opts.WriteStoragePolicies) > 0 {
+		key.policy = opts.WriteStoragePolicies[0]
+	}
+	return key, opts, nil
+}
+
+// removeSeriesMetricsTypeLabels removes the reserved metrics type and
+// storage policy labels from the series, returning their values and whether
+// either was present. The labels are copied rather than modified in place so
+// that other references to the labels of the series are left unchanged.
+func removeSeriesMetricsTypeLabels(
+	series *prompb.TimeSeries,
+) (string, string, bool) {
+	var (
+		metricsType, strPolicy string
+		found                  int
+	)
+	for _, label := range series.Labels {
+		switch {
+		case bytes.Equal(label.Name, seriesMetricsTypeLabel):
+			metricsType = string(bytes.TrimSpace(label.Value))
+			found++
+		case bytes.Equal(label.Name, seriesStoragePolicyLabel):
+			strPolicy = string(bytes.TrimSpace(label.Value))
+			found++
+		}
+	}
+	if found == 0 {
+		return "", "", false
+	}
+
+	labels := make([]prompb.Label, 0, len(series.Labels)-found)
+	for _, label := range series.Labels {
+		if bytes.Equal(label.Name, seriesMetricsTypeLabel) ||
+			bytes.Equal(label.Name, seriesStoragePolicyLabel) {
+			continue
+		}
+		labels = append(labels, label)
+	}
+	series.Labels = labels
+	return metricsType, strPolicy, true
+}
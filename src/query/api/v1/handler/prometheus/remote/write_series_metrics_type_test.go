@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/storage/m3/storagemetadata"
+	"github.com/m3db/m3/src/x/headers"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteSeriesMetricsType(t *testing.T) {
+	aggregatedPolicy := policy.MustParseStoragePolicy("1m:48h")
+	tests := []struct {
+		name     string
+		series   prompb.TimeSeries
+		key      writeRouteKey
+		opts     ingest.WriteOptions
+		expectOK bool
+	}{
+		{
+			name:     "no labels",
+			series:   test.NewSeries("a", "job", "test"),
+			expectOK: true,
+		},
+		{
+			name:   "unaggregated",
+			series: test.NewSeries("a", "job", "test", "__m3_metrics_type__", "unaggregated"),
+			key: writeRouteKey{
+				labelled:    true,
+				metricsType: storagemetadata.UnaggregatedMetricsType,
+			},
+			opts:     ingest.WriteOptions{DownsampleOverride: true},
+			expectOK: true,
+		},
+		{
+			name: "aggregated",
+			series: test.NewSeries("a", "job", "test", "__m3_metrics_type__", "aggregated",
+				"__m3_storage_policy__", "1m:48h"),
+			key: writeRouteKey{
+				labelled:    true,
+				metricsType: storagemetadata.AggregatedMetricsType,
+				policy:      aggregatedPolicy,
+			},
+			opts: ingest.WriteOptions{
+				DownsampleOverride:   true,
+				WriteOverride:        true,
+				WriteStoragePolicies: policy.StoragePolicies{aggregatedPolicy},
+			},
+			expectOK: true,
+		},
+		{
+			name: "unaggregated with storage policy",
+			series: test.NewSeries("a", "job", "test", "__m3_metrics_type__", "unaggregated",
+				"__m3_storage_policy__", "1m:48h"),
+		},
+		{
+			name:   "aggregated without storage policy",
+			series: test.NewSeries("a", "job", "test", "__m3_metrics_type__", "aggregated"),
+		},
+		{
+			name:   "storage policy without metrics type",
+			series: test.NewSeries("a", "job", "test", "__m3_storage_policy__", "1m:48h"),
+		},
+		{
+			name:   "unknown metrics type",
+			series: test.NewSeries("a", "job", "test", "__m3_metrics_type__", "unknown"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := tt.series
+			key, opts, err := routeSeriesMetricsType(&series, ingest.WriteOptions{})
+			if !tt.expectOK {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.key, key)
+			require.Equal(t, tt.opts, opts)
+			// The reserved labels are always removed.
+			require.Equal(t, test.NewSeries("a", "job", "test").Labels, series.Labels)
+		})
+	}
+}
+
+func TestPromWriteSeriesMetricsTypeLabels(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedPolicy := policy.MustParseStoragePolicy("1m:48h")
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	expectWrite := func(opts ingest.WriteOptions, names ...string) {
+		mockDownsamplerAndWriter.
+			EXPECT().
+			WriteBatch(gomock.Any(), gomock.Any(), opts).
+			DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+				var written []string
+				for iter.Next() {
+					tags := iter.Current().Tags
+					name, _ := tags.Name()
+					written = append(written, string(name))
+					_, ok := tags.Get(seriesMetricsTypeLabel)
+					require.False(t, ok)
+					_, ok = tags.Get(seriesStoragePolicyLabel)
+					require.False(t, ok)
+				}
+				require.Equal(t, names, written)
+				return nil
+			})
+	}
+	expectWrite(ingest.WriteOptions{}, "default")
+	expectWrite(ingest.WriteOptions{DownsampleOverride: true}, "raw_a", "raw_b")
+	expectWrite(ingest.WriteOptions{
+		DownsampleOverride:   true,
+		WriteOverride:        true,
+		WriteStoragePolicies: policy.StoragePolicies{aggregatedPolicy},
+	}, "agg")
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				SeriesMetricsTypeLabels: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			test.NewSeries("default", "job", "test"),
+			test.NewSeries("raw_a", "job", "test", "__m3_metrics_type__", "unaggregated"),
+			test.NewSeries("agg", "job", "test", "__m3_metrics_type__", "aggregated",
+				"__m3_storage_policy__", "1m:48h"),
+			test.NewSeries("invalid", "job", "test", "__m3_metrics_type__", "unknown"),
+			test.NewSeries("raw_b", "job", "test", "__m3_metrics_type__", "unaggregated"),
+		},
+	}
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.PartialSuccessHeader, "true")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	// The series with an invalid metrics type is reported by its labels and
+	// the other series are written.
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	var resp partialSuccessResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+	require.Len(t, resp.FailedSeries, 1)
+	require.Equal(t, "invalid", resp.FailedSeries[0].Labels["__name__"])
+	require.Equal(t, 4, resp.SamplesWritten)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultOutOfOrderMaxSeries = 1 << 18
+	defaultOutOfOrderRetention = 10 * time.Minute
+)
+
+// seriesWatermark is the timestamp of the last written sample of a series.
+type seriesWatermark struct {
+	key       [8]byte
+	timestamp int64
+	updated   time.Time
+}
+
+// seriesWatermarks remembers the timestamp of the last written sample of
+// recently written series to reject or drop samples that are not newer, the
+// least recently written series are evicted once full.
+type seriesWatermarks struct {
+	sync.Mutex
+
+	mode       config.OutOfOrderMode
+	maxSeries  int
+	retention  time.Duration
+	nowFn      clock.NowFn
+	entries    map[[8]byte]*list.Element
+	lru        *list.List
+	outOfOrder tally.Counter
+}
+
+func newSeriesWatermarks(
+	cfg config.PromRemoteWriteOutOfOrderConfiguration,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) *seriesWatermarks {
+	maxSeries := defaultOutOfOrderMaxSeries
+	if v := cfg.MaxSeries; v > 0 {
+		maxSeries = v
+	}
+	retention := defaultOutOfOrderRetention
+	if v := cfg.Retention; v > 0 {
+		retention = v
+	}
+	return &seriesWatermarks{
+		mode:       cfg.Mode,
+		maxSeries:  maxSeries,
+		retention:  retention,
+		nowFn:      nowFn,
+		entries:    make(map[[8]byte]*list.Element),
+		lru:        list.New(),
+		outOfOrder: scope.SubScope("write").Counter("out-of-order-samples"),
+	}
+}
+
+// Filter rejects the request if any sample is not newer than the last
+// written sample of its series, or in drop mode drops those samples and any
+// series left without samples. The keys of the remaining series are
+// returned to record the series as written once the write completes.
+func (w *seriesWatermarks) Filter(
+	req *prompb.WriteRequest,
+	unit xtime.Unit,
+) ([][8]byte, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	var (
+		now           = w.nowFn()
+		numOutOfOrder int
+		keys          = make([][8]byte, 0, len(req.Timeseries))
+		series        = req.Timeseries[:0]
+	)
+	for i, s := range req.Timeseries {
+		key := sortedSeriesKey(s.Labels)
+		watermark, ok := w.getWithLock(key, now)
+		if !ok {
+			keys = append(keys, key)
+			series = append(series, s)
+			continue
+		}
+
+		samples := s.Samples[:0]
+		for _, sample := range s.Samples {
+			if sampleTime(sample.Timestamp, unit).UnixNano() > watermark {
+				samples = append(samples, sample)
+				continue
+			}
+			numOutOfOrder++
+			if w.mode == config.OutOfOrderReject {
+				w.outOfOrder.Inc(int64(numOutOfOrder))
+				return nil, xhttp.NewError(fmt.Errorf(
+					"series %d %s has out of order sample at timestamp: %d",
+					i, DeterministicSeriesID(s.Labels), sample.Timestamp),
+					http.StatusBadRequest)
+			}
+		}
+		if len(samples) == 0 && len(s.Samples) > 0 {
+			continue
+		}
+		s.Samples = samples
+		keys = append(keys, key)
+		series = append(series, s)
+	}
+	req.Timeseries = series
+	w.outOfOrder.Inc(int64(numOutOfOrder))
+	return keys, nil
+}
+
+// Written records the timestamp of the last sample of each series of the
+// request that was written, series that failed to be written are not
+// recorded so that they can be retried.
+func (w *seriesWatermarks) Written(
+	req *prompb.WriteRequest,
+	keys [][8]byte,
+	unit xtime.Unit,
+	batchErr ingest.BatchError,
+) {
+	var failed []int
+	if batchErr != nil {
+		var ok bool
+		if failed, ok = failedSeries(batchErr); !ok {
+			return
+		}
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	now := w.nowFn()
+	for i, s := range req.Timeseries {
+		if idx := sort.SearchInts(failed, i); idx < len(failed) && failed[idx] == i {
+			continue
+		}
+		if len(s.Samples) == 0 {
+			continue
+		}
+		last := s.Samples[0].Timestamp
+		for _, sample := range s.Samples[1:] {
+			if sample.Timestamp > last {
+				last = sample.Timestamp
+			}
+		}
+		w.setWithLock(keys[i], sampleTime(last, unit).UnixNano(), now)
+	}
+}
+
+func (w *seriesWatermarks) getWithLock(key [8]byte, now time.Time) (int64, bool) {
+	elem, ok := w.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := elem.Value.(*seriesWatermark)
+	if now.Sub(entry.updated) > w.retention {
+		w.lru.Remove(elem)
+		delete(w.entries, key)
+		return 0, false
+	}
+	return entry.timestamp, true
+}
+
+func (w *seriesWatermarks) setWithLock(key [8]byte, timestamp int64, now time.Time) {
+	if elem, ok := w.entries[key]; ok {
+		entry := elem.Value.(*seriesWatermark)
+		if timestamp > entry.timestamp {
+			entry.timestamp = timestamp
+		}
+		entry.updated = now
+		w.lru.MoveToFront(elem)
+		return
+	}
+
+	w.entries[key] = w.lru.PushFront(&seriesWatermark{
+		key:       key,
+		timestamp: timestamp,
+		updated:   now,
+	})
+	for w.lru.Len() > w.maxSeries {
+		oldest := w.lru.Back()
+		w.lru.Remove(oldest)
+		delete(w.entries, oldest.Value.(*seriesWatermark).key)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestSeriesWatermarksDrop(t *testing.T) {
+	now := time.Unix(0, 0)
+	nowFn := func() time.Time { return now }
+
+	scope := tally.NewTestScope("", nil)
+	w := newSeriesWatermarks(config.PromRemoteWriteOutOfOrderConfiguration{
+		Mode:      config.OutOfOrderDrop,
+		Retention: time.Minute,
+	}, nowFn, scope)
+
+	req := test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 2000, 1000),
+		test.WithTimestamps(test.NewSeries("b"), 2000, 1000),
+	)
+	keys, err := w.Filter(req, xtime.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 2)
+
+	// Series that fail to be written are not recorded.
+	w.Written(req, keys, xtime.Millisecond,
+		seriesBatchError(ingest.NewSeriesError(errors.New("unavailable"), 1)))
+
+	req = test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 2000, 3000),
+		test.WithTimestamps(test.NewSeries("b"), 2000, 3000),
+	)
+	keys, err = w.Filter(req, xtime.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 2)
+	require.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 3000}}, req.Timeseries[0].Samples)
+	require.Len(t, req.Timeseries[1].Samples, 2)
+	w.Written(req, keys, xtime.Millisecond, nil)
+
+	// Series left without samples are dropped.
+	req = test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 3000),
+		test.WithTimestamps(test.NewSeries("b"), 3000),
+	)
+	_, err = w.Filter(req, xtime.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 0)
+	require.Equal(t, int64(3), scope.Snapshot().Counters()["write.out-of-order-samples+"].Value())
+
+	// Watermarks are forgotten after the retention.
+	now = now.Add(2 * time.Minute)
+	req = test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 3000),
+		test.WithTimestamps(test.NewSeries("b"), 3000),
+	)
+	_, err = w.Filter(req, xtime.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 2)
+}
+
+func TestSeriesWatermarksReject(t *testing.T) {
+	w := newSeriesWatermarks(config.PromRemoteWriteOutOfOrderConfiguration{
+		Mode:      config.OutOfOrderReject,
+		MaxSeries: 1,
+	}, time.Now, tally.NoopScope)
+
+	req := test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 1000),
+		test.WithTimestamps(test.NewSeries("b"), 1000),
+	)
+	keys, err := w.Filter(req, xtime.Millisecond)
+	require.NoError(t, err)
+	w.Written(req, keys, xtime.Millisecond, nil)
+
+	// Only the most recently written series is remembered.
+	req = test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 1000),
+		test.WithTimestamps(test.NewSeries("b"), 1000),
+	)
+	_, err = w.Filter(req, xtime.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `series 1 {__name__="b"} has out of order sample at timestamp: 1000`)
+
+	// Timestamps are compared regardless of their unit.
+	req = test.NewWriteRequest(
+		test.WithTimestamps(test.NewSeries("a"), 1000000),
+		test.WithTimestamps(test.NewSeries("b"), 1000000),
+	)
+	_, err = w.Filter(req, xtime.Microsecond)
+	require.Error(t, err)
+}
+
+func TestPromWriteOutOfOrder(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				OutOfOrder: config.PromRemoteWriteOutOfOrderConfiguration{
+					Mode: config.OutOfOrderReject,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	// Replaying the same request is rejected.
+	promReq := test.GeneratePromWriteRequest()
+	for _, status := range []int{http.StatusOK, http.StatusBadRequest} {
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		require.Equal(t, status, writer.Result().StatusCode)
+	}
+}
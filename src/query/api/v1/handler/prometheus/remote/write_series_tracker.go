@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"sync"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/x/clock"
+
+	"github.com/uber-go/tally"
+)
+
+// seriesTracker approximately counts the written series that are new versus
+// those that were seen within a rolling window.
+type seriesTracker struct {
+	sync.Mutex
+
+	filter         *rollingSeriesFilter
+	newSeries      tally.Counter
+	existingSeries tally.Counter
+}
+
+func newSeriesTracker(
+	cfg config.PromRemoteWriteSeriesTrackingConfiguration,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) *seriesTracker {
+	return &seriesTracker{
+		filter: newRollingSeriesFilter(cfg.Window, cfg.ExpectedSeries,
+			cfg.FalsePositiveRate, nowFn),
+		newSeries:      scope.SubScope("series").Counter("new"),
+		existingSeries: scope.SubScope("series").Counter("existing"),
+	}
+}
+
+// Track counts the series as new or existing and records them as seen.
+func (t *seriesTracker) Track(timeseries []prompb.TimeSeries) {
+	var numNew, numExisting int64
+
+	t.Lock()
+	t.filter.Rotate()
+	for _, series := range timeseries {
+		key := seriesKey(series.Labels)
+		inCurrent, seen := t.filter.Test(key)
+		if seen {
+			numExisting++
+		} else {
+			numNew++
+		}
+		if !inCurrent {
+			t.filter.Add(key)
+		}
+	}
+	t.Unlock()
+
+	t.newSeries.Inc(numNew)
+	t.existingSeries.Inc(numExisting)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestSeriesTrackerTrack(t *testing.T) {
+	now := time.Now()
+	nowFn := func() time.Time { return now }
+	scope := tally.NewTestScope("", nil)
+	tracker := newSeriesTracker(config.PromRemoteWriteSeriesTrackingConfiguration{
+		Enabled: true,
+		Window:  time.Minute,
+	}, nowFn, scope)
+
+	counts := func() (int64, int64) {
+		counters := scope.Snapshot().Counters()
+		return counters["series.new+"].Value(), counters["series.existing+"].Value()
+	}
+
+	tracker.Track(test.NamedSeries("a", "b"))
+	tracker.Track(test.NamedSeries("a", "c"))
+	newSeries, existingSeries := counts()
+	require.Equal(t, int64(3), newSeries)
+	require.Equal(t, int64(1), existingSeries)
+
+	// Series seen in the previous window are still existing series, series
+	// only seen before the previous window are new again.
+	now = now.Add(time.Minute)
+	tracker.Track(test.NamedSeries("a"))
+	now = now.Add(time.Minute)
+	tracker.Track(test.NamedSeries("a", "b"))
+	newSeries, existingSeries = counts()
+	require.Equal(t, int64(4), newSeries)
+	require.Equal(t, int64(3), existingSeries)
+
+	// All series are new once two windows pass without any writes.
+	now = now.Add(2 * time.Minute)
+	tracker.Track(test.NamedSeries("a"))
+	newSeries, existingSeries = counts()
+	require.Equal(t, int64(5), newSeries)
+	require.Equal(t, int64(3), existingSeries)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"fmt"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// strictMessage describes the fields of a message in a write request, the
+// value of each field is the schema of the field if it is a message or nil
+// if it is a scalar.
+type strictMessage struct {
+	name   string
+	fields map[protowire.Number]*strictMessage
+}
+
+var (
+	strictLabel = &strictMessage{
+		name:   "Label",
+		fields: map[protowire.Number]*strictMessage{1: nil, 2: nil},
+	}
+	strictSample = &strictMessage{
+		name: "Sample",
+		fields: map[protowire.Number]*strictMessage{
+			1:                     nil,
+			2:                     nil,
+			samplePolicyHintField: nil,
+		},
+	}
+	strictTimeSeries = &strictMessage{
+		name: "TimeSeries",
+		fields: map[protowire.Number]*strictMessage{
+			1:                   strictLabel,
+			2:                   strictSample,
+			3:                   nil,
+			4:                   nil,
+			5:                   nil,
+			101:                 nil,
+			102:                 nil,
+			encodedSamplesField: nil,
+		},
+	}
+	strictWriteRequest = &strictMessage{
+		name:   "WriteRequest",
+		fields: map[protowire.Number]*strictMessage{1: strictTimeSeries},
+	}
+)
+
+// validateStrict rejects write requests that contain fields unknown to the
+// write request schema, which the regular decoding silently ignores, or that
+// decoded to series that are unlikely to have been intended, both of which
+// usually indicate a client using a mismatched schema.
+func validateStrict(body []byte, req *prompb.WriteRequest) error {
+	if err := validateKnownFields(body, strictWriteRequest); err != nil {
+		return fmt.Errorf("strict decode: %v", err)
+	}
+
+	for i, series := range req.Timeseries {
+		if len(series.Labels) > 0 && len(series.Samples) == 0 {
+			return fmt.Errorf("strict decode: series %d has labels but no samples", i)
+		}
+		for j, sample := range series.Samples {
+			if sample.Timestamp == 0 {
+				return fmt.Errorf("strict decode: series %d sample %d has a zero timestamp", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+func validateKnownFields(b []byte, msg *strictMessage) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field, ok := msg.fields[num]
+		if !ok {
+			return fmt.Errorf("unknown field %d in %s", num, msg.name)
+		}
+
+		if field != nil && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := validateKnownFields(v, field); err != nil {
+				return err
+			}
+			b = b[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
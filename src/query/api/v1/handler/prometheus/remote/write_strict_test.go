@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestValidateStrict(t *testing.T) {
+	series := prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: []byte("__name__"), Value: []byte("up")}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}
+	seriesBytes, err := proto.Marshal(&series)
+	require.NoError(t, err)
+
+	writeRequest := func(seriesBytes []byte) []byte {
+		b := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendBytes(b, seriesBytes)
+	}
+	withUnknownField := func(b []byte, num protowire.Number) []byte {
+		b = append([]byte(nil), b...)
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, 1)
+	}
+
+	tests := []struct {
+		name  string
+		body  []byte
+		mutFn func(req *prompb.WriteRequest)
+		err   string
+	}{
+		{
+			name: "valid",
+			body: writeRequest(seriesBytes),
+		},
+		{
+			name: "unknown write request field",
+			body: withUnknownField(writeRequest(seriesBytes), 2),
+			err:  "strict decode: unknown field 2 in WriteRequest",
+		},
+		{
+			name: "unknown time series field",
+			body: writeRequest(withUnknownField(seriesBytes, 6)),
+			err:  "strict decode: unknown field 6 in TimeSeries",
+		},
+		{
+			name: "no samples",
+			body: writeRequest(seriesBytes),
+			mutFn: func(req *prompb.WriteRequest) {
+				req.Timeseries[0].Samples = nil
+			},
+			err: "strict decode: series 0 has labels but no samples",
+		},
+		{
+			name: "zero timestamp",
+			body: writeRequest(seriesBytes),
+			mutFn: func(req *prompb.WriteRequest) {
+				req.Timeseries[0].Samples[0].Timestamp = 0
+			},
+			err: "strict decode: series 0 sample 0 has a zero timestamp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(tt.body, &req))
+			require.Len(t, req.Timeseries, 1)
+			if tt.mutFn != nil {
+				tt.mutFn(&req)
+			}
+
+			err := validateStrict(tt.body, &req)
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestPromWriteStrictDecode(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				StrictDecode: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	data, err := proto.Marshal(test.GeneratePromWriteRequest())
+	require.NoError(t, err)
+	data = protowire.AppendTag(data, 3, protowire.VarintType)
+	data = protowire.AppendVarint(data, 1)
+
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL,
+		bytes.NewReader(snappy.Encode(nil, data)))
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "unknown field 3 in WriteRequest")
+}
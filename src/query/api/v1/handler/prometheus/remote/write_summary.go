@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/prometheus/common/model"
+)
+
+var quantileLabel = []byte(model.QuantileLabel)
+
+// summaryKeyBuilder builds the keys that group the series of classic
+// Prometheus summaries, which are written as a series per quantile plus
+// "_sum" and "_count" series, by the summary name and its labels other
+// than the quantile.
+type summaryKeyBuilder struct {
+	buf     []byte
+	scratch []prompb.Label
+}
+
+// groupSummaries gives the series of each summary in the request summary
+// type metadata, unless they already have type metadata, so that they are
+// written together. The "_sum" and "_count" series of a summary are only
+// grouped if the request has a quantile series of the summary, since they
+// cannot be told apart from those of a histogram otherwise. An error is
+// returned if a series has a quantile that is not a number between zero
+// and one.
+func groupSummaries(req *prompb.WriteRequest) error {
+	var (
+		groups  = make(map[string][]int)
+		builder summaryKeyBuilder
+	)
+	for i, series := range req.Timeseries {
+		quantile, ok := labelValue(series.Labels, quantileLabel)
+		if !ok {
+			continue
+		}
+		q, err := strconv.ParseFloat(string(quantile), 64)
+		if err != nil || math.IsNaN(q) || q < 0 || q > 1 {
+			return fmt.Errorf("series %d has invalid quantile: %q", i, quantile)
+		}
+
+		name, _ := labelValue(series.Labels, metricNameLabel)
+		key := builder.Key(series.Labels, name)
+		groups[key] = append(groups[key], i)
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	for i, series := range req.Timeseries {
+		name, ok := labelValue(series.Labels, metricNameLabel)
+		if !ok {
+			continue
+		}
+		var base []byte
+		switch {
+		case bytes.HasSuffix(name, histogramSumSuffix):
+			base = name[:len(name)-len(histogramSumSuffix)]
+		case bytes.HasSuffix(name, histogramCountSuffix):
+			base = name[:len(name)-len(histogramCountSuffix)]
+		default:
+			continue
+		}
+		if _, ok := labelValue(series.Labels, quantileLabel); ok {
+			continue
+		}
+
+		key := builder.Key(series.Labels, base)
+		if _, ok := groups[key]; ok {
+			groups[key] = append(groups[key], i)
+		}
+	}
+
+	for _, indexes := range groups {
+		for _, idx := range indexes {
+			if req.Timeseries[idx].Type == prompb.MetricType_UNKNOWN {
+				req.Timeseries[idx].Type = prompb.MetricType_SUMMARY
+			}
+		}
+	}
+	return nil
+}
+
+// Key returns the group key of the labels with the metric name replaced by
+// the name of the summary and the quantile label removed.
+func (b *summaryKeyBuilder) Key(labels []prompb.Label, name []byte) string {
+	b.scratch = append(b.scratch[:0], labels...)
+	sort.Slice(b.scratch, func(i, j int) bool {
+		return bytes.Compare(b.scratch[i].Name, b.scratch[j].Name) < 0
+	})
+	b.buf = b.buf[:0]
+	for _, l := range b.scratch {
+		value := l.Value
+		switch {
+		case bytes.Equal(l.Name, quantileLabel):
+			continue
+		case bytes.Equal(l.Name, metricNameLabel):
+			value = name
+		}
+		b.buf = append(b.buf, l.Name...)
+		b.buf = append(b.buf, 0xff)
+		b.buf = append(b.buf, value...)
+		b.buf = append(b.buf, 0xfe)
+	}
+	return string(b.buf)
+}
+
+// labelValue returns the value of the label with the name if present.
+func labelValue(labels []prompb.Label, name []byte) ([]byte, bool) {
+	for _, l := range labels {
+		if bytes.Equal(l.Name, name) {
+			return l.Value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"testing"
+
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seriesTypes(req *prompb.WriteRequest) []prompb.MetricType {
+	types := make([]prompb.MetricType, 0, len(req.Timeseries))
+	for _, series := range req.Timeseries {
+		types = append(types, series.Type)
+	}
+	return types
+}
+
+func TestGroupSummaries(t *testing.T) {
+	req := test.NewWriteRequest(
+		test.NewSeries("latency", "host", "a", "quantile", "0.5"),
+		test.NewSeries("latency", "host", "a", "quantile", "0.99"),
+		test.NewSeries("latency_sum", "host", "a"),
+		test.NewSeries("latency_count", "host", "a"),
+		// A different host is a different summary without quantiles.
+		test.NewSeries("latency_sum", "host", "c"),
+		// Existing type metadata is left unchanged.
+		test.NewSeries("latency", "host", "b", "quantile", "1"),
+		test.WithType(test.NewSeries("latency_count", "host", "b"), prompb.MetricType_GAUGE),
+		test.NewSeries("requests_total", "host", "a"),
+	)
+
+	require.NoError(t, groupSummaries(req))
+	assert.Equal(t, []prompb.MetricType{
+		prompb.MetricType_SUMMARY,
+		prompb.MetricType_SUMMARY,
+		prompb.MetricType_SUMMARY,
+		prompb.MetricType_SUMMARY,
+		prompb.MetricType_UNKNOWN,
+		prompb.MetricType_SUMMARY,
+		prompb.MetricType_GAUGE,
+		prompb.MetricType_UNKNOWN,
+	}, seriesTypes(req))
+}
+
+func TestGroupSummariesWithoutQuantiles(t *testing.T) {
+	// Histogram sum and count series are not grouped as summaries.
+	req := test.NewWriteRequest(
+		test.NewSeries("latency_sum", "host", "a"),
+		test.NewSeries("latency_count", "host", "a"),
+	)
+
+	require.NoError(t, groupSummaries(req))
+	assert.Equal(t, []prompb.MetricType{
+		prompb.MetricType_UNKNOWN,
+		prompb.MetricType_UNKNOWN,
+	}, seriesTypes(req))
+}
+
+func TestGroupSummariesInvalidQuantile(t *testing.T) {
+	for _, quantile := range []string{"abc", "-0.1", "1.5", "NaN"} {
+		req := test.NewWriteRequest(
+			test.NewSeries("latency", "host", "a", "quantile", "0.5"),
+			test.NewSeries("latency", "host", "a", "quantile", quantile),
+		)
+
+		err := groupSummaries(req)
+		require.Error(t, err, quantile)
+		assert.Contains(t, err.Error(), "series 1 has invalid quantile")
+	}
+}
@@ -23,35 +23,48 @@ package remote
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
 	"github.com/m3db/m3/src/cmd/services/m3query/config"
 	"github.com/m3db/m3/src/dbnode/generated/proto/annotation"
+	tterrors "github.com/m3db/m3/src/dbnode/network/server/tchannelthrift/errors"
 	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
 	"github.com/m3db/m3/src/query/api/v1/options"
 	"github.com/m3db/m3/src/query/generated/proto/prompb"
 	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/query/storage/m3/storagemetadata"
+	"github.com/m3db/m3/src/query/ts"
 	xclock "github.com/m3db/m3/src/x/clock"
 	xerrors "github.com/m3db/m3/src/x/errors"
 	"github.com/m3db/m3/src/x/headers"
 	"github.com/m3db/m3/src/x/instrument"
+	xhttp "github.com/m3db/m3/src/x/net/http"
 	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func makeOptions(ds ingest.DownsamplerAndWriter) options.HandlerOptions {
@@ -86,6 +99,679 @@ func TestPromWriteParsing(t *testing.T) {
 	require.Equal(t, ingest.WriteOptions{}, r.Options)
 }
 
+func TestValidateNames(t *testing.T) {
+	tests := []struct {
+		mode       config.NameValidationMode
+		name       string
+		label      string
+		errContain string
+	}{
+		{mode: "", name: "foo-bar", label: "b.az"},
+		{mode: config.NameValidationLegacy, name: "foo:bar_1", label: "baz_1"},
+		{mode: config.NameValidationLegacy, name: "foo.bar", label: "baz", errContain: `invalid metric name: "foo.bar"`},
+		{mode: config.NameValidationLegacy, name: "1foo", label: "baz", errContain: `invalid metric name: "1foo"`},
+		{mode: config.NameValidationLegacy, name: "foo", label: "b:az", errContain: `invalid label name: "b:az"`},
+		{mode: config.NameValidationUTF8, name: "foo.bär", label: "bäz"},
+		{mode: config.NameValidationUTF8, name: "foo", label: "\xff", errContain: "invalid label name"},
+		{mode: config.NameValidationUTF8, name: "", label: "baz", errContain: "invalid metric name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.mode, tt.name, tt.label), func(t *testing.T) {
+			req := &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{{
+					Labels: []prompb.Label{
+						{Name: []byte("__name__"), Value: []byte(tt.name)},
+						{Name: []byte(tt.label), Value: []byte("qux")},
+					},
+				}},
+			}
+			err := validateNames(req, tt.mode, [][]byte{metricNameLabel})
+			if tt.errContain == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errContain)
+		})
+	}
+}
+
+func TestPromWriteNameValidation(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				NameValidation: config.NameValidationLegacy,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReq.Timeseries[1].Labels[0].Value = []byte("second.metric")
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "second.metric")
+
+	_, err = NewPromWriteHandler(opts.SetConfig(config.Configuration{
+		PromRemoteWrite: config.PromRemoteWriteConfiguration{
+			NameValidation: "unknown",
+		},
+	}))
+	require.Error(t, err)
+}
+
+func TestPromWriteTimestampOffset(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	newRequest := func() (*http.Request, *prompb.WriteRequest) {
+		promReq := test.GeneratePromWriteRequest()
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		req.Header.Set(headers.TimestampOffsetHeader, "1h")
+		return req, promReq
+	}
+
+	// Not allowed by default.
+	handler, err := NewPromWriteHandler(makeOptions(mockDownsamplerAndWriter))
+	require.NoError(t, err)
+	req, _ := newRequest()
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				AllowTimestampOffset: true,
+			},
+		})
+	handler, err = NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	req, promReq := newRequest()
+	r, err := handler.(*PromWriteHandler).parseRequest(req)
+	require.NoError(t, err)
+
+	hourMillis := int64(time.Hour / time.Millisecond)
+	for i, series := range r.Request.Timeseries {
+		for j, sample := range series.Samples {
+			expected := promReq.Timeseries[i].Samples[j].Timestamp + hourMillis
+			require.Equal(t, expected, sample.Timestamp)
+		}
+	}
+}
+
+func TestPromWriteTimestampPrecision(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	promReq := test.GeneratePromWriteRequest()
+	// Express the generated millisecond timestamps in seconds.
+	for i := range promReq.Timeseries {
+		for j := range promReq.Timeseries[i].Samples {
+			promReq.Timeseries[i].Samples[j].Timestamp /= 1000
+		}
+	}
+
+	var numSeries int
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			for iter.Next() {
+				value := iter.Current()
+				require.Equal(t, xtime.Second, value.Unit)
+				for j, dp := range value.Datapoints {
+					expected := time.Unix(promReq.Timeseries[numSeries].Samples[j].Timestamp, 0)
+					require.True(t, expected.Equal(dp.Timestamp))
+				}
+				numSeries++
+			}
+			return nil
+		})
+
+	handler, err := NewPromWriteHandler(makeOptions(mockDownsamplerAndWriter))
+	require.NoError(t, err)
+
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.TimestampPrecisionHeader, "s")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	require.Equal(t, len(promReq.Timeseries), numSeries)
+
+	// Unrecognized precisions are rejected.
+	promReqBody = test.GeneratePromWriteRequestBody(t, promReq)
+	req = httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.TimestampPrecisionHeader, "minutes")
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+}
+
+func TestPromWriteInvalidTimestamps(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReq := test.GeneratePromWriteRequest()
+		// Invalidate one sample of the first series and all of the samples
+		// of the second series.
+		promReq.Timeseries[0].Samples[0].Timestamp = 0
+		for i := range promReq.Timeseries[1].Samples {
+			promReq.Timeseries[1].Samples[i].Timestamp = -1
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+	newHandler := func(
+		mode config.InvalidTimestampMode,
+		scope tally.Scope,
+	) *PromWriteHandler {
+		opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+			SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					InvalidTimestamps: mode,
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler.(*PromWriteHandler)
+	}
+	counterKey := "write.invalid-timestamp-samples+handler=remote-write,test=invalid-timestamps"
+
+	// Rejected requests are a bad request.
+	scope := tally.NewTestScope("", map[string]string{"test": "invalid-timestamps"})
+	handler := newHandler(config.InvalidTimestampReject, scope)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+
+	// Dropped samples are removed along with series left without samples.
+	scope = tally.NewTestScope("", map[string]string{"test": "invalid-timestamps"})
+	handler = newHandler(config.InvalidTimestampDrop, scope)
+	r, err := handler.parseRequest(newRequest())
+	require.NoError(t, err)
+	require.Len(t, r.Request.Timeseries, 1)
+	require.Len(t, r.Request.Timeseries[0].Samples, 1)
+	require.True(t, r.Request.Timeseries[0].Samples[0].Timestamp > 0)
+	require.Equal(t, int64(3), scope.Snapshot().Counters()[counterKey].Value())
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				InvalidTimestamps: "unknown",
+			},
+		})
+	_, err = NewPromWriteHandler(opts)
+	require.Error(t, err)
+}
+
+func TestPromWriteEmptyLabelValues(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: []byte("__name__"), Value: []byte("up")},
+						{Name: []byte("host"), Value: []byte("a")},
+					},
+					Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: []byte("__name__"), Value: []byte("up")},
+						{Name: []byte("host"), Value: []byte("b")},
+						{Name: []byte("zone"), Value: []byte("")},
+					},
+					Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+				},
+			},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+	newHandler := func(mode config.EmptyLabelValueMode, scope tally.Scope) *PromWriteHandler {
+		opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+			SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					EmptyLabelValues: mode,
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler.(*PromWriteHandler)
+	}
+	counterKey := "write.empty-label-values+handler=remote-write,test=empty-label-values"
+	newScope := func() tally.TestScope {
+		return tally.NewTestScope("", map[string]string{"test": "empty-label-values"})
+	}
+
+	// Rejected requests are a bad request.
+	scope := newScope()
+	handler := newHandler(config.EmptyLabelValueReject, scope)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "series 1 has label with empty value: zone")
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+
+	// Dropped series are removed from the request.
+	scope = newScope()
+	handler = newHandler(config.EmptyLabelValueDropSeries, scope)
+	r, err := handler.parseRequest(newRequest())
+	require.NoError(t, err)
+	require.Len(t, r.Request.Timeseries, 1)
+	require.Equal(t, []byte("a"), r.Request.Timeseries[0].Labels[1].Value)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+
+	// Dropped labels are removed from their series.
+	scope = newScope()
+	handler = newHandler(config.EmptyLabelValueDropLabels, scope)
+	r, err = handler.parseRequest(newRequest())
+	require.NoError(t, err)
+	require.Len(t, r.Request.Timeseries, 2)
+	require.Equal(t, []prompb.Label{
+		{Name: []byte("__name__"), Value: []byte("up")},
+		{Name: []byte("host"), Value: []byte("b")},
+	}, r.Request.Timeseries[1].Labels)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				EmptyLabelValues: "unknown",
+			},
+		})
+	_, err = NewPromWriteHandler(opts)
+	require.Error(t, err)
+}
+
+func TestPromWriteValueRanges(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{{Name: []byte("__name__"), Value: []byte("cpu_ratio")}},
+					Samples: []prompb.Sample{
+						{Value: 0.5, Timestamp: 1000},
+						{Value: 50, Timestamp: 2000},
+						{Value: math.NaN(), Timestamp: 3000},
+					},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: []byte("__name__"), Value: []byte("cpu_ratio")},
+						{Name: []byte("host"), Value: []byte("b")},
+					},
+					Samples: []prompb.Sample{{Value: -1, Timestamp: 1000}},
+				},
+				{
+					Labels:  []prompb.Label{{Name: []byte("__name__"), Value: []byte("other")}},
+					Samples: []prompb.Sample{{Value: 50, Timestamp: 1000}},
+				},
+			},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+	newHandler := func(mode config.ValueRangeMode, scope tally.Scope) *PromWriteHandler {
+		opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+			SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					ValueRanges: config.PromRemoteWriteValueRangesConfiguration{
+						Mode: mode,
+						Metrics: map[string]config.PromRemoteWriteValueRange{
+							"cpu_ratio": {Min: 0, Max: 1},
+						},
+					},
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler.(*PromWriteHandler)
+	}
+	counterKey := "write.out-of-range-samples+handler=remote-write,test=value-ranges"
+
+	// Rejected requests are a bad request.
+	scope := tally.NewTestScope("", map[string]string{"test": "value-ranges"})
+	handler := newHandler(config.ValueRangeReject, scope)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "series 0 has a cpu_ratio sample with out of range value: 50")
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+
+	// Dropped samples are removed along with series left without samples,
+	// NaN staleness markers and other metrics are kept.
+	scope = tally.NewTestScope("", map[string]string{"test": "value-ranges"})
+	handler = newHandler("", scope)
+	r, err := handler.parseRequest(newRequest())
+	require.NoError(t, err)
+	require.Len(t, r.Request.Timeseries, 2)
+	require.Len(t, r.Request.Timeseries[0].Samples, 2)
+	require.Equal(t, 0.5, r.Request.Timeseries[0].Samples[0].Value)
+	require.True(t, math.IsNaN(r.Request.Timeseries[0].Samples[1].Value))
+	require.Equal(t, float64(50), r.Request.Timeseries[1].Samples[0].Value)
+	require.Equal(t, int64(2), scope.Snapshot().Counters()[counterKey].Value())
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				ValueRanges: config.PromRemoteWriteValueRangesConfiguration{
+					Mode: "unknown",
+				},
+			},
+		})
+	_, err = NewPromWriteHandler(opts)
+	require.Error(t, err)
+}
+
+func TestPromWriteSeriesSampleLimit(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels:  []prompb.Label{{Name: []byte("__name__"), Value: []byte("small")}},
+					Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+				},
+				{
+					Labels: []prompb.Label{{Name: []byte("__name__"), Value: []byte("backfill")}},
+					Samples: []prompb.Sample{
+						{Value: 3, Timestamp: 3000},
+						{Value: 1, Timestamp: 1000},
+						{Value: 4, Timestamp: 4000},
+						{Value: 2, Timestamp: 2000},
+					},
+				},
+			},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+	newHandler := func(mode config.SeriesSampleLimitMode, scope tally.Scope) *PromWriteHandler {
+		opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+			SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					SeriesSampleLimit: config.PromRemoteWriteSeriesSampleLimitConfiguration{
+						MaxSamplesPerSeries: 2,
+						Mode:                mode,
+					},
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler.(*PromWriteHandler)
+	}
+	counterKey := "write.series-samples-over-limit+handler=remote-write,test=series-sample-limit"
+
+	// Rejected requests are a bad request.
+	scope := tally.NewTestScope("", map[string]string{"test": "series-sample-limit"})
+	handler := newHandler("", scope)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "series 1 backfill has 4 samples, max samples per series: 2")
+	require.Equal(t, int64(2), scope.Snapshot().Counters()[counterKey].Value())
+
+	// Truncated series keep their newest samples.
+	scope = tally.NewTestScope("", map[string]string{"test": "series-sample-limit"})
+	handler = newHandler(config.SeriesSampleLimitTruncate, scope)
+	r, err := handler.parseRequest(newRequest())
+	require.NoError(t, err)
+	require.Len(t, r.Request.Timeseries, 2)
+	require.Len(t, r.Request.Timeseries[0].Samples, 1)
+	require.Equal(t, []prompb.Sample{
+		{Value: 3, Timestamp: 3000},
+		{Value: 4, Timestamp: 4000},
+	}, r.Request.Timeseries[1].Samples)
+	require.Equal(t, int64(2), scope.Snapshot().Counters()[counterKey].Value())
+}
+
+func TestPromWriteCustomMetricNameTag(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetTagOptions(models.NewTagOptions().SetMetricName([]byte("metric"))).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				NameValidation: config.NameValidationLegacy,
+				ValueRanges: config.PromRemoteWriteValueRangesConfiguration{
+					Mode: config.ValueRangeReject,
+					Metrics: map[string]config.PromRemoteWriteValueRange{
+						"cpu_ratio": {Min: 0, Max: 1},
+					},
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	write := func(name, value string, v float64) *httptest.ResponseRecorder {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: []byte(name), Value: []byte(value)}},
+				Samples: []prompb.Sample{{Value: v, Timestamp: 1000}},
+			}},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		return writer
+	}
+
+	// The metric name tag of the tag options is validated as a metric name.
+	writer := write("metric", "bad-name", 0.5)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "invalid metric name")
+
+	// Value ranges apply to the metric name from either label.
+	for _, name := range []string{"metric", "__name__"} {
+		writer = write(name, "cpu_ratio", 50)
+		require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+		require.Contains(t, writer.Body.String(), "cpu_ratio sample with out of range value: 50")
+	}
+}
+
+func TestPromWriteIDScheme(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var schemes []models.IDSchemeType
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_ context.Context,
+			iter ingest.DownsampleAndWriteIter,
+			_ ingest.WriteOptions,
+		) ingest.BatchError {
+			require.True(t, iter.Next())
+			schemes = append(schemes, iter.Current().Tags.Opts.IDSchemeType())
+			return nil
+		}).
+		Times(2)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				IDSchemes: []models.IDSchemeType{models.TypeQuoted, models.TypePrependMeta},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	write := func(scheme string) *http.Response {
+		promReq := test.GeneratePromWriteRequest()
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		req.Header.Set(headers.IDSchemeHeader, scheme)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		return writer.Result()
+	}
+
+	require.Equal(t, http.StatusOK, write("prepend_meta").StatusCode)
+	require.Equal(t, http.StatusOK, write("quoted").StatusCode)
+	require.Equal(t, []models.IDSchemeType{models.TypePrependMeta, models.TypeQuoted}, schemes)
+
+	// Unknown schemes are a bad request.
+	require.Equal(t, http.StatusBadRequest, write("graphite").StatusCode)
+}
+
+func TestPromWriteMaxDecompressionRatio(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", map[string]string{"test": "decompression-ratio"})
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				MaxDecompressionRatio: 2,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	// Repeated labels compress to far less than half of their size.
+	promReq := &prompb.WriteRequest{}
+	for i := 0; i < 100; i++ {
+		promReq.Timeseries = append(promReq.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: []byte("__name__"), Value: []byte("up")}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		})
+	}
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "exceeds max ratio 2")
+
+	counterKey := "parse.rejected+handler=remote-write,reason=compression_ratio,test=decompression-ratio"
+	require.Equal(t, int64(1), scope.Snapshot().Counters()[counterKey].Value())
+}
+func TestPromWriteDuplicateTimestamps(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{{Name: []byte("__name__"), Value: []byte("first")}},
+					Samples: []prompb.Sample{
+						{Value: 3, Timestamp: 2000},
+						{Value: 1, Timestamp: 1000},
+						{Value: 4, Timestamp: 2000},
+						{Value: 2, Timestamp: 2000},
+					},
+				},
+			},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+	newHandler := func(mode config.DuplicateTimestampMode) *PromWriteHandler {
+		opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+			SetConfig(config.Configuration{
+				PromRemoteWrite: config.PromRemoteWriteConfiguration{
+					DuplicateTimestamps: mode,
+				},
+			})
+		handler, err := NewPromWriteHandler(opts)
+		require.NoError(t, err)
+		return handler.(*PromWriteHandler)
+	}
+
+	tests := []struct {
+		mode     config.DuplicateTimestampMode
+		expected []prompb.Sample
+	}{
+		{
+			// Samples are written as is by default.
+			mode: "",
+			expected: []prompb.Sample{
+				{Value: 3, Timestamp: 2000},
+				{Value: 1, Timestamp: 1000},
+				{Value: 4, Timestamp: 2000},
+				{Value: 2, Timestamp: 2000},
+			},
+		},
+		{
+			mode:     config.DuplicateTimestampFirstWins,
+			expected: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 3, Timestamp: 2000}},
+		},
+		{
+			mode:     config.DuplicateTimestampLastWins,
+			expected: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+		},
+		{
+			mode:     config.DuplicateTimestampMax,
+			expected: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 4, Timestamp: 2000}},
+		},
+		{
+			mode:     config.DuplicateTimestampMin,
+			expected: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+		},
+	}
+	for _, tt := range tests {
+		r, err := newHandler(tt.mode).parseRequest(newRequest())
+		require.NoError(t, err, string(tt.mode))
+		require.Equal(t, tt.expected, r.Request.Timeseries[0].Samples, string(tt.mode))
+	}
+
+	// Conflicting values are a bad request naming the series.
+	writer := httptest.NewRecorder()
+	newHandler(config.DuplicateTimestampReject).ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), `series 0 {__name__=\"first\"}`)
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				DuplicateTimestamps: "unknown",
+			},
+		})
+	_, err := NewPromWriteHandler(opts)
+	require.Error(t, err)
+}
+
 func TestPromWrite(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
@@ -109,6 +795,86 @@ func TestPromWrite(t *testing.T) {
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestPromWriteZstd(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	data, err := proto.Marshal(test.GeneratePromWriteRequest())
+	require.NoError(t, err)
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	compressed := encoder.EncodeAll(data, nil)
+	require.NoError(t, encoder.Close())
+
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, bytes.NewReader(compressed))
+	req.Header.Set(xhttp.HeaderContentEncoding, prometheus.ZstdContentEncoding)
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, prometheus.AcceptedContentEncodings,
+		resp.Header.Get(xhttp.HeaderAcceptEncoding))
+}
+
+func TestPromWriteDrain(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		started = make(chan struct{})
+		unblock = make(chan struct{})
+	)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, _ ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			close(started)
+			<-unblock
+			return nil
+		})
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writeHandler := handler.(*PromWriteHandler)
+
+	inFlightDone := make(chan int)
+	go func() {
+		promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		inFlightDone <- writer.Result().StatusCode
+	}()
+	<-started
+
+	// Drain does not complete while a write is in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, writeHandler.Drain(ctx))
+
+	// New writes are rejected once draining.
+	promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusServiceUnavailable, writer.Result().StatusCode)
+
+	close(unblock)
+	require.Equal(t, http.StatusOK, <-inFlightDone)
+	require.NoError(t, writeHandler.Drain(context.Background()))
+}
+
 func TestPromWriteError(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
@@ -140,6 +906,205 @@ func TestPromWriteError(t *testing.T) {
 	require.True(t, bytes.Contains(body, []byte(batchErr.Error())))
 }
 
+func TestPromWriteErrorStatus(t *testing.T) {
+	// Prometheus retries writes that fail with a 5XX status and drops writes
+	// that fail with a 4XX status, so only errors that retrying can never
+	// fix may return a 4XX status.
+	var (
+		badRequestErr    = tterrors.NewBadRequestError(errors.New("bad request"))
+		invalidParamsErr = xerrors.NewInvalidParamsError(errors.New("invalid params"))
+		regularErr       = errors.New("regular")
+	)
+	tests := []struct {
+		name     string
+		errs     []error
+		expected int
+	}{
+		{
+			name:     "bad request",
+			errs:     []error{badRequestErr},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid params",
+			errs:     []error{invalidParamsErr},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name: "series errors",
+			errs: []error{
+				ingest.NewSeriesError(badRequestErr, 0),
+				ingest.NewSeriesError(invalidParamsErr, 1),
+			},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name:     "regular",
+			errs:     []error{regularErr},
+			expected: http.StatusInternalServerError,
+		},
+		{
+			name:     "retryable",
+			errs:     []error{xerrors.NewRetryableError(regularErr)},
+			expected: http.StatusInternalServerError,
+		},
+		{
+			name:     "non retryable",
+			errs:     []error{xerrors.NewNonRetryableError(regularErr)},
+			expected: http.StatusInternalServerError,
+		},
+		{
+			name:     "mixed",
+			errs:     []error{invalidParamsErr, regularErr},
+			expected: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := xtest.NewController(t)
+			defer ctrl.Finish()
+
+			multiErr := xerrors.NewMultiError()
+			for _, err := range tt.errs {
+				multiErr = multiErr.Add(err)
+			}
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+			mockDownsamplerAndWriter.EXPECT().
+				WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(multiErr)
+
+			handler, err := NewPromWriteHandler(makeOptions(mockDownsamplerAndWriter))
+			require.NoError(t, err)
+
+			promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+			req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			require.Equal(t, tt.expected, writer.Result().StatusCode)
+		})
+	}
+}
+
+func TestPromWritePartialSuccess(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	multiErr := xerrors.NewMultiError().
+		Add(ingest.NewSeriesError(errors.New("an error"), 1)).
+		Add(ingest.NewSeriesError(errors.New("another error"), 1))
+	batchErr := ingest.BatchError(multiErr)
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(batchErr).
+		Times(2)
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReq.Timeseries[1].Samples = promReq.Timeseries[1].Samples[:1]
+
+	// Without the header the whole request fails.
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusInternalServerError, writer.Result().StatusCode)
+
+	promReqBody = test.GeneratePromWriteRequestBody(t, promReq)
+	req = httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.PartialSuccessHeader, "true")
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get(headers.SamplesWrittenHeader))
+	assert.Equal(t, "1", resp.Header.Get(headers.SamplesFailedHeader))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"samplesWritten":2,"samplesFailed":1,`+
+		`"failedSeries":[{"index":1,"labels":{"__name__":"second","foo":"qux","bar":"baz"}}]}`, string(body))
+}
+
+func TestFirstFailedSeriesFields(t *testing.T) {
+	promReq := test.GeneratePromWriteRequest()
+	errs := []error{
+		errors.New("not a series error"),
+		ingest.NewSeriesError(errors.New("an error"), 1),
+		ingest.NewSeriesError(errors.New("another error"), 0),
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	zap.New(core).Info("write error", firstFailedSeriesFields(promReq, errs, [][]byte{metricNameLabel})...)
+	entry := logs.All()[0]
+
+	name, ok := labelValue(promReq.Timeseries[0].Labels, metricNameLabel)
+	require.True(t, ok)
+	fingerprint := seriesKey(promReq.Timeseries[0].Labels)
+	require.Equal(t, map[string]interface{}{
+		"firstFailedSeriesIndex":       int64(0),
+		"firstFailedSeriesName":        string(name),
+		"firstFailedSeriesFingerprint": hex.EncodeToString(fingerprint[:]),
+	}, entry.ContextMap())
+
+	require.Empty(t, firstFailedSeriesFields(promReq, errs[:1], [][]byte{metricNameLabel}))
+}
+
+func TestPromWritePartialSuccessUnknownSeries(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	multiErr := xerrors.NewMultiError().
+		Add(ingest.NewSeriesError(errors.New("an error"), 1)).
+		Add(errors.New("another error"))
+	batchErr := ingest.BatchError(multiErr)
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(batchErr)
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	// Errors that are not specific to a series fail the whole request.
+	promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.PartialSuccessHeader, "true")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusInternalServerError, writer.Result().StatusCode)
+}
+
+func TestPromWriteEmptyRequest(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	// No write is expected for an empty request.
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	scope := tally.NewTestScope("",
+		map[string]string{"test": "empty-metric-test"})
+	iopts := instrument.NewOptions().SetMetricsScope(scope)
+	opts := makeOptions(mockDownsamplerAndWriter).SetInstrumentOpts(iopts)
+
+	executeWriteRequest(t, opts, &prompb.WriteRequest{})
+
+	counters := scope.Snapshot().Counters()
+	empty, ok := counters["write.empty+handler=remote-write,test=empty-metric-test"]
+	require.True(t, ok)
+	assert.Equal(t, int64(1), empty.Value())
+	success, ok := counters["write.success+handler=remote-write,test=empty-metric-test"]
+	require.True(t, ok)
+	assert.Equal(t, int64(0), success.Value())
+}
+
 func TestWriteErrorMetricCount(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
@@ -164,6 +1129,35 @@ func TestWriteErrorMetricCount(t *testing.T) {
 	require.True(t, foundMetric)
 }
 
+func TestWritePhaseDurationMetrics(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	scope := tally.NewTestScope("",
+		map[string]string{"test": "phase-metric-test"})
+
+	iopts := instrument.NewOptions().SetMetricsScope(scope)
+	opts := makeOptions(mockDownsamplerAndWriter).SetInstrumentOpts(iopts)
+
+	executeWriteRequest(t, opts, test.GeneratePromWriteRequest())
+
+	histograms := scope.Snapshot().Histograms()
+	for _, name := range []string{"parse", "unmarshal", "write"} {
+		key := name + ".duration+handler=remote-write,test=phase-metric-test"
+		histogram, ok := histograms[key]
+		require.True(t, ok, key)
+
+		var count int64
+		for _, v := range histogram.Durations() {
+			count += v
+		}
+		assert.Equal(t, int64(1), count, key)
+	}
+}
+
 func TestWriteDatapointDelayMetric(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
@@ -222,6 +1216,36 @@ func TestWriteDatapointDelayMetric(t *testing.T) {
 	require.True(t, foundMetric)
 }
 
+func TestWriteDatapointDelayMetricDisabled(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	scope := tally.NewTestScope("",
+		map[string]string{"test": "delay-metric-disabled-test"})
+
+	iopts := instrument.NewOptions().SetMetricsScope(scope)
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetInstrumentOpts(iopts).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				DisableIngestLatencyMetric: true,
+			},
+		})
+
+	executeWriteRequest(t, opts, test.GeneratePromWriteRequest())
+
+	values, found := scope.Snapshot().Histograms()["ingest.latency+handler=remote-write,test=delay-metric-disabled-test"]
+	require.True(t, found)
+	for _, valuesInBucket := range values.Durations() {
+		require.Equal(t, int64(0), valuesInBucket)
+	}
+}
+
 func TestPromWriteUnaggregatedMetricsWithHeader(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
@@ -249,45 +1273,251 @@ func TestPromWriteUnaggregatedMetricsWithHeader(t *testing.T) {
 		storagemetadata.UnaggregatedMetricsType.String())
 
 	writer := httptest.NewRecorder()
-	handler.ServeHTTP(writer, req)
-	resp := writer.Result()
-	require.Equal(t, http.StatusOK, resp.StatusCode)
+	handler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPromWriteAggregatedMetricsWithHeader(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	expectedIngestWriteOptions := ingest.WriteOptions{
+		DownsampleOverride:     true,
+		DownsampleMappingRules: nil,
+		WriteOverride:          true,
+		WriteStoragePolicies: policy.StoragePolicies{
+			policy.MustParseStoragePolicy("1m:21d"),
+		},
+	}
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), expectedIngestWriteOptions)
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	writeHandler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Add(headers.MetricsTypeHeader,
+		storagemetadata.AggregatedMetricsType.String())
+	req.Header.Add(headers.MetricsStoragePolicyHeader,
+		"1m:21d")
+
+	writer := httptest.NewRecorder()
+	writeHandler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPromWriteAnnotationHeaders(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	expectedIngestWriteOptions := ingest.WriteOptions{
+		Annotations: map[string]string{
+			"source-cluster":   "east",
+			"pipeline-version": "v2",
+		},
+	}
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), expectedIngestWriteOptions)
+
+	opts := makeOptions(mockDownsamplerAndWriter)
+	writeHandler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.AnnotationHeaderPrefix+"Source-Cluster", "east")
+	req.Header.Set("m3-annotation-pipeline-version", "v2")
+
+	writer := httptest.NewRecorder()
+	writeHandler.ServeHTTP(writer, req)
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPromWriteInvalidStoragePolicyHeader(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	opts := makeOptions(mockDownsamplerAndWriter)
+	writeHandler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Add(headers.MetricsTypeHeader,
+		storagemetadata.AggregatedMetricsType.String())
+	req.Header.Add(headers.MetricsStoragePolicyHeader, "invalid")
+
+	_, err = writeHandler.(*PromWriteHandler).checkedParseRequest(req)
+	require.Error(t, err)
+	require.True(t, IsStoragePolicyParseError(err))
+	require.NotNil(t, xerrors.GetInnerInvalidParamsError(err))
+
+	parseErr, ok := xerrors.GetInnerInvalidParamsError(err).(StoragePolicyParseError)
+	require.True(t, ok)
+	require.Equal(t, "invalid", parseErr.Policy)
+
+	// Other invalid headers are not storage policy parse errors.
+	req = httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL,
+		test.GeneratePromWriteRequestBody(t, promReq))
+	req.Header.Add(headers.MetricsTypeHeader, "invalid")
+	_, err = writeHandler.(*PromWriteHandler).checkedParseRequest(req)
+	require.Error(t, err)
+	require.False(t, IsStoragePolicyParseError(err))
+}
+
+func TestPromWriteTagOptions(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	tagOpts := models.NewTagOptions().
+		SetMetricName([]byte("metric")).
+		SetIDSchemeType(models.TypePrependMeta)
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetTagOptions(tagOpts)
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	writeHandler, ok := handler.(*PromWriteHandler)
+	require.True(t, ok)
+	require.Equal(t, tagOpts, writeHandler.TagOptions())
+	require.Equal(t, []byte("metric"), writeHandler.TagOptions().MetricName())
+	require.Equal(t, models.TypePrependMeta, writeHandler.TagOptions().IDSchemeType())
+}
+
+func TestPromWriteLabelsSorted(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var written []models.Tags
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			for iter.Next() {
+				written = append(written, iter.Current().Tags)
+			}
+			return nil
+		})
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetTagOptions(models.NewTagOptions().SetMetricName([]byte("name"))).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				TrustSortedLabels: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	newRequest := func(labels ...prompb.Label) *http.Request {
+		promReq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{{
+				Labels:  labels,
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+			}},
+		}
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		req.Header.Set(headers.LabelsSortedHeader, "true")
+		return req
+	}
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest(
+		prompb.Label{Name: []byte("host"), Value: []byte("a")},
+		prompb.Label{Name: []byte("__name__"), Value: []byte("up")},
+	))
+	require.Equal(t, http.StatusBadRequest, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "series 0 labels are not sorted")
+
+	// Renaming the metric name tag leaves the tags out of order so they are
+	// still sorted when converted.
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest(
+		prompb.Label{Name: []byte("__name__"), Value: []byte("up")},
+		prompb.Label{Name: []byte("host"), Value: []byte("a")},
+	))
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	require.Len(t, written, 1)
+	require.Equal(t, []models.Tag{
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("name"), Value: []byte("up")},
+	}, written[0].Tags)
 }
 
-func TestPromWriteAggregatedMetricsWithHeader(t *testing.T) {
+func TestPromWriteWriteModeHeader(t *testing.T) {
 	ctrl := xtest.NewController(t)
 	defer ctrl.Finish()
 
-	expectedIngestWriteOptions := ingest.WriteOptions{
-		DownsampleOverride:     true,
-		DownsampleMappingRules: nil,
-		WriteOverride:          true,
-		WriteStoragePolicies: policy.StoragePolicies{
-			policy.MustParseStoragePolicy("1m:21d"),
-		},
-	}
-
 	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
 	mockDownsamplerAndWriter.
 		EXPECT().
-		WriteBatch(gomock.Any(), gomock.Any(), expectedIngestWriteOptions)
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
 
-	opts := makeOptions(mockDownsamplerAndWriter)
-	writeHandler, err := NewPromWriteHandler(opts)
+	handler, err := NewPromWriteHandler(makeOptions(mockDownsamplerAndWriter))
 	require.NoError(t, err)
 
-	promReq := test.GeneratePromWriteRequest()
-	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
-	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
-	req.Header.Add(headers.MetricsTypeHeader,
-		storagemetadata.AggregatedMetricsType.String())
-	req.Header.Add(headers.MetricsStoragePolicyHeader,
-		"1m:21d")
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: headers.BothWriteMode,
+		},
+		{
+			name:     "unaggregated",
+			headers:  map[string]string{headers.MetricsTypeHeader: "unaggregated"},
+			expected: headers.DirectWriteMode,
+		},
+		{
+			name: "aggregated",
+			headers: map[string]string{
+				headers.MetricsTypeHeader:          "aggregated",
+				headers.MetricsStoragePolicyHeader: "1m:48h",
+			},
+			expected: headers.DirectWriteMode,
+		},
+		{
+			name:     "aggregate write type",
+			headers:  map[string]string{headers.WriteTypeHeader: headers.AggregateWriteType},
+			expected: headers.DownsampledWriteMode,
+		},
+	}
 
-	writer := httptest.NewRecorder()
-	writeHandler.ServeHTTP(writer, req)
-	resp := writer.Result()
-	require.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+			req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			resp := writer.Result()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, tt.expected, resp.Header.Get(headers.WriteModeHeader))
+		})
+	}
 }
 
 func TestPromWriteMetricsTypes(t *testing.T) {
@@ -418,6 +1648,267 @@ func TestPromWriteDisabledMetricsTypes(t *testing.T) {
 	require.NoError(t, capturedIter.Error())
 }
 
+func TestPromWriteSeriesObserver(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	var observed []string
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetPromWriteSeriesObserver(func(labels []prompb.Label) {
+			for _, l := range labels {
+				if string(l.Name) == "__name__" {
+					observed = append(observed, string(l.Value))
+				}
+			}
+		})
+
+	executeWriteRequest(t, opts, test.GeneratePromWriteRequest())
+	require.Equal(t, []string{"first", "second"}, observed)
+}
+
+func TestPromWriteDecodedObserver(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	var observed [][]byte
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetPromWriteDecodedObserver(func(raw []byte) {
+			observed = append(observed, raw)
+		})
+
+	promReq := test.GeneratePromWriteRequest()
+	executeWriteRequest(t, opts, promReq)
+	require.Equal(t, 1, len(observed))
+
+	var decoded prompb.WriteRequest
+	require.NoError(t, proto.Unmarshal(observed[0], &decoded))
+	require.Equal(t, promReq.Timeseries, decoded.Timeseries)
+}
+
+func TestPromWriteConcurrency(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+	)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			var (
+				names    []string
+				batchErr xerrors.MultiError
+			)
+			for i := 0; iter.Next(); i++ {
+				name, _ := iter.Current().Tags.Name()
+				names = append(names, string(name))
+				if string(name) == "second" {
+					batchErr = batchErr.Add(ingest.NewSeriesError(errors.New("an error"), i))
+				}
+			}
+			lock.Lock()
+			batches = append(batches, names)
+			lock.Unlock()
+			if batchErr.Empty() {
+				return nil
+			}
+			return batchErr
+		}).
+		Times(2)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				WriteConcurrency: config.PromRemoteWriteConcurrencyConfiguration{
+					Shards:    2,
+					MinSeries: 2,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.PartialSuccessHeader, "true")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	// Each series is written by its own shard.
+	sort.Slice(batches, func(i, j int) bool { return batches[i][0] < batches[j][0] })
+	require.Equal(t, [][]string{{"first"}, {"second"}}, batches)
+
+	// The failed series is reported by its index and labels.
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	var resp partialSuccessResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+	require.Equal(t, []partialSuccessFailedSeries{
+		{Index: 1, Labels: map[string]string{"__name__": "second", "foo": "qux", "bar": "baz"}},
+	}, resp.FailedSeries)
+}
+
+type labelAuthorizer struct {
+	name, value string
+	sorted      []bool
+}
+
+func (a *labelAuthorizer) Allowed(_ context.Context, labels []prompb.Label) error {
+	a.sorted = append(a.sorted, sort.SliceIsSorted(labels, func(i, j int) bool {
+		return bytes.Compare(labels[i].Name, labels[j].Name) < 0
+	}))
+	for _, l := range labels {
+		if string(l.Name) == a.name && string(l.Value) == a.value {
+			return nil
+		}
+	}
+	return fmt.Errorf("missing label %s=%s", a.name, a.value)
+}
+
+func TestPromWriteAuthorizer(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	newRequest := func() *http.Request {
+		promReqBody := test.GeneratePromWriteRequestBody(t, test.GeneratePromWriteRequest())
+		return httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	}
+
+	// Reject mode fails the whole request.
+	authorizer := &labelAuthorizer{name: "foo", value: "bar"}
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetPromWriteAuthorizer(options.PromWriteAuthorizerOptions{
+			Authorizer: authorizer,
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusForbidden, writer.Result().StatusCode)
+	require.Contains(t, writer.Body.String(), "series 1 not authorized: missing label foo=bar")
+	require.Equal(t, []bool{true, true}, authorizer.sorted)
+
+	// Drop mode writes the authorized series.
+	var written []string
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			for iter.Next() {
+				name, _ := iter.Current().Tags.Name()
+				written = append(written, string(name))
+			}
+			return nil
+		})
+	opts = makeOptions(mockDownsamplerAndWriter).
+		SetPromWriteAuthorizer(options.PromWriteAuthorizerOptions{
+			Authorizer: &labelAuthorizer{name: "foo", value: "bar"},
+			Mode:       options.PromWriteAuthorizerModeDrop,
+		})
+	handler, err = NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest())
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	require.Equal(t, []string{"first"}, written)
+}
+
+func TestPromWriteLabelSampler(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any())
+
+	var observed int
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetPromWriteSeriesObserver(func(labels []prompb.Label) {
+			observed++
+		}).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				LabelSampler: config.PromRemoteWriteLabelSamplerConfiguration{
+					Enabled:  true,
+					Interval: time.Hour,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writeHandler := handler.(*PromWriteHandler)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	writeHandler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+
+	// The configured observer is still invoked alongside the sampler.
+	require.Equal(t, len(promReq.Timeseries), observed)
+	top, _ := writeHandler.labelSampler.sample()
+	require.NotEmpty(t, top)
+
+	require.NoError(t, writeHandler.Drain(context.Background()))
+}
+
+func TestPromWriteLowerCaseLabelNames(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var capturedIter ingest.DownsampleAndWriteIter
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			capturedIter = iter
+			return nil
+		})
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				LowerCaseLabelNames: true,
+			},
+		})
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: []byte("Host"), Value: []byte("a")}}},
+			{Labels: []prompb.Label{{Name: []byte("host"), Value: []byte("a")}}},
+			{Labels: []prompb.Label{{Name: []byte("HÖST"), Value: []byte("a")}}},
+		},
+	}
+
+	executeWriteRequest(t, opts, promReq)
+
+	for _, expected := range []string{"host", "host", "höst"} {
+		require.True(t, capturedIter.Next())
+		tags := capturedIter.Current().Tags.Tags
+		require.Equal(t, 1, len(tags))
+		assert.Equal(t, expected, string(tags[0].Name))
+	}
+	require.False(t, capturedIter.Next())
+	require.NoError(t, capturedIter.Error())
+}
+
 func BenchmarkWriteDatapoints(b *testing.B) {
 	ctrl := xtest.NewController(b)
 	defer ctrl.Finish()
@@ -443,6 +1934,231 @@ func BenchmarkWriteDatapoints(b *testing.B) {
 	}
 }
 
+func TestPromWriteIDOverrideLabel(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var capturedIter ingest.DownsampleAndWriteIter
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			capturedIter = iter
+			return nil
+		})
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				IDOverrideLabel: "__m3_id__",
+			},
+		})
+
+	labels := []prompb.Label{
+		{Name: []byte("__m3_id__"), Value: []byte("precomputed")},
+		{Name: []byte("host"), Value: []byte("a")},
+	}
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: labels},
+			{Labels: labels[1:]},
+		},
+	}
+
+	executeWriteRequest(t, opts, promReq)
+
+	require.True(t, capturedIter.Next())
+	value := capturedIter.Current()
+	assert.Equal(t, []byte("precomputed"), value.ID)
+	assert.Equal(t, []models.Tag{{Name: []byte("host"), Value: []byte("a")}}, value.Tags.Tags)
+
+	require.True(t, capturedIter.Next())
+	value = capturedIter.Current()
+	assert.Nil(t, value.ID)
+	assert.Equal(t, []models.Tag{{Name: []byte("host"), Value: []byte("a")}}, value.Tags.Tags)
+
+	require.False(t, capturedIter.Next())
+	require.NoError(t, capturedIter.Error())
+}
+
+func TestPromWriteTee(t *testing.T) {
+	for _, mode := range []options.PromWriteTeeMode{
+		options.PromWriteTeeModeMirror,
+		options.PromWriteTeeModeShadow,
+	} {
+		t.Run(fmt.Sprintf("mode=%d", mode), func(t *testing.T) {
+			ctrl := xtest.NewController(t)
+			defer ctrl.Finish()
+
+			var numPrimary, numSecondary int
+			primary := ingest.NewMockDownsamplerAndWriter(ctrl)
+			primary.EXPECT().
+				WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+				Do(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+					for iter.Next() {
+						numPrimary++
+					}
+					return nil
+				})
+
+			secondaryErr := xerrors.NewMultiError().Add(errors.New("secondary error"))
+			secondary := ingest.NewMockDownsamplerAndWriter(ctrl)
+			secondary.EXPECT().
+				WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+					for iter.Next() {
+						numSecondary++
+					}
+					return secondaryErr
+				})
+
+			scope := tally.NewTestScope("",
+				map[string]string{"test": "tee-test"})
+			opts := makeOptions(primary).
+				SetInstrumentOpts(instrument.NewOptions().SetMetricsScope(scope)).
+				SetPromWriteTee(options.PromWriteTeeOptions{
+					Writer: secondary,
+					Mode:   mode,
+				})
+
+			// Secondary errors are never returned to the client.
+			executeWriteRequest(t, opts, test.GeneratePromWriteRequest())
+
+			foundMetric := xclock.WaitUntil(func() bool {
+				found, ok := scope.Snapshot().Counters()["tee.errors+handler=remote-write,test=tee-test"]
+				return ok && found.Value() == 1
+			}, 5*time.Second)
+			require.True(t, foundMetric)
+			assert.Equal(t, 2, numPrimary)
+			assert.Equal(t, 2, numSecondary)
+		})
+	}
+}
+
+func TestDeterministicSeriesID(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: []byte("job"), Value: []byte("a")},
+		{Name: []byte("__name__"), Value: []byte("up")},
+		{Name: []byte("instance"), Value: []byte("b")},
+	}
+	reversed := []prompb.Label{labels[2], labels[1], labels[0]}
+
+	expected := `{__name__="up",instance="b",job="a"}`
+	assert.Equal(t, expected, string(DeterministicSeriesID(labels)))
+	assert.Equal(t, expected, string(DeterministicSeriesID(reversed)))
+
+	// The labels are not modified.
+	assert.Equal(t, "job", string(labels[0].Name))
+}
+
+func TestPromWriteDeterministicSeriesIDs(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	var capturedIter ingest.DownsampleAndWriteIter
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			capturedIter = iter
+			return nil
+		})
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetTagOptions(models.NewTagOptions().SetIDSchemeType(models.TypePrependMeta)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				IDOverrideLabel:        "__m3_id__",
+				DeterministicSeriesIDs: true,
+			},
+		})
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("__name__"), Value: []byte("up")},
+			}},
+			{Labels: []prompb.Label{
+				{Name: []byte("__m3_id__"), Value: []byte("precomputed")},
+				{Name: []byte("host"), Value: []byte("a")},
+			}},
+		},
+	}
+
+	executeWriteRequest(t, opts, promReq)
+
+	require.True(t, capturedIter.Next())
+	assert.Equal(t, `{__name__="up",host="a"}`, string(capturedIter.Current().ID))
+	require.True(t, capturedIter.Next())
+	assert.Equal(t, "precomputed", string(capturedIter.Current().ID))
+	require.False(t, capturedIter.Next())
+}
+
+func TestPreparedWriteRequestIter(t *testing.T) {
+	promReq := test.GeneratePromWriteRequest()
+	prepared, err := NewPreparedWriteRequest(promReq.Timeseries,
+		models.NewTagOptions(), false)
+	require.NoError(t, err)
+	require.Equal(t, len(promReq.Timeseries), prepared.Len())
+
+	first := prepared.Iter()
+	require.True(t, first.Next())
+	first.SetCurrentMetadata(ts.Metadata{DropUnaggregated: true})
+
+	// A second iterator starts from the beginning and does not observe
+	// metadata set on the first.
+	second := prepared.Iter()
+	for i := 0; i < prepared.Len(); i++ {
+		require.True(t, second.Next())
+		assert.Equal(t, ts.Metadata{}, second.Current().Metadata)
+		assert.Equal(t, promReq.Timeseries[i].Samples[0].Value,
+			second.Current().Datapoints[0].Value)
+	}
+	require.False(t, second.Next())
+	require.NoError(t, second.Error())
+
+	assert.True(t, first.Current().Metadata.DropUnaggregated)
+}
+
+func TestPreparedWriteRequestSingleSampleSeries(t *testing.T) {
+	promReq := test.GeneratePromWriteRequest()
+	promReq.Timeseries[0].Samples = promReq.Timeseries[0].Samples[:1]
+	promReq.Timeseries = append(promReq.Timeseries, prompb.TimeSeries{
+		Labels:  promReq.Timeseries[0].Labels,
+		Samples: []prompb.Sample{{Value: 42, Timestamp: 1000}},
+	})
+
+	prepared, err := NewPreparedWriteRequest(promReq.Timeseries,
+		models.NewTagOptions(), false)
+	require.NoError(t, err)
+
+	iter := prepared.Iter()
+	var values [][]float64
+	for iter.Next() {
+		var seriesValues []float64
+		for _, dp := range iter.Current().Datapoints {
+			seriesValues = append(seriesValues, dp.Value)
+		}
+		values = append(values, seriesValues)
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, [][]float64{{1}, {3, 4}, {42}}, values)
+
+	// Appending to the datapoints of a single sample series must not
+	// overwrite the datapoints of the next single sample series.
+	require.NoError(t, iter.Reset())
+	require.True(t, iter.Next())
+	first := iter.Current().Datapoints
+	assert.Equal(t, 1, cap(first))
+	_ = append(first, ts.Datapoint{Value: -1})
+	require.True(t, iter.Next())
+	require.True(t, iter.Next())
+	assert.Equal(t, 42.0, iter.Current().Datapoints[0].Value)
+}
+
 func verifyIterValueAnnotation(
 	t *testing.T,
 	iter ingest.DownsampleAndWriteIter,
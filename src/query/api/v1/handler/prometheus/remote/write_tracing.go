@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/tracepoint"
+	xopentracing "github.com/m3db/m3/src/x/opentracing"
+
+	"github.com/opentracing/opentracing-go"
+	opentracingext "github.com/opentracing/opentracing-go/ext"
+	opentracinglog "github.com/opentracing/opentracing-go/log"
+)
+
+// ServeHTTP writes the series of a remote write request within a span that
+// is a child of the span of the request context if there is one, or of the
+// span context propagated by the request headers otherwise, in whichever
+// formats the tracer supports such as W3C trace context. The span is tagged
+// with the number of series and samples and with the response status, and
+// has child spans for parsing and writing the request. When no tracer is
+// configured the global noop tracer is used and nothing is traced.
+func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var opts []opentracing.StartSpanOption
+	if opentracing.SpanFromContext(ctx) == nil {
+		tracer := opentracing.GlobalTracer()
+		if parent, err := tracer.Extract(opentracing.HTTPHeaders,
+			opentracing.HTTPHeadersCarrier(r.Header)); err == nil {
+			opts = append(opts, opentracing.ChildOf(parent))
+		}
+	}
+
+	span, ctx := xopentracing.StartSpanFromContext(ctx, tracepoint.PromWriteServeHTTP, opts...)
+	defer span.Finish()
+	if _, noop := span.Tracer().(opentracing.NoopTracer); noop {
+		h.serveHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.serveHTTP(recorder, r.WithContext(ctx))
+	opentracingext.HTTPStatusCode.Set(span, uint16(recorder.status))
+	if recorder.status >= http.StatusInternalServerError {
+		opentracingext.Error.Set(span, true)
+	}
+}
+
+// statusRecorder records the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush flushes the response if the underlying writer supports flushing.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// tagRequestSpan tags the span of the request context with the number of
+// series and samples in the request.
+func tagRequestSpan(ctx context.Context, req *prompb.WriteRequest) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	if _, noop := span.Tracer().(opentracing.NoopTracer); noop {
+		return
+	}
+
+	var numSamples int
+	for _, series := range req.Timeseries {
+		numSamples += len(series.Samples)
+	}
+	span.SetTag("series", len(req.Timeseries))
+	span.SetTag("samples", numSamples)
+}
+
+// finishSpan finishes the span of a phase of the request, marking it as
+// failed if the phase returned an error.
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		opentracingext.Error.Set(span, true)
+		span.LogFields(opentracinglog.Error(err))
+	}
+	span.Finish()
+}
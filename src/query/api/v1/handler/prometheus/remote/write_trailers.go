@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/x/headers"
+	xhttp "github.com/m3db/m3/src/x/net/http"
+)
+
+// resultTrailersWriter is a response writer for a write that has already
+// been sent a 200 status, the status the write responds with once complete
+// is recorded and reported in a trailer instead.
+type resultTrailersWriter struct {
+	http.ResponseWriter
+	status int
+	err    string
+}
+
+// startResultTrailers declares the result trailers and sends a 200 status,
+// the result is false if the response cannot be flushed before the write.
+func startResultTrailers(w http.ResponseWriter) (*resultTrailersWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Trailer", headers.WriteStatusTrailer+", "+headers.FailedCountTrailer+
+		", "+headers.WriteErrorTrailer)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &resultTrailersWriter{ResponseWriter: w, status: http.StatusOK}, true
+}
+
+func (w *resultTrailersWriter) WriteHeader(status int) {
+	// The status has already been sent.
+	w.status = status
+}
+
+// WriteError records the error the write failed with, the body cannot be
+// written with the error since a 200 status has already been sent.
+func (w *resultTrailersWriter) WriteError(err xhttp.Error) {
+	w.status = err.Code()
+	w.err = err.Error()
+}
+
+// Finish sets the trailers with the status the write responded with, the
+// number of series that failed to be written and the error the write failed
+// with, if any.
+func (w *resultTrailersWriter) Finish(failed int) {
+	w.Header().Set(headers.WriteStatusTrailer, strconv.Itoa(w.status))
+	w.Header().Set(headers.FailedCountTrailer, strconv.Itoa(failed))
+	if w.err != "" {
+		w.Header().Set(headers.WriteErrorTrailer, w.err)
+	}
+}
+
+// numFailedSeries returns the number of series of the request that failed to
+// be written, all of the series failed if any error was not for a series.
+func numFailedSeries(batchErr ingest.BatchError, numSeries int) int {
+	if batchErr == nil {
+		return 0
+	}
+	if failed, ok := failedSeries(batchErr); ok {
+		return len(failed)
+	}
+	return numSeries
+}
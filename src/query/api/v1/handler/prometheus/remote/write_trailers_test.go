@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/x/headers"
+	xtest "github.com/m3db/m3/src/x/test"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromWriteResultTrailers(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(seriesBatchError(ingest.NewSeriesError(errors.New("unavailable"), 0))).
+		Times(2)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				ResultTrailers: true,
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	newRequest := func(protoMajor int) *http.Request {
+		promReq := test.GeneratePromWriteRequest()
+		promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+		req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+		req.ProtoMajor = protoMajor
+		req.Header.Set(headers.ResultTrailersHeader, "true")
+		return req
+	}
+
+	// HTTP/2 clients are sent a 200 status with the result in trailers.
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest(2))
+	resp := writer.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "500", resp.Trailer.Get(headers.WriteStatusTrailer))
+	require.Equal(t, "1", resp.Trailer.Get(headers.FailedCountTrailer))
+	require.Contains(t, resp.Trailer.Get(headers.WriteErrorTrailer), "unavailable")
+	// The error is not written to the body after the status has been sent.
+	require.Empty(t, writer.Body.String())
+
+	// Other clients are sent the result synchronously.
+	writer = httptest.NewRecorder()
+	handler.ServeHTTP(writer, newRequest(1))
+	resp = writer.Result()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Empty(t, resp.Trailer)
+}
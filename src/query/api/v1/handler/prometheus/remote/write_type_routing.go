@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+)
+
+type metricTypeClass int
+
+const (
+	metricTypeUnclassified metricTypeClass = iota
+	metricTypeCounter
+	metricTypeGauge
+	metricTypeHistogram
+	metricTypeSummary
+
+	numMetricTypeClasses
+)
+
+var (
+	counterSuffix         = []byte("_total")
+	histogramBucketSuffix = []byte("_bucket")
+	histogramSumSuffix    = []byte("_sum")
+	histogramCountSuffix  = []byte("_count")
+)
+
+// metricTypeRouter routes series to storage policies by their metric type.
+type metricTypeRouter struct {
+	policies [numMetricTypeClasses]policy.StoragePolicies
+}
+
+// newMetricTypeRouter returns a router for the configured storage policies
+// or nil if no storage policies are configured for any metric type.
+func newMetricTypeRouter(
+	cfg config.PromRemoteWriteTypeStoragePoliciesConfiguration,
+) *metricTypeRouter {
+	if len(cfg.Counter) == 0 && len(cfg.Gauge) == 0 &&
+		len(cfg.Histogram) == 0 && len(cfg.Summary) == 0 {
+		return nil
+	}
+
+	var r metricTypeRouter
+	r.policies[metricTypeCounter] = cfg.Counter
+	r.policies[metricTypeGauge] = cfg.Gauge
+	r.policies[metricTypeHistogram] = cfg.Histogram
+	r.policies[metricTypeSummary] = cfg.Summary
+	return &r
+}
+
+// Policies returns the metric type of the series and the storage policies
+// it is routed to, series of types without policies are unclassified and
+// are written with the write options of the request.
+func (r *metricTypeRouter) Policies(
+	series prompb.TimeSeries,
+) (metricTypeClass, policy.StoragePolicies) {
+	class := classifyMetricType(series)
+	if len(r.policies[class]) == 0 {
+		return metricTypeUnclassified, nil
+	}
+	return class, r.policies[class]
+}
+
+// classifyMetricType returns the metric type of the series from its type
+// metadata if present, or otherwise from the suffix of its metric name.
+// Counters are identified by a _total suffix and histograms by a _bucket,
+// _sum or _count suffix, so summaries without type metadata are classified
+// as histograms.
+func classifyMetricType(series prompb.TimeSeries) metricTypeClass {
+	switch series.Type {
+	case prompb.MetricType_COUNTER:
+		return metricTypeCounter
+	case prompb.MetricType_GAUGE:
+		return metricTypeGauge
+	case prompb.MetricType_HISTOGRAM, prompb.MetricType_GAUGE_HISTOGRAM:
+		return metricTypeHistogram
+	case prompb.MetricType_SUMMARY:
+		return metricTypeSummary
+	}
+
+	for _, label := range series.Labels {
+		if !bytes.Equal(label.Name, metricNameLabel) {
+			continue
+		}
+		switch name := label.Value; {
+		case bytes.HasSuffix(name, counterSuffix):
+			return metricTypeCounter
+		case bytes.HasSuffix(name, histogramBucketSuffix),
+			bytes.HasSuffix(name, histogramSumSuffix),
+			bytes.HasSuffix(name, histogramCountSuffix):
+			return metricTypeHistogram
+		}
+		return metricTypeUnclassified
+	}
+	return metricTypeUnclassified
+}
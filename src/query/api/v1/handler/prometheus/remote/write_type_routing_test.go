@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xerrors "github.com/m3db/m3/src/x/errors"
+	"github.com/m3db/m3/src/x/headers"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyMetricType(t *testing.T) {
+	tests := []struct {
+		series   prompb.TimeSeries
+		expected metricTypeClass
+	}{
+		{test.NewSeries("requests_total", "job", "test"), metricTypeCounter},
+		{test.NewSeries("latency_bucket", "job", "test"), metricTypeHistogram},
+		{test.NewSeries("latency_sum", "job", "test"), metricTypeHistogram},
+		{test.NewSeries("latency_count", "job", "test"), metricTypeHistogram},
+		{test.NewSeries("memory_bytes", "job", "test"), metricTypeUnclassified},
+		// Type metadata takes precedence over the name.
+		{test.WithType(test.NewSeries("requests_total", "job", "test"), prompb.MetricType_GAUGE), metricTypeGauge},
+		{test.WithType(test.NewSeries("latency_sum", "job", "test"), prompb.MetricType_SUMMARY), metricTypeSummary},
+		{test.WithType(test.NewSeries("latency", "job", "test"), prompb.MetricType_GAUGE_HISTOGRAM), metricTypeHistogram},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, classifyMetricType(tt.series),
+			string(tt.series.Labels[1].Value))
+	}
+}
+
+func TestMetricTypeRouterPolicies(t *testing.T) {
+	counterPolicies := []policy.StoragePolicy{
+		policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+	}
+	require.Nil(t, newMetricTypeRouter(config.PromRemoteWriteTypeStoragePoliciesConfiguration{}))
+	r := newMetricTypeRouter(config.PromRemoteWriteTypeStoragePoliciesConfiguration{
+		Counter: counterPolicies,
+	})
+	require.NotNil(t, r)
+
+	class, policies := r.Policies(test.NewSeries("requests_total", "job", "test"))
+	require.Equal(t, metricTypeCounter, class)
+	require.Equal(t, policy.StoragePolicies(counterPolicies), policies)
+
+	// Histograms have no policies so are unclassified.
+	class, policies = r.Policies(test.NewSeries("latency_bucket", "job", "test"))
+	require.Equal(t, metricTypeUnclassified, class)
+	require.Nil(t, policies)
+}
+
+func TestPromWriteTypeStoragePolicies(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	counterPolicies := policy.StoragePolicies{
+		policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+	}
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), ingest.WriteOptions{}).
+		Return(nil)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), ingest.WriteOptions{
+			DownsampleOverride:   true,
+			WriteOverride:        true,
+			WriteStoragePolicies: counterPolicies,
+		}).
+		// The series error index is relative to the counter batch.
+		Return(xerrors.NewMultiError().Add(
+			ingest.NewSeriesError(errors.New("an error"), 0)))
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				TypeStoragePolicies: config.PromRemoteWriteTypeStoragePoliciesConfiguration{
+					Counter: counterPolicies,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			test.NewSeries("memory_bytes", "job", "test"),
+			test.NewSeries("requests_total", "job", "test"),
+		},
+	}
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	req.Header.Set(headers.PartialSuccessHeader, "true")
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	// The failed counter is reported by its labels.
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	var resp partialSuccessResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+	require.Len(t, resp.FailedSeries, 1)
+	require.Equal(t, "requests_total", resp.FailedSeries[0].Labels["__name__"])
+	require.Equal(t, 1, resp.SamplesWritten)
+}
+
+func TestPromWriteTypeStoragePoliciesFailFast(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	// Only the first route is written since its write fails.
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), ingest.WriteOptions{FailFast: true}).
+		Return(xerrors.NewMultiError().Add(errors.New("an error")))
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				FailFast: true,
+				TypeStoragePolicies: config.PromRemoteWriteTypeStoragePoliciesConfiguration{
+					Counter: policy.StoragePolicies{
+						policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+					},
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+
+	promReq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			test.NewSeries("memory_bytes", "job", "test"),
+			test.NewSeries("requests_total", "job", "test"),
+		},
+	}
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusInternalServerError, writer.Result().StatusCode)
+}
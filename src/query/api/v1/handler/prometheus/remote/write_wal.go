@@ -0,0 +1,357 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	defaultWALMaxSegmentSize = 64 << 20
+
+	walSegmentPrefix = "segment-"
+	walSegmentSuffix = ".wal"
+
+	// walRecordHeaderSize is the size of the record type, sequence number,
+	// payload length and payload checksum preceding each payload.
+	walRecordHeaderSize = 1 + 8 + 4 + 4
+
+	walRecordEntry walRecordType = 1
+	walRecordDone  walRecordType = 2
+)
+
+var errWALClosed = errors.New("write ahead log is closed")
+
+type walRecordType byte
+
+// walEntry identifies a batch appended to the write ahead log.
+type walEntry struct {
+	segment *walSegment
+	seq     uint64
+}
+
+type walSegment struct {
+	path    string
+	file    *os.File
+	size    int64
+	pending int
+	rotated bool
+}
+
+// writeAheadLog persists accepted batches to segment files on local disk
+// before they are written so that batches that were accepted but not yet
+// written when the process exited can be replayed on start up. Each batch
+// is appended as an entry record, which is synced to disk before Append
+// returns, and a done record is appended once the batch has been written.
+// Segments are rotated once they reach a max size and are removed once all
+// of their entries are done.
+type writeAheadLog struct {
+	sync.Mutex
+
+	dir            string
+	maxSegmentSize int64
+	current        *walSegment
+	// rotated are the rotated segments with entries that are not yet done.
+	rotated     map[*walSegment]struct{}
+	nextSegment uint64
+	nextSeq     uint64
+	closed      bool
+}
+
+// openWriteAheadLog opens a write ahead log in the given directory, creating
+// the directory if it does not exist. It returns the paths of the segments
+// left by a previous process in the order they were written, which must be
+// replayed with replayWALSegment.
+func openWriteAheadLog(dir string, maxSegmentSize int64) (*writeAheadLog, []string, error) {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = defaultWALMaxSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	existing, next, err := listWALSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &writeAheadLog{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		rotated:        make(map[*walSegment]struct{}),
+		nextSegment:    next,
+	}
+	if err := w.rotateWithLock(); err != nil {
+		return nil, nil, err
+	}
+	return w, existing, nil
+}
+
+// listWALSegments returns the paths of the segments in the directory in the
+// order they were written and the index to use for the next segment.
+func listWALSegments(dir string) ([]string, uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		indexes = make(map[string]uint64, len(matches))
+		next    uint64
+	)
+	for _, path := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), walSegmentPrefix), walSegmentSuffix)
+		index, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid write ahead log segment: %s", path)
+		}
+		indexes[path] = index
+		if index >= next {
+			next = index + 1
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return indexes[matches[i]] < indexes[matches[j]]
+	})
+	return matches, next, nil
+}
+
+// Append persists the series of a batch with timestamps of the given unit,
+// the returned entry must be passed to Done once the batch is written.
+func (w *writeAheadLog) Append(series []prompb.TimeSeries, unit xtime.Unit) (walEntry, error) {
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	if err != nil {
+		return walEntry{}, err
+	}
+	payload := make([]byte, 0, 1+len(data))
+	payload = append(payload, byte(unit))
+	payload = append(payload, data...)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return walEntry{}, errWALClosed
+	}
+	if w.current.size >= w.maxSegmentSize {
+		if err := w.rotateWithLock(); err != nil {
+			return walEntry{}, err
+		}
+	}
+
+	segment := w.current
+	seq := w.nextSeq
+	err = segment.append(walRecordEntry, seq, payload)
+	if err == nil {
+		err = segment.file.Sync()
+	}
+	if err != nil {
+		// Start a new segment so that no further records are appended
+		// after a record that may be partially written.
+		if rotateErr := w.rotateWithLock(); rotateErr != nil {
+			return walEntry{}, fmt.Errorf("%v: could not rotate segment: %v", err, rotateErr)
+		}
+		return walEntry{}, err
+	}
+	w.nextSeq++
+	segment.pending++
+	return walEntry{segment: segment, seq: seq}, nil
+}
+
+// Done marks the batch as written so that it is not replayed. The done
+// record is not synced to disk since losing it only results in the batch
+// being written again on replay.
+func (w *writeAheadLog) Done(entry walEntry) error {
+	w.Lock()
+	defer w.Unlock()
+
+	segment := entry.segment
+	if segment.file == nil {
+		return errWALClosed
+	}
+	segment.pending--
+	if err := segment.append(walRecordDone, entry.seq, nil); err != nil {
+		return err
+	}
+	if segment.rotated && segment.pending == 0 {
+		delete(w.rotated, segment)
+		return segment.remove()
+	}
+	return nil
+}
+
+// Close closes the write ahead log, segments with entries that are not yet
+// done are retained to be replayed on start up.
+func (w *writeAheadLog) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	for segment := range w.rotated {
+		segment.file.Close()
+		segment.file = nil
+		delete(w.rotated, segment)
+	}
+	if w.current.pending == 0 {
+		return w.current.remove()
+	}
+	err := w.current.file.Close()
+	w.current.file = nil
+	return err
+}
+
+func (w *writeAheadLog) rotateWithLock() error {
+	path := filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, w.nextSegment, walSegmentSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if prev := w.current; prev != nil {
+		prev.rotated = true
+		if prev.pending > 0 {
+			w.rotated[prev] = struct{}{}
+		} else if err := prev.remove(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	w.current = &walSegment{path: path, file: file}
+	w.nextSegment++
+	return nil
+}
+
+func (s *walSegment) append(typ walRecordType, seq uint64, payload []byte) error {
+	var header [walRecordHeaderSize]byte
+	header[0] = byte(typ)
+	binary.LittleEndian.PutUint64(header[1:9], seq)
+	binary.LittleEndian.PutUint32(header[9:13], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[13:17], crc32.ChecksumIEEE(payload))
+
+	// Write the header and payload together so that a failed write leaves
+	// at most a truncated record at the end of the segment.
+	record := append(header[:], payload...)
+	n, err := s.file.Write(record)
+	s.size += int64(n)
+	return err
+}
+
+func (s *walSegment) remove() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	return os.Remove(s.path)
+}
+
+// walReplayFn writes a batch replayed from the write ahead log.
+type walReplayFn func(series []prompb.TimeSeries, unit xtime.Unit)
+
+// replayWALSegment calls replayFn with each batch in the segment that is
+// not done and then removes the segment. A truncated or corrupt record ends
+// the segment since it can only be the result of a partial write, any
+// entries before it are still replayed. A record with a length greater than
+// the remaining size of the segment is treated as corrupt before its payload
+// is allocated.
+func replayWALSegment(path string, replayFn walReplayFn) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	var (
+		r         = bufio.NewReader(file)
+		remaining = info.Size()
+		entries   = make(map[uint64][]byte)
+		order     []uint64
+		header    [walRecordHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		remaining -= walRecordHeaderSize
+		typ := walRecordType(header[0])
+		seq := binary.LittleEndian.Uint64(header[1:9])
+		size := int64(binary.LittleEndian.Uint32(header[9:13]))
+		if size > remaining {
+			break
+		}
+		remaining -= size
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[13:17]) {
+			break
+		}
+
+		switch typ {
+		case walRecordEntry:
+			entries[seq] = payload
+			order = append(order, seq)
+		case walRecordDone:
+			delete(entries, seq)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	for _, seq := range order {
+		payload, ok := entries[seq]
+		if !ok || len(payload) == 0 {
+			continue
+		}
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(payload[1:], &req); err != nil {
+			return fmt.Errorf("could not decode write ahead log entry: %v", err)
+		}
+		replayFn(req.Timeseries, xtime.Unit(payload[0]))
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	xtest "github.com/m3db/m3/src/x/test"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWALDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "remote-write-wal")
+	require.NoError(t, err)
+	return dir
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	segments, _, err := listWALSegments(dir)
+	require.NoError(t, err)
+	return segments
+}
+
+func replayedSeries(t *testing.T, dir string) [][]prompb.TimeSeries {
+	var replayed [][]prompb.TimeSeries
+	for _, path := range walSegments(t, dir) {
+		err := replayWALSegment(path, func(series []prompb.TimeSeries, unit xtime.Unit) {
+			require.Equal(t, xtime.Millisecond, unit)
+			replayed = append(replayed, series)
+		})
+		require.NoError(t, err)
+	}
+	return replayed
+}
+
+func TestWriteAheadLogReplaysPending(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+
+	wal, existing, err := openWriteAheadLog(dir, 0)
+	require.NoError(t, err)
+	require.Empty(t, existing)
+
+	series := test.GeneratePromWriteRequest().Timeseries
+	done, err := wal.Append(series[:1], xtime.Millisecond)
+	require.NoError(t, err)
+	_, err = wal.Append(series[1:], xtime.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, wal.Done(done))
+	require.NoError(t, wal.Close())
+
+	// Only the entry that is not done is replayed, after which the segment
+	// is removed.
+	replayed := replayedSeries(t, dir)
+	require.Equal(t, [][]prompb.TimeSeries{series[1:]}, replayed)
+	require.Empty(t, walSegments(t, dir))
+}
+
+func TestWriteAheadLogRemovesDoneSegments(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+
+	// Rotate on every append.
+	wal, _, err := openWriteAheadLog(dir, 1)
+	require.NoError(t, err)
+
+	series := test.GeneratePromWriteRequest().Timeseries
+	first, err := wal.Append(series, xtime.Millisecond)
+	require.NoError(t, err)
+	second, err := wal.Append(series, xtime.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, walSegments(t, dir), 2)
+
+	// The rotated segment is removed once all of its entries are done.
+	require.NoError(t, wal.Done(first))
+	require.Len(t, walSegments(t, dir), 1)
+
+	require.NoError(t, wal.Done(second))
+	require.NoError(t, wal.Close())
+	require.Empty(t, walSegments(t, dir))
+}
+
+func TestWriteAheadLogReplayTruncated(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+
+	wal, _, err := openWriteAheadLog(dir, 0)
+	require.NoError(t, err)
+	series := test.GeneratePromWriteRequest().Timeseries
+	_, err = wal.Append(series, xtime.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	// Simulate a partially written record following the complete entry.
+	segments := walSegments(t, dir)
+	require.Len(t, segments, 1)
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{byte(walRecordEntry), 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	replayed := replayedSeries(t, dir)
+	require.Equal(t, [][]prompb.TimeSeries{series}, replayed)
+}
+
+func TestWriteAheadLogReplayCorruptLength(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+
+	wal, _, err := openWriteAheadLog(dir, 0)
+	require.NoError(t, err)
+	series := test.GeneratePromWriteRequest().Timeseries
+	_, err = wal.Append(series, xtime.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	// Simulate a record with a corrupt length following the complete entry,
+	// replay must stop at it rather than allocating the length.
+	segments := walSegments(t, dir)
+	require.Len(t, segments, 1)
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	var header [walRecordHeaderSize]byte
+	header[0] = byte(walRecordEntry)
+	binary.LittleEndian.PutUint64(header[1:9], 1)
+	binary.LittleEndian.PutUint32(header[9:13], math.MaxUint32)
+	_, err = f.Write(header[:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	replayed := replayedSeries(t, dir)
+	require.Equal(t, [][]prompb.TimeSeries{series}, replayed)
+}
+
+func TestPromWriteWAL(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+
+	// Leave a pending entry as if a previous process exited before it was
+	// written.
+	wal, _, err := openWriteAheadLog(dir, 0)
+	require.NoError(t, err)
+	pending := test.GeneratePromWriteRequest().Timeseries[:1]
+	_, err = wal.Append(pending, xtime.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	var written []int
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.
+		EXPECT().
+		WriteBatch(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, iter ingest.DownsampleAndWriteIter, _ ingest.WriteOptions) ingest.BatchError {
+			var n int
+			for iter.Next() {
+				n++
+			}
+			written = append(written, n)
+			return nil
+		}).
+		Times(2)
+
+	opts := makeOptions(mockDownsamplerAndWriter).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				WAL: config.PromRemoteWriteWALConfiguration{
+					Enabled: true,
+					Path:    dir,
+				},
+			},
+		})
+	handler, err := NewPromWriteHandler(opts)
+	require.NoError(t, err)
+	writeHandler := handler.(*PromWriteHandler)
+
+	// The pending entry is replayed on start up.
+	require.Equal(t, []int{1}, written)
+
+	promReq := test.GeneratePromWriteRequest()
+	promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+	req := httptest.NewRequest(PromWriteHTTPMethod, PromWriteURL, promReqBody)
+	writer := httptest.NewRecorder()
+	writeHandler.ServeHTTP(writer, req)
+	require.Equal(t, http.StatusOK, writer.Result().StatusCode)
+	require.Equal(t, []int{1, 2}, written)
+
+	// All entries are done so no segments are retained once drained.
+	require.NoError(t, writeHandler.Drain(context.Background()))
+	require.Empty(t, walSegments(t, dir))
+}
+
+func TestPromWriteWALRequiresPath(t *testing.T) {
+	ctrl := xtest.NewController(t)
+	defer ctrl.Finish()
+
+	opts := makeOptions(ingest.NewMockDownsamplerAndWriter(ctrl)).
+		SetConfig(config.Configuration{
+			PromRemoteWrite: config.PromRemoteWriteConfiguration{
+				WAL: config.PromRemoteWriteWALConfiguration{Enabled: true},
+			},
+		})
+	_, err := NewPromWriteHandler(opts)
+	require.Equal(t, errNoWALPath, err)
+}
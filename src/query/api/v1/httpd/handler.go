@@ -259,6 +259,15 @@ func (h *Handler) RegisterRoutes() error {
 	}, logging.WithNoResponseLog()); err != nil {
 		return err
 	}
+	if writeHandler, ok := promRemoteWriteHandler.(*remote.PromWriteHandler); ok {
+		if err := h.registry.Register(queryhttp.RegisterOptions{
+			Path:    remote.PromWriteFreezeURL,
+			Handler: writeHandler.FreezeHandler(),
+			Methods: remote.PromWriteFreezeHTTPMethods,
+		}); err != nil {
+			return err
+		}
+	}
 
 	// InfluxDB write endpoint.
 	if err := h.registry.Register(queryhttp.RegisterOptions{
@@ -21,6 +21,7 @@
 package options
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"strings"
@@ -34,6 +35,7 @@ import (
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/handleroptions"
 	"github.com/m3db/m3/src/query/api/v1/validators"
 	"github.com/m3db/m3/src/query/executor"
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
 	graphite "github.com/m3db/m3/src/query/graphite/storage"
 	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/query/storage"
@@ -215,6 +217,30 @@ type HandlerOptions interface {
 	SetNamespaceValidator(NamespaceValidator) HandlerOptions
 	// NamespaceValidator returns the NamespaceValidator.
 	NamespaceValidator() NamespaceValidator
+
+	// SetPromWriteSeriesObserver sets the observer invoked for each series
+	// decoded by the Prometheus remote write handler.
+	SetPromWriteSeriesObserver(value PromWriteSeriesObserver) HandlerOptions
+	// PromWriteSeriesObserver returns the Prometheus remote write series observer.
+	PromWriteSeriesObserver() PromWriteSeriesObserver
+
+	// SetPromWriteTee sets the secondary writer that the Prometheus remote
+	// write handler tees writes to.
+	SetPromWriteTee(value PromWriteTeeOptions) HandlerOptions
+	// PromWriteTee returns the Prometheus remote write tee options.
+	PromWriteTee() PromWriteTeeOptions
+
+	// SetPromWriteAuthorizer sets the authorizer that the Prometheus remote
+	// write handler checks each series with.
+	SetPromWriteAuthorizer(value PromWriteAuthorizerOptions) HandlerOptions
+	// PromWriteAuthorizer returns the Prometheus remote write authorizer options.
+	PromWriteAuthorizer() PromWriteAuthorizerOptions
+
+	// SetPromWriteDecodedObserver sets the observer invoked with the
+	// decompressed body of each Prometheus remote write request.
+	SetPromWriteDecodedObserver(value PromWriteDecodedObserver) HandlerOptions
+	// PromWriteDecodedObserver returns the Prometheus remote write decoded observer.
+	PromWriteDecodedObserver() PromWriteDecodedObserver
 }
 
 // HandlerOptions represents handler options.
@@ -243,6 +269,10 @@ type handlerOptions struct {
 	m3dbOpts              m3db.Options
 	namespaceValidator    NamespaceValidator
 	storeMetricsType      bool
+	promWriteObserver     PromWriteSeriesObserver
+	promWriteTee          PromWriteTeeOptions
+	promWriteAuthorizer   PromWriteAuthorizerOptions
+	promWriteDecoded      PromWriteDecodedObserver
 }
 
 // EmptyHandlerOptions returns  default handler options.
@@ -567,6 +597,115 @@ func (o *handlerOptions) NamespaceValidator() NamespaceValidator {
 	return o.namespaceValidator
 }
 
+func (o *handlerOptions) SetPromWriteSeriesObserver(value PromWriteSeriesObserver) HandlerOptions {
+	opts := *o
+	opts.promWriteObserver = value
+	return &opts
+}
+
+func (o *handlerOptions) PromWriteSeriesObserver() PromWriteSeriesObserver {
+	return o.promWriteObserver
+}
+
+func (o *handlerOptions) SetPromWriteTee(value PromWriteTeeOptions) HandlerOptions {
+	opts := *o
+	opts.promWriteTee = value
+	return &opts
+}
+
+func (o *handlerOptions) PromWriteTee() PromWriteTeeOptions {
+	return o.promWriteTee
+}
+
+func (o *handlerOptions) SetPromWriteAuthorizer(value PromWriteAuthorizerOptions) HandlerOptions {
+	opts := *o
+	opts.promWriteAuthorizer = value
+	return &opts
+}
+
+func (o *handlerOptions) PromWriteAuthorizer() PromWriteAuthorizerOptions {
+	return o.promWriteAuthorizer
+}
+
+func (o *handlerOptions) SetPromWriteDecodedObserver(value PromWriteDecodedObserver) HandlerOptions {
+	opts := *o
+	opts.promWriteDecoded = value
+	return &opts
+}
+
+func (o *handlerOptions) PromWriteDecodedObserver() PromWriteDecodedObserver {
+	return o.promWriteDecoded
+}
+
+// PromWriteTeeMode is the mode used to tee Prometheus remote writes to a
+// secondary writer.
+type PromWriteTeeMode uint
+
+const (
+	// PromWriteTeeModeMirror writes to both the primary and secondary writer
+	// before responding, only the result of the primary write is returned.
+	PromWriteTeeModeMirror PromWriteTeeMode = iota
+	// PromWriteTeeModeShadow writes to the secondary writer asynchronously
+	// and does not wait for it to complete.
+	PromWriteTeeModeShadow
+)
+
+// PromWriteTeeOptions configures teeing Prometheus remote writes to a
+// secondary writer, such as when dual writing during a storage migration.
+// Errors from the secondary writer are never returned to clients.
+type PromWriteTeeOptions struct {
+	// Writer is the secondary writer, if nil then writes are not teed.
+	Writer ingest.DownsamplerAndWriter
+	// Mode is the tee mode.
+	Mode PromWriteTeeMode
+}
+
+// PromWriteAuthorizer authorizes the series written by Prometheus remote
+// write requests, such as to only allow a team to write series with its
+// team label. It is invoked once per series after the request has been
+// authenticated so implementations must be cheap.
+type PromWriteAuthorizer interface {
+	// Allowed returns an error if the series with the given labels may not
+	// be written. The labels are sorted by name and are only valid for the
+	// duration of the call.
+	Allowed(ctx context.Context, labels []prompb.Label) error
+}
+
+// PromWriteAuthorizerMode is how the Prometheus remote write handler treats
+// series that are not authorized.
+type PromWriteAuthorizerMode uint
+
+const (
+	// PromWriteAuthorizerModeReject rejects the whole request with a 403
+	// status if any series is not authorized.
+	PromWriteAuthorizerModeReject PromWriteAuthorizerMode = iota
+	// PromWriteAuthorizerModeDrop drops the series that are not authorized
+	// and writes the rest of the request.
+	PromWriteAuthorizerModeDrop
+)
+
+// PromWriteAuthorizerOptions configures authorizing the series written by
+// Prometheus remote write requests.
+type PromWriteAuthorizerOptions struct {
+	// Authorizer is the authorizer, if nil then all series are allowed.
+	Authorizer PromWriteAuthorizer
+	// Mode is the authorizer mode.
+	Mode PromWriteAuthorizerMode
+}
+
+// PromWriteSeriesObserver is invoked once per series decoded from a Prometheus
+// remote write request, before the series is written. It is called inline on
+// the request path so implementations must be cheap and must not block, the
+// labels are only valid for the duration of the call.
+type PromWriteSeriesObserver func(labels []prompb.Label)
+
+// PromWriteDecodedObserver is invoked once per Prometheus remote write request
+// with the decompressed protobuf body of the request once it has been decoded,
+// such as to forward requests verbatim to another system without re-encoding
+// them. The body is a copy so may be retained, it is called inline on the
+// request path so implementations must not block.
+type PromWriteDecodedObserver func(raw []byte)
+
 // NamespaceValidator defines namespace validation logics.
 type NamespaceValidator interface {
 	// ValidateNewNamespace gets invoked when creating a new namespace.
@@ -70,6 +70,38 @@ func PromLabelsToM3Tags(
 	return tags.AddTags(tagList)
 }
 
+// PromSortedLabelsToM3Tags converts Prometheus labels that are sorted by name
+// to M3 tags, the tags are only sorted if renaming the name or bucket labels
+// with the tag options leaves them out of order.
+func PromSortedLabelsToM3Tags(
+	labels []prompb.Label,
+	tagOptions models.TagOptions,
+) models.Tags {
+	if tagOptions.IDSchemeType() == models.TypeGraphite {
+		// Graphite tags are sorted numerically so always normalize.
+		return PromLabelsToM3Tags(labels, tagOptions)
+	}
+
+	tags := models.NewTags(len(labels), tagOptions)
+	for _, label := range labels {
+		name := label.Name
+		if bytes.Equal(promDefaultName, name) {
+			name = tagOptions.MetricName()
+		} else if bytes.Equal(promDefaultBucketName, name) {
+			name = tagOptions.BucketName()
+		}
+		tags = tags.AddTagWithoutNormalizing(models.Tag{
+			Name:  name,
+			Value: label.Value,
+		})
+	}
+
+	if !sort.IsSorted(tags) {
+		tags = tags.Normalize()
+	}
+	return tags
+}
+
 // PromTimeSeriesToSeriesAttributes extracts the series info from a prometheus
 // timeseries.
 func PromTimeSeriesToSeriesAttributes(series prompb.TimeSeries) (ts.SeriesAttributes, error) {
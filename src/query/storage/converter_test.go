@@ -401,3 +401,24 @@ func TestSeriesAttributesToAnnotationPayload(t *testing.T) {
 	require.NoError(t, err)
 	assert.False(t, payload.HandleValueResets)
 }
+
+func TestSortedLabelConversion(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: promDefaultName, Value: []byte("name-val")},
+		{Name: []byte("foo"), Value: []byte("bar")},
+		{Name: promDefaultBucketName, Value: []byte("bucket-val")},
+	}
+
+	for _, opts := range []models.TagOptions{
+		models.NewTagOptions(),
+		// Renaming the name and bucket labels leaves the tags out of order.
+		models.NewTagOptions().
+			SetMetricName([]byte("name")).
+			SetBucketName([]byte("bucket")),
+	} {
+		expected := PromLabelsToM3Tags(labels, opts)
+		tags := PromSortedLabelsToM3Tags(labels, opts)
+		assert.Equal(t, expected.Tags, tags.Tags)
+		assert.Equal(t, expected.ID(), tags.ID())
+	}
+}
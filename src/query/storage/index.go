@@ -67,6 +67,24 @@ func TagsToIdentTagIterator(tags models.Tags) ident.TagIterator {
 	return ident.NewTagsIterator(ident.NewTags(identTags...))
 }
 
+// TagsToMap returns the tags of the tag iterator as a map of tag name to
+// tag value, for rendering tags when debugging. The tags are read from a
+// duplicate of the iterator so its position is unchanged, and the names
+// and values are copied since the bytes returned by an iterator may be
+// reused once it is advanced. Tags read before an iteration error are
+// returned.
+func TagsToMap(tags ident.TagIterator) map[string]string {
+	iter := tags.Duplicate()
+	defer iter.Close()
+
+	result := make(map[string]string, iter.Remaining())
+	for iter.Next() {
+		tag := iter.Current()
+		result[tag.Name.String()] = tag.Value.String()
+	}
+	return result
+}
+
 // FetchOptionsToM3Options converts a set of coordinator options to M3 options.
 func FetchOptionsToM3Options(fetchOptions *FetchOptions, fetchQuery *FetchQuery) index.QueryOptions {
 	return index.QueryOptions{
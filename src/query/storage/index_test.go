@@ -61,6 +61,18 @@ func TestTagsToIdentTagIterator(t *testing.T) {
 	assert.Equal(t, testTags, tags)
 }
 
+func TestTagsToMap(t *testing.T) {
+	tagIter := makeTagIter()
+	defer tagIter.Close()
+
+	require.True(t, tagIter.Next())
+	assert.Equal(t, map[string]string{"t1": "v1", "t2": "v2"}, TagsToMap(tagIter))
+
+	// The position of the iterator is unchanged.
+	assert.Equal(t, "t1", tagIter.Current().Name.String())
+	assert.Equal(t, 1, tagIter.Remaining())
+}
+
 func TestFromM3IdentToMetric(t *testing.T) {
 	tagIters := makeTagIter()
 	name := []byte("foobarbaz")
@@ -623,7 +623,7 @@ func (s *m3storage) Write(
 		// to stop calling NoFinalize() below if we do that.
 		tags       = query.Tags()
 		datapoints = query.Datapoints()
-		idBuf      = tags.ID()
+		idBuf      = query.ID()
 		id         = ident.BytesID(idBuf)
 	)
 	// Set id to NoFinalize to avoid cloning it in write operations
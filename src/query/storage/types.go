@@ -246,6 +246,10 @@ type WriteQueryOptions struct {
 	Unit       xtime.Unit
 	Annotation []byte
 	Attributes storagemetadata.Attributes
+
+	// ID if set overrides the series ID that is otherwise generated
+	// from the tags.
+	ID []byte
 }
 
 // CompleteTagsQuery represents a query that returns an autocompleted
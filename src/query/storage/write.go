@@ -75,6 +75,15 @@ func (q WriteQuery) Tags() models.Tags {
 	return q.opts.Tags
 }
 
+// ID returns the series ID, which is generated from the tags unless it
+// has been overridden.
+func (q WriteQuery) ID() []byte {
+	if len(q.opts.ID) > 0 {
+		return q.opts.ID
+	}
+	return q.opts.Tags.ID()
+}
+
 // Datapoints returns the datapoints.
 func (q WriteQuery) Datapoints() ts.Datapoints {
 	return q.opts.Datapoints
@@ -106,5 +115,5 @@ func (q WriteQuery) Options() WriteQueryOptions {
 }
 
 func (q *WriteQuery) String() string {
-	return string(q.opts.Tags.ID())
+	return string(q.ID())
 }
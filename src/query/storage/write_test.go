@@ -90,3 +90,28 @@ func TestNewWriteQueryValidateUnit(t *testing.T) {
 	require.Error(t, err)
 	require.True(t, xerrors.IsInvalidParams(err))
 }
+
+func TestWriteQueryID(t *testing.T) {
+	opts := WriteQueryOptions{
+		Tags: models.MustMakeTags("foo", "bar"),
+		Datapoints: ts.Datapoints{
+			{
+				Timestamp: time.Now(),
+				Value:     42,
+			},
+		},
+		Unit: xtime.Second,
+		Attributes: storagemetadata.Attributes{
+			MetricsType: storagemetadata.UnaggregatedMetricsType,
+		},
+	}
+	q, err := NewWriteQuery(opts)
+	require.NoError(t, err)
+	require.Equal(t, opts.Tags.ID(), q.ID())
+
+	opts.ID = []byte("override")
+	q, err = NewWriteQuery(opts)
+	require.NoError(t, err)
+	require.Equal(t, []byte("override"), q.ID())
+	require.Equal(t, "override", q.String())
+}
@@ -45,4 +45,13 @@ const (
 
 	// TemporalDecodeParallel is time taken for a parallel pass decode time.
 	TemporalDecodeParallel = "temporal.parallelProcess.decode"
+
+	// PromWriteServeHTTP is for a remote write request in ServeHTTP.
+	PromWriteServeHTTP = "remote.PromWriteHandler.ServeHTTP"
+
+	// PromWriteParseRequest is for the call to parseRequest in ServeHTTP.
+	PromWriteParseRequest = "remote.PromWriteHandler.parseRequest"
+
+	// PromWriteWrite is for the call to write in ServeHTTP.
+	PromWriteWrite = "remote.PromWriteHandler.write"
 )
@@ -60,6 +60,24 @@ const (
 	// only aggregated namespaces
 	AggregateWriteType = "aggregate"
 
+	// WriteModeHeader is a response header that reports whether the series
+	// of a write request were written directly to storage, downsampled or
+	// both, derived from the write options of the request.
+	// Valid values are "direct", "downsampled" or "both".
+	WriteModeHeader = M3HeaderPrefix + "Write-Mode"
+
+	// DirectWriteMode is the write mode of writes that are only written
+	// directly to storage.
+	DirectWriteMode = "direct"
+
+	// DownsampledWriteMode is the write mode of writes that are only
+	// downsampled.
+	DownsampledWriteMode = "downsampled"
+
+	// BothWriteMode is the write mode of writes that are written directly
+	// to storage and downsampled.
+	BothWriteMode = "both"
+
 	// MetricsStoragePolicyHeader specifies the resolution and retention of
 	// metrics being written or read.
 	// In the form of a storage policy string, e.g. "1m:14d".
@@ -75,6 +93,71 @@ const (
 	// incoming write requests. See `MapTagsOptions` for structure.
 	MapTagsByJSONHeader = M3HeaderPrefix + "Map-Tags-JSON"
 
+	// TimestampOffsetHeader shifts the timestamps of all samples in a write
+	// request by the given duration (e.g. "36h" or "-5m"), which is useful
+	// when replaying captured traffic. It is only honored if the write
+	// handler has been configured to allow it.
+	TimestampOffsetHeader = M3HeaderPrefix + "Timestamp-Offset"
+
+	// TimestampPrecisionHeader sets the precision of the sample timestamps
+	// in a write request, one of "ns", "us", "ms" or "s". Timestamps are
+	// assumed to be in milliseconds if not set.
+	TimestampPrecisionHeader = M3HeaderPrefix + "Timestamp-Precision"
+
+	// AnnotationHeaderPrefix is the prefix of write request headers that
+	// annotate the write with provenance metadata that is not written as
+	// labels, the lowercased remainder of the header name is the annotation
+	// name, e.g. M3-Annotation-Source-Cluster sets source-cluster.
+	AnnotationHeaderPrefix = M3HeaderPrefix + "Annotation-"
+
+	// LabelsSortedHeader marks a write request as having the labels of every
+	// series sorted by name, if set to true and trusted by the server then
+	// the labels are validated to be sorted rather than sorted again.
+	LabelsSortedHeader = M3HeaderPrefix + "Labels-Sorted"
+
+	// IDSchemeHeader selects the ID scheme that the series IDs of a write
+	// request are generated with, such as quoted or prepend_meta, from the
+	// ID schemes allowed by the server. If not set then the ID scheme of the
+	// configured tag options is used.
+	IDSchemeHeader = M3HeaderPrefix + "ID-Scheme"
+
+	// UncompressedHeader marks a write request without a content encoding as
+	// having an uncompressed body, if set to true then the body is parsed as
+	// is rather than decompressed with the default snappy encoding.
+	UncompressedHeader = M3HeaderPrefix + "Uncompressed"
+
+	// PartialSuccessHeader opts a write request in to partial success
+	// responses, if set to true then a write where only some series fail
+	// responds with a success status and reports the failed series rather
+	// than failing the whole request.
+	PartialSuccessHeader = M3HeaderPrefix + "Partial-Success"
+
+	// ResultTrailersHeader opts an HTTP/2 write request in to reporting the
+	// result of the write in trailers, if set to true then a 200 status is
+	// sent before the series are written and the result is reported in the
+	// WriteStatusTrailer, FailedCountTrailer and WriteErrorTrailer trailers.
+	ResultTrailersHeader = M3HeaderPrefix + "Result-Trailers"
+
+	// WriteStatusTrailer is the trailer of writes that report their result
+	// in trailers with the status the write would otherwise respond with.
+	WriteStatusTrailer = M3HeaderPrefix + "Write-Status"
+
+	// FailedCountTrailer is the trailer of writes that report their result
+	// in trailers with the number of series that failed to be written.
+	FailedCountTrailer = M3HeaderPrefix + "Failed-Count"
+
+	// WriteErrorTrailer is the trailer of writes that report their result
+	// in trailers with the error the write failed with, if any.
+	WriteErrorTrailer = M3HeaderPrefix + "Write-Error"
+
+	// SamplesWrittenHeader is the header added to partial success responses
+	// with the number of samples written.
+	SamplesWrittenHeader = M3HeaderPrefix + "Samples-Written"
+
+	// SamplesFailedHeader is the header added to partial success responses
+	// with the number of samples that failed to be written.
+	SamplesFailedHeader = M3HeaderPrefix + "Samples-Failed"
+
 	// LimitMaxSeriesHeader is the M3 limit timeseries header that limits
 	// the number of time series returned by each storage node.
 	LimitMaxSeriesHeader = M3HeaderPrefix + "Limit-Max-Series"
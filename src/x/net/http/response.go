@@ -34,6 +34,15 @@ const (
 	// HeaderContentType is the HTTP Content Type header.
 	HeaderContentType = "Content-Type"
 
+	// HeaderContentEncoding is the HTTP Content Encoding header.
+	HeaderContentEncoding = "Content-Encoding"
+
+	// HeaderAcceptEncoding is the HTTP Accept Encoding header.
+	HeaderAcceptEncoding = "Accept-Encoding"
+
+	// HeaderRetryAfter is the HTTP Retry After header.
+	HeaderRetryAfter = "Retry-After"
+
 	// ContentTypeJSON is the Content-Type value for a JSON response.
 	ContentTypeJSON = "application/json"
 